@@ -72,24 +72,46 @@ func RegisterAccount(domain Domain, state *State) (err error) {
 	return
 }
 
-func SetupProvider(domain Domain, client *lego.Client, f fs.Fs) (err error) {
+// webrootPathPerm parses the webroot options into the PathPerm used for the
+// challenge tokens, owned by the running user unless configured otherwise
+func webrootPathPerm(opts map[string]string) (pp *file.PathPerm, err error) {
+	defaults, err := ValidateInstallDefaults(RawInstallDefaults{})
+	if err != nil {
+		return
+	}
+
+	rpp := RawPathPerm{
+		Path:  opts[AUTHENTICATION_OPTION_PATH],
+		Owner: opts[AUTHENTICATION_OPTION_OWNER],
+		Group: opts[AUTHENTICATION_OPTION_GROUP],
+		Perm:  opts[AUTHENTICATION_OPTION_PERM],
+	}
+	pp, err = ValidatePathPerm(rpp, defaults.PathPermDefaults(false))
+	if err != nil {
+		err = fmt.Errorf("invalid path perm definition in options for %s: %w", AUTHENTICATION_METHOD_HTTP01_WEBROOT, err)
+		return
+	}
+	return
+}
+
+// SetupProvider configures the challenge provider for the domain. The
+// http-01/standalone challenge is served on the matching pre-opened listener,
+// if any, or on a listener bound for the duration of the challenge.
+func SetupProvider(domain Domain, client *lego.Client, f fs.Fs, listeners Listeners) (err error) {
 	opts := domain.Authentication.Options
 	switch domain.Authentication.Method {
 	case AUTHENTICATION_METHOD_HTTP01_STANDALONE:
+		if sp, ok := listeners[StandaloneAddress(domain.Authentication)]; ok {
+			err = client.Challenge.SetHTTP01Provider(sp)
+			break
+		}
 		iface := opts[AUTHENTICATION_OPTION_INTERFACE]
 		port := opts[AUTHENTICATION_OPTION_PORT]
 		err = client.Challenge.SetHTTP01Provider(http01.NewProviderServer(iface, port))
 	case AUTHENTICATION_METHOD_HTTP01_WEBROOT:
-		rpp := RawPathPerm{
-			Path:  opts[AUTHENTICATION_OPTION_PATH],
-			Owner: opts[AUTHENTICATION_OPTION_OWNER],
-			Group: opts[AUTHENTICATION_OPTION_GROUP],
-			Perm:  opts[AUTHENTICATION_OPTION_PERM],
-		}
 		var pp *file.PathPerm
-		pp, err = ValidatePathPerm(rpp)
+		pp, err = webrootPathPerm(opts)
 		if err != nil {
-			err = fmt.Errorf("invalid path perm definition in options for %s: %w", domain.Authentication.Method, err)
 			return
 		}
 		err = client.Challenge.SetHTTP01Provider(webroot.NewWebrootProvider(f, pp))
@@ -120,13 +142,13 @@ func SetupProvider(domain Domain, client *lego.Client, f fs.Fs) (err error) {
 	return
 }
 
-func ObtainCertificate(domain Domain, state *State, f fs.Fs) (err error) {
+func ObtainCertificate(domain Domain, state *State, f fs.Fs, listeners Listeners) (err error) {
 	client, err := GetClient(domain, *state)
 	if err != nil {
 		return
 	}
 
-	err = SetupProvider(domain, client, f)
+	err = SetupProvider(domain, client, f, listeners)
 	if err != nil {
 		err = fmt.Errorf("could not setup provider for ACME challange: %w", err)
 		return
@@ -145,13 +167,13 @@ func ObtainCertificate(domain Domain, state *State, f fs.Fs) (err error) {
 	return
 }
 
-func RenewCertificate(domain Domain, state *State, f fs.Fs) (err error) {
+func RenewCertificate(domain Domain, state *State, f fs.Fs, listeners Listeners) (err error) {
 	client, err := GetClient(domain, *state)
 	if err != nil {
 		return
 	}
 
-	err = SetupProvider(domain, client, f)
+	err = SetupProvider(domain, client, f, listeners)
 	if err != nil {
 		err = fmt.Errorf("could not setup provider for ACME challange: %w", err)
 		return
@@ -166,3 +188,88 @@ func RenewCertificate(domain Domain, state *State, f fs.Fs) (err error) {
 
 	return
 }
+
+// RevokeCertificate revokes the certificate of the domain with the CA and
+// drops it from the state, so that a new one is obtained on the next run
+func RevokeCertificate(domain Domain, state *State) (err error) {
+	if state.ACME.Empty() {
+		err = fmt.Errorf("%w: no certificate to revoke for domain %s", MissingCertificate, domain.Domain)
+		return
+	}
+
+	client, err := GetClient(domain, *state)
+	if err != nil {
+		return
+	}
+
+	if err = client.Certificate.Revoke(state.ACME.Certificate); err != nil {
+		err = fmt.Errorf("could not revoke certificate through ACME: %w", err)
+		return
+	}
+	state.ACME = ACMEState{}
+
+	return
+}
+
+// DeactivateAccount deactivates the account of the domain with the CA and
+// drops its registration from the state. A new account is registered, with
+// a new key, on the next run.
+func DeactivateAccount(domain Domain, state *State) (err error) {
+	if state.Account.Registration == nil {
+		err = fmt.Errorf("account for domain %s is not registered", domain.Domain)
+		return
+	}
+
+	client, err := GetClient(domain, *state)
+	if err != nil {
+		return
+	}
+
+	if err = client.Registration.DeleteRegistration(); err != nil {
+		err = fmt.Errorf("could not deactivate account through ACME: %w", err)
+		return
+	}
+	account, err := NewState(domain)
+	if err != nil {
+		return
+	}
+	state.Account = account.Account
+
+	return
+}
+
+// ACME performs the protocol work for domains, which needs no privileges
+// other than serving the challenges
+type ACME interface {
+	Register(domain Domain, state *State) error
+	Obtain(domain Domain, state *State) error
+	Renew(domain Domain, state *State) error
+	Revoke(domain Domain, state *State) error
+	Deactivate(domain Domain, state *State) error
+}
+
+// LocalACME performs the ACME work in the running process
+type LocalACME struct {
+	Fs        fs.Fs
+	Listeners Listeners
+}
+
+func (l LocalACME) Register(domain Domain, state *State) error {
+	return RegisterAccount(domain, state)
+}
+
+func (l LocalACME) Obtain(domain Domain, state *State) error {
+	return ObtainCertificate(domain, state, l.Fs, l.Listeners)
+}
+
+func (l LocalACME) Renew(domain Domain, state *State) error {
+	return RenewCertificate(domain, state, l.Fs, l.Listeners)
+}
+
+func (l LocalACME) Revoke(domain Domain, state *State) error {
+	return RevokeCertificate(domain, state)
+}
+
+func (l LocalACME) Deactivate(domain Domain, state *State) error {
+	return DeactivateAccount(domain, state)
+}
@@ -0,0 +1,72 @@
+package standalone
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"golang.org/x/exp/slog"
+)
+
+// StandaloneProvider answers http-01 challenges on a listener which has been
+// opened beforehand, possibly by a more privileged process. The listener is
+// served from the first challenge onwards and kept open across domains.
+type StandaloneProvider struct {
+	listener net.Listener
+	serve    sync.Once
+
+	mu     sync.RWMutex
+	tokens map[string]string
+}
+
+func NewStandaloneProvider(listener net.Listener) *StandaloneProvider {
+	return &StandaloneProvider{
+		listener: listener,
+		tokens:   map[string]string{},
+	}
+}
+
+func (sp *StandaloneProvider) Listener() net.Listener {
+	return sp.listener
+}
+
+func (sp *StandaloneProvider) Present(domain, token, keyAuth string) (err error) {
+	slog.Info("serving token on listener", "domain", domain, "token", token, "address", sp.listener.Addr())
+	sp.mu.Lock()
+	sp.tokens[http01.ChallengePath(token)] = keyAuth
+	sp.mu.Unlock()
+
+	sp.serve.Do(func() {
+		go func() {
+			if err := http.Serve(sp.listener, sp); err != nil {
+				slog.Warn("stopped serving challenges", "address", sp.listener.Addr(), "err", err)
+			}
+		}()
+	})
+	return
+}
+
+func (sp *StandaloneProvider) CleanUp(domain, token, keyAuth string) (err error) {
+	slog.Info("removing token from listener", "domain", domain, "token", token, "address", sp.listener.Addr())
+	sp.mu.Lock()
+	delete(sp.tokens, http01.ChallengePath(token))
+	sp.mu.Unlock()
+	return
+}
+
+func (sp *StandaloneProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sp.mu.RLock()
+	keyAuth, ok := sp.tokens[r.URL.Path]
+	sp.mu.RUnlock()
+
+	if r.Method != http.MethodGet || !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := w.Write([]byte(keyAuth)); err != nil {
+		slog.Warn("could not write challenge response", "path", r.URL.Path, "err", err)
+	}
+}
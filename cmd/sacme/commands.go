@@ -0,0 +1,751 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/lucat1/sacme"
+	"github.com/lucat1/sacme/pkg/file"
+	"github.com/lucat1/sacme/pkg/systemd"
+	fs "github.com/spf13/afero"
+)
+
+// command is a subcommand of sacme, with its own flags following its name
+type command struct {
+	name string
+	// the positional arguments, for the usage
+	args  string
+	help  string
+	flags *flag.FlagSet
+	run   func(slog *slog.Logger, args []string) int
+}
+
+func newCommand(opts *options, name, args, help string) *command {
+	c := &command{
+		name:  name,
+		args:  args,
+		help:  help,
+		flags: flag.NewFlagSet("sacme "+name, flag.ExitOnError),
+	}
+	opts.registerGlobal(c.flags)
+	c.flags.Usage = func() {
+		fmt.Fprintf(c.flags.Output(), "usage: sacme %s [flags] %s\n\n%s\n\nflags:\n", c.name, c.args, c.help)
+		c.flags.PrintDefaults()
+	}
+	return c
+}
+
+// usage reports an invalid command line and returns EXIT_INVALID
+func (c *command) usage(format string, a ...any) int {
+	fmt.Fprintf(c.flags.Output(), "sacme %s: %s\n", c.name, fmt.Sprintf(format, a...))
+	c.flags.Usage()
+	return EXIT_INVALID
+}
+
+func commands(opts *options) []*command {
+	return []*command{
+		newRunCommand(opts),
+		newStatusCommand(opts),
+		newForecastCommand(opts),
+		newValidateCommand(opts),
+		newRenewCommand(opts),
+		newRevokeCommand(opts),
+		newReinstallCommand(opts),
+		newExportCommand(opts),
+		newAccountCommand(opts),
+	}
+}
+
+// dispatch parses the command line and runs the requested command, returning
+// its exit code. Global flags can precede the command name. Without a
+// command, run is executed and its flags are accepted as global flags, as
+// they were before sacme had commands.
+func dispatch(slog *slog.Logger, args []string) int {
+	var opts options
+	return dispatchCommands(slog, args, &opts, commands(&opts))
+}
+
+// dispatchCommands is dispatch, among cmds sharing opts, the first of which
+// is run
+func dispatchCommands(slog *slog.Logger, args []string, opts *options, cmds []*command) int {
+	run := cmds[0]
+
+	global := flag.NewFlagSet("sacme", flag.ExitOnError)
+	opts.registerGlobal(global)
+	root := flag.NewFlagSet("sacme", flag.ExitOnError)
+	run.flags.VisitAll(func(f *flag.Flag) {
+		root.Var(f.Value, f.Name, f.Usage)
+	})
+	root.Usage = func() {
+		out := root.Output()
+		fmt.Fprintf(out, "usage: sacme [flags] [command] [command flags] [arguments]\n\ncommands:\n")
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		for _, c := range cmds {
+			fmt.Fprintf(w, "  %s %s\t%s\n", c.name, c.args, c.help)
+		}
+		w.Flush()
+		fmt.Fprintf(out, "\nflags:\n")
+		global.PrintDefaults()
+		fmt.Fprintf(out, "\nRun 'sacme help <command>' for the flags of a command.\n")
+	}
+	root.Parse(args)
+
+	if root.NArg() <= 0 {
+		return run.run(slog, nil)
+	}
+	name := root.Arg(0)
+	if name == "help" {
+		for _, c := range cmds {
+			if c.name == root.Arg(1) {
+				c.flags.SetOutput(os.Stdout)
+				c.flags.Usage()
+				return EXIT_OK
+			}
+		}
+		root.SetOutput(os.Stdout)
+		root.Usage()
+		return EXIT_OK
+	}
+
+	i := slices.IndexFunc(cmds, func(c *command) bool { return c.name == name })
+	if i < 0 {
+		fmt.Fprintf(root.Output(), "sacme: unknown command %s\n", name)
+		root.Usage()
+		return EXIT_INVALID
+	}
+	c := cmds[i]
+	if c != run {
+		misplaced := ""
+		root.Visit(func(f *flag.Flag) {
+			if global.Lookup(f.Name) == nil {
+				misplaced = f.Name
+			}
+		})
+		if len(misplaced) > 0 {
+			return c.usage("flag -%s must follow the run command", misplaced)
+		}
+	}
+	c.flags.Parse(root.Args()[1:])
+	return c.run(slog, c.flags.Args())
+}
+
+// env is what the commands load from the global flags
+type env struct {
+	opts    options
+	config  *sacme.Config
+	files   []string
+	domains []sacme.Domain
+	rootFS  fs.Fs
+	store   *sacme.StateStore
+
+	// set up by connect
+	listeners sacme.Listeners
+	activated []net.Listener
+}
+
+// load loads the config and the domain definitions. On failure, the reason is
+// logged and the exit code returned.
+func load(slog *slog.Logger, opts options) (e *env, code int) {
+	config, files, domains, err := loadDomains(opts)
+	if err != nil {
+		slog.Error("could not load domains", err)
+		code = EXIT_SETUP
+		return
+	}
+
+	rootFS := fs.NewOsFs()
+	if config.Privileges != nil {
+		slog.Info("running rootless", "uid", config.Privileges.Uid)
+		rootFS = file.NewRootlessFs(rootFS)
+	}
+
+	slog.Info("loaded domains", "len", len(domains))
+	for _, domain := range domains {
+		slog.Info("definition for", "domain", domain.Domain, "account", domain.Account, "authentication", domain.Authentication)
+	}
+
+	if duplicate := checkForDuplicateDomains(domains); duplicate != nil {
+		slog.Error("duplicate domain", nil, "domain", *duplicate)
+		code = EXIT_INVALID
+		return
+	}
+
+	store := sacme.NewStateStore(fs.NewBasePathFs(rootFS, opts.stateStorePath))
+	e = &env{
+		opts:    opts,
+		config:  config,
+		files:   files,
+		domains: domains,
+		rootFS:  rootFS,
+		store:   &store,
+	}
+	return
+}
+
+// connect sets up the challenge listeners and the ACME work, returning a
+// runner for the domains. On failure, the reason is logged and the exit code
+// returned.
+func (e *env) connect(slog *slog.Logger) (r *runner, code int) {
+	activated, err := systemd.Listeners()
+	if err != nil {
+		slog.Error("could not use socket activated listeners", err)
+		code = EXIT_SETUP
+		return
+	}
+	listeners := sacme.Listeners{}
+	if err = setupListeners(listeners, e.config, e.domains, activated); err != nil {
+		slog.Error("could not setup challenge listeners", err)
+		code = EXIT_SETUP
+		return
+	}
+	if len(activated) > 0 {
+		slog.Info("using socket activated listeners", "len", len(activated))
+	}
+	e.listeners, e.activated = listeners, activated
+
+	var acme sacme.ACME = sacme.LocalACME{Fs: e.rootFS, Listeners: listeners}
+	if e.config.ACMEUser != nil {
+		acme, err = sacme.NewHelperACME(e.config.ACMEUser, e.config.ACMEGroup, listeners)
+		if err != nil {
+			slog.Error("could not setup unprivileged ACME helper", err)
+			code = EXIT_SETUP
+			return
+		}
+		slog.Info("performing ACME work unprivileged", "user", e.config.ACMEUser.Username, "group", e.config.ACMEGroup.Name, "listeners", len(listeners))
+	}
+
+	r = &runner{
+		store:     e.store,
+		acme:      acme,
+		fs:        e.rootFS,
+		skipHooks: e.opts.skipHooks,
+	}
+	return
+}
+
+// selectDomains returns the domains with the given names, in the order of the
+// definitions, or all domains if no name is given
+func (e *env) selectDomains(names []string) (domains []sacme.Domain, err error) {
+	for _, name := range names {
+		if !slices.ContainsFunc(e.domains, func(d sacme.Domain) bool { return d.Domain == name }) {
+			err = fmt.Errorf("no definition for domain %s", name)
+			return
+		}
+	}
+	for _, domain := range e.domains {
+		if len(names) <= 0 || slices.ContainsFunc(names, func(name string) bool { return name == domain.Domain }) {
+			domains = append(domains, domain)
+		}
+	}
+	return
+}
+
+// process processes the domains named in args, or all of them, running the
+// deferred hooks and summarizing the outcome
+func (c *command) process(slog *slog.Logger, opts *options, args []string, configure func(r *runner)) int {
+	if opts.jobs < 1 {
+		return c.usage("invalid number of jobs %d", opts.jobs)
+	}
+	e, code := load(slog, *opts)
+	if e == nil {
+		return code
+	}
+	domains, err := e.selectDomains(args)
+	if err == nil {
+		err = opts.checkSelection(e.domains)
+	}
+	if err != nil {
+		return c.usage("%v", err)
+	}
+	selected := []sacme.Domain{}
+	for _, domain := range domains {
+		if opts.selects(domain.Domain) {
+			selected = append(selected, domain)
+		}
+	}
+	domains = selected
+	if opts.dryRun {
+		r := &runner{store: e.store, fs: e.rootFS, skipHooks: opts.skipHooks, forceRenew: opts.forceRenew}
+		configure(r)
+		return r.planAll(slog, os.Stdout, domains)
+	}
+	r, code := e.connect(slog)
+	if r == nil {
+		return code
+	}
+	r.forceRenew = opts.forceRenew
+	configure(r)
+
+	results := r.processAll(slog, domains, opts.jobs)
+	hooksFailed := runDeferred(slog, results)
+	return summarize(slog, results, hooksFailed)
+}
+
+func newRunCommand(opts *options) *command {
+	c := newCommand(opts, "run", "", "obtain, renew and install the certificates of all domains as needed (the default)")
+	opts.registerProcess(c.flags)
+	daemon := c.flags.Bool("daemon", false, "keep running, renewing each certificate when it is due")
+	c.run = func(slog *slog.Logger, args []string) int {
+		if len(args) > 0 {
+			return c.usage("unexpected arguments %v", args)
+		}
+		if !*daemon {
+			return c.process(slog, opts, nil, func(r *runner) {})
+		}
+		if opts.dryRun {
+			return c.usage("-dry-run cannot be used with -daemon")
+		}
+		if opts.forceRenew {
+			return c.usage("-force-renew cannot be used with -daemon")
+		}
+
+		if opts.jobs < 1 {
+			return c.usage("invalid number of jobs %d", opts.jobs)
+		}
+		e, code := load(slog, *opts)
+		if e == nil {
+			return code
+		}
+		if err := opts.checkSelection(e.domains); err != nil {
+			return c.usage("%v", err)
+		}
+		r, code := e.connect(slog)
+		if r == nil {
+			return code
+		}
+		d := newDaemon(*opts, r, e.config, e.files, e.domains, e.listeners, e.activated)
+		return d.run(slog)
+	}
+	return c
+}
+
+func newRenewCommand(opts *options) *command {
+	c := newCommand(opts, "renew", "[domain...]", "renew the certificates of the given domains, or of all domains, which are due")
+	opts.registerProcess(c.flags)
+	c.flags.BoolVar(&opts.forceRenew, "force", false, "renew the certificates even if they are not due, like -force-renew")
+	c.run = func(slog *slog.Logger, args []string) int {
+		return c.process(slog, opts, args, func(r *runner) {})
+	}
+	return c
+}
+
+func newReinstallCommand(opts *options) *command {
+	c := newCommand(opts, "reinstall", "[domain...]", "install the files of the given domains, or of all domains, again and run their hooks")
+	opts.registerProcess(c.flags)
+	c.run = func(slog *slog.Logger, args []string) int {
+		return c.process(slog, opts, args, func(r *runner) {
+			r.reinstall = true
+		})
+	}
+	return c
+}
+
+func newValidateCommand(opts *options) *command {
+	c := newCommand(opts, "validate", "", "check the global config and all domain files, reporting every problem found")
+	c.run = func(slog *slog.Logger, args []string) int {
+		if len(args) > 0 {
+			return c.usage("unexpected arguments %v", args)
+		}
+
+		diagnostics, domains, err := validate(*opts)
+		if err != nil {
+			slog.Error("could not validate the definitions", err)
+			return EXIT_SETUP
+		}
+		problems := 0
+		for _, d := range diagnostics {
+			fmt.Println(d)
+			if !d.Warning {
+				problems++
+			}
+		}
+		if problems > 0 {
+			fmt.Printf("%d problems found\n", problems)
+			return EXIT_INVALID
+		}
+		fmt.Printf("%d domains are valid\n", domains)
+		return EXIT_OK
+	}
+	return c
+}
+
+// validate checks the global config and the domain files. The domain files
+// are checked against the built-in defaults when the config is not valid.
+func validate(opts options) (diagnostics []sacme.Diagnostic, domains int, err error) {
+	configPath := opts.configPath
+	if len(configPath) <= 0 {
+		configPath = filepath.Join(opts.domainsPath, sacme.CONFIG_FILE_NAME)
+	}
+	config, err := sacme.ValidateConfig(sacme.RawConfig{})
+	if err != nil {
+		return
+	}
+	content, err := os.ReadFile(configPath)
+	if err == nil {
+		var c *sacme.Config
+		c, diagnostics = sacme.ParseConfigFile(configPath, content)
+		if c != nil {
+			config = c
+		}
+	} else if len(opts.configPath) > 0 || !errors.Is(err, os.ErrNotExist) {
+		err = fmt.Errorf("could not read config file: %w", err)
+		return
+	}
+
+	valid, diags, err := sacme.ValidateDomainFiles(os.DirFS(opts.domainsPath), *config)
+	if err != nil {
+		return
+	}
+	for _, d := range diags {
+		d.File = filepath.Join(opts.domainsPath, d.File)
+		diagnostics = append(diagnostics, d)
+	}
+	domains = len(valid)
+	return
+}
+
+func newStatusCommand(opts *options) *command {
+	c := newCommand(opts, "status", "[domain...]", "show the certificates of the given domains, or of all domains, and whether their installed files are in sync")
+	asJSON := c.flags.Bool("json", false, "print the status as JSON")
+	effective := c.flags.Bool("effective", false, "also show the definition of each domain, with the defaults of the global config applied")
+	c.run = func(slog *slog.Logger, args []string) int {
+		e, code := load(slog, *opts)
+		if e == nil {
+			return code
+		}
+		domains, err := e.selectDomains(args)
+		if err != nil {
+			return c.usage("%v", err)
+		}
+
+		code = EXIT_OK
+		now := time.Now()
+		statuses := []*sacme.DomainStatus{}
+		for _, domain := range domains {
+			var status *sacme.DomainStatus
+			state, err := e.store.Load(domain)
+			if err == nil {
+				status, err = state.Status(domain, e.rootFS, now)
+			}
+			if err != nil {
+				slog.Error("could not read domain status", err, "domain", domain.Domain)
+				code = EXIT_PARTIAL_FAILURE
+				continue
+			}
+			if *effective {
+				config := domain.Config()
+				status.Config = &config
+			}
+			statuses = append(statuses, status)
+		}
+
+		if *asJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(statuses); err != nil {
+				slog.Error("could not encode status", err)
+				return EXIT_FAILURE
+			}
+			return code
+		}
+		printStatus(os.Stdout, statuses)
+		return code
+	}
+	return c
+}
+
+// printStatus prints the status of each domain as a table
+func printStatus(out io.Writer, statuses []*sacme.DomainStatus) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for i, status := range statuses {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		account := status.Account
+		if len(account) <= 0 {
+			account = "not registered"
+		}
+		fmt.Fprintf(w, "%s\t\n", status.Domain)
+		fmt.Fprintf(w, "  account\t%s (%s)\n", status.Email, account)
+		fmt.Fprintf(w, "  directory\t%s\n", status.Directory)
+
+		if cert := status.Certificate; cert != nil {
+			fmt.Fprintf(w, "  sans\t%s\n", strings.Join(cert.SANs, ", "))
+			fmt.Fprintf(w, "  issuer\t%s\n", cert.Issuer)
+			fmt.Fprintf(w, "  serial\t%s\n", cert.Serial)
+			fmt.Fprintf(w, "  not before\t%s\n", cert.NotBefore.Format(time.RFC3339))
+			fmt.Fprintf(w, "  not after\t%s (%d days left)\n", cert.NotAfter.Format(time.RFC3339), cert.DaysLeft)
+			fmt.Fprintf(w, "  next renewal\t%s\n", cert.NextRenewal.Format(time.RFC3339))
+		} else {
+			fmt.Fprintf(w, "  certificate\tnot issued yet\n")
+		}
+
+		if len(status.Files) <= 0 {
+			fmt.Fprintf(w, "  installs\tnone\n")
+		}
+		for j, file := range status.Files {
+			label := ""
+			if j == 0 {
+				label = "installs"
+			}
+			sync := "in sync"
+			if !file.InSync {
+				sync = "out of sync: " + file.Problem
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", label, file.Path, sync)
+		}
+		if status.Config != nil {
+			printConfig(w, *status.Config)
+		}
+	}
+	w.Flush()
+}
+
+// printConfig prints the effective definition of a domain as rows of the
+// status table
+func printConfig(w io.Writer, config sacme.DomainConfig) {
+	tos := "not accepted"
+	if config.AcceptTOS {
+		tos = "accepted"
+	}
+	fmt.Fprintf(w, "  key type\t%s (terms of service %s)\n", config.KeyType, tos)
+
+	options := []string{}
+	for key, val := range config.Authentication.Options {
+		options = append(options, key+"="+val)
+	}
+	sort.Strings(options)
+	fmt.Fprintf(w, "  authentication\t%s %s\n", config.Authentication.Method, strings.Join(options, " "))
+
+	if len(config.RenewalBeforeExpiry) > 0 {
+		fmt.Fprintf(w, "  renewal\t%s before expiry\n", config.RenewalBeforeExpiry)
+	} else {
+		fmt.Fprintf(w, "  renewal\tafter %g%% of the validity\n", config.RenewalFraction*100)
+	}
+
+	context := func(ctx sacme.HookContextConfig) (s string) {
+		if len(ctx.User) > 0 {
+			s += fmt.Sprintf(", as %s:%s", ctx.User, ctx.Group)
+		}
+		if len(ctx.Dir) > 0 {
+			s += ", in " + ctx.Dir
+		}
+		if ctx.Env != nil {
+			s += fmt.Sprintf(", environment [%s]", strings.Join(ctx.Env, " "))
+		}
+		return
+	}
+	hooks := func(label string, hooks []sacme.HookConfig) {
+		for _, hook := range hooks {
+			deferred := ""
+			if hook.Deferred {
+				deferred = ", deferred"
+			}
+			fmt.Fprintf(w, "  %s\t%s (timeout %s, on failure %s%s%s)\n", label, hook.Command, hook.Timeout, hook.OnFailure, deferred, context(hook.HookContextConfig))
+			label = ""
+		}
+	}
+	for _, name := range []string{"pre_issue", "post_issue", "on_renew_failure", "on_uninstall"} {
+		hooks(name, config.Hooks[name])
+	}
+
+	file := func(f sacme.FileConfig) string {
+		return fmt.Sprintf("%s (mode %s, owner %s:%s)", f.Path, f.Mode, f.Owner, f.Group)
+	}
+	for j, install := range config.Installs {
+		label := fmt.Sprintf("install %d", j)
+		for _, f := range install.Files {
+			fmt.Fprintf(w, "  %s\t%s\n", label, file(f))
+			label = ""
+		}
+		if install.Dir != nil {
+			fmt.Fprintf(w, "  %s\t%s -> %s\n", label, install.Link, file(*install.Dir))
+			label = ""
+		}
+		hooks(label, install.Hooks)
+		if len(install.Reload) > 0 {
+			as := ""
+			if len(install.ReloadUser) > 0 {
+				as = fmt.Sprintf(" (as %s:%s)", install.ReloadUser, install.ReloadGroup)
+			}
+			fmt.Fprintf(w, "  \treload %s%s\n", install.Reload, as)
+		}
+	}
+}
+
+func newRevokeCommand(opts *options) *command {
+	c := newCommand(opts, "revoke", "domain...", "revoke the certificates of the given domains, which are obtained again on the next run")
+	c.run = func(slog *slog.Logger, args []string) int {
+		if len(args) <= 0 {
+			return c.usage("no domain given")
+		}
+		return c.acme(slog, opts, args, "revoked certificate", func(r *runner, domain sacme.Domain, state *sacme.State) error {
+			return r.acme.Revoke(domain, state)
+		})
+	}
+	return c
+}
+
+// acme performs an ACME operation on each of the domains named in args, or
+// on all of them, saving their state when it succeeds
+func (c *command) acme(slog *slog.Logger, opts *options, args []string, done string, op func(r *runner, domain sacme.Domain, state *sacme.State) error) int {
+	e, code := load(slog, *opts)
+	if e == nil {
+		return code
+	}
+	domains, err := e.selectDomains(args)
+	if err != nil {
+		return c.usage("%v", err)
+	}
+	r, code := e.connect(slog)
+	if r == nil {
+		return code
+	}
+
+	results := []domainResult{}
+	for _, domain := range domains {
+		logger := slog.With("domain", domain.Domain)
+		res := domainResult{Domain: domain.Domain}
+		state, err := r.store.Load(domain)
+		if err == nil {
+			err = op(r, domain, state)
+		}
+		if err == nil {
+			err = saveState(&logger, r.store, domain, state, c.name)
+		}
+		if err == nil {
+			logger.Info(done)
+			res.Modified = true
+		}
+		res.Err = err
+		results = append(results, res)
+	}
+	return summarize(slog, results, false)
+}
+
+func newExportCommand(opts *options) *command {
+	c := newCommand(opts, "export", "domain", "write the certificate of a domain, or other parts of it, to standard output or a file")
+	parts := c.flags.String("parts", string(sacme.INSTALL_PART_FULLCHAIN), "comma separated parts to export, one of key, crt, ca, leaf, chain and fullchain")
+	out := c.flags.String("out", "-", "file to write to, created with mode 0600, or - for standard output")
+	c.run = func(slog *slog.Logger, args []string) int {
+		if len(args) != 1 {
+			return c.usage("expected a single domain")
+		}
+		exported := []sacme.InstallPart{}
+		for _, part := range strings.Split(*parts, ",") {
+			if !sacme.VALID_INSTALL_PARTS[sacme.InstallPart(part)] {
+				return c.usage("invalid part %s", part)
+			}
+			exported = append(exported, sacme.InstallPart(part))
+		}
+		e, code := load(slog, *opts)
+		if e == nil {
+			return code
+		}
+		domains, err := e.selectDomains(args)
+		if err != nil {
+			return c.usage("%v", err)
+		}
+
+		state, err := e.store.Load(domains[0])
+		if err == nil && state.ACME.Empty() {
+			err = fmt.Errorf("no certificate for domain %s", domains[0].Domain)
+		}
+		content := []byte{}
+		for _, part := range exported {
+			if err != nil {
+				break
+			}
+			var p []byte
+			p, err = state.ACME.Part(part)
+			content = append(content, p...)
+		}
+		if err == nil {
+			if *out == "-" {
+				_, err = os.Stdout.Write(content)
+			} else {
+				err = os.WriteFile(*out, content, 0600)
+			}
+		}
+		if err != nil {
+			slog.Error("could not export certificate", err, "domain", domains[0].Domain)
+			return EXIT_FAILURE
+		}
+		return EXIT_OK
+	}
+	return c
+}
+
+func newAccountCommand(opts *options) *command {
+	c := newCommand(opts, "account", "show|register|deactivate [domain...]", "show, register or deactivate the ACME accounts of the given domains, or of all domains")
+	c.run = func(slog *slog.Logger, args []string) int {
+		if len(args) <= 0 {
+			return c.usage("no action given")
+		}
+		// flags can also follow the action
+		action := args[0]
+		c.flags.Parse(args[1:])
+		args = c.flags.Args()
+		switch action {
+		case "show":
+			return c.showAccounts(slog, opts, args)
+		case "register":
+			return c.acme(slog, opts, args, "registered account", func(r *runner, domain sacme.Domain, state *sacme.State) error {
+				if state.IsRegistered() {
+					return nil
+				}
+				return r.acme.Register(domain, state)
+			})
+		case "deactivate":
+			if len(args) <= 0 {
+				return c.usage("no domain given")
+			}
+			return c.acme(slog, opts, args, "deactivated account", func(r *runner, domain sacme.Domain, state *sacme.State) error {
+				return r.acme.Deactivate(domain, state)
+			})
+		}
+		return c.usage("unknown action %s", action)
+	}
+	return c
+}
+
+func (c *command) showAccounts(slog *slog.Logger, opts *options, args []string) int {
+	e, code := load(slog, *opts)
+	if e == nil {
+		return code
+	}
+	domains, err := e.selectDomains(args)
+	if err != nil {
+		return c.usage("%v", err)
+	}
+
+	code = EXIT_OK
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DOMAIN\tEMAIL\tDIRECTORY\tACCOUNT")
+	for _, domain := range domains {
+		account := "-"
+		state, err := e.store.Load(domain)
+		if err != nil {
+			slog.Error("could not load domain state", err, "domain", domain.Domain)
+			code = EXIT_PARTIAL_FAILURE
+		} else if state.IsRegistered() {
+			account = state.Account.Registration.URI
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", domain.Domain, domain.Account.Email, domain.Account.Directroy, account)
+	}
+	w.Flush()
+	return code
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+func TestDispatch(t *testing.T) {
+	defaults := func(set func(o *options)) (o options) {
+		f := flag.NewFlagSet("defaults", flag.ContinueOnError)
+		o.registerGlobal(f)
+		o.registerProcess(f)
+		set(&o)
+		return
+	}
+
+	for _, test := range []struct {
+		name string
+		args []string
+		code int
+		// the command run with its arguments, if any
+		ran     string
+		ranArgs []string
+		opts    options
+	}{
+		{"default", nil, EXIT_OK, "run", nil, defaults(func(o *options) {})},
+		{
+			"default with run flags", []string{"-jobs", "2", "-only", "a.test,b.test", "-only", "c.test"}, EXIT_OK, "run", nil,
+			defaults(func(o *options) { o.jobs, o.only = 2, domainsFlag{"a.test", "b.test", "c.test"} }),
+		},
+		{"run", []string{"run", "-dry-run"}, EXIT_OK, "run", []string{}, defaults(func(o *options) { o.dryRun = true })},
+		{
+			"global flags before the command", []string{"-domains-path", "/domains", "status", "a.test"}, EXIT_OK, "status", []string{"a.test"},
+			defaults(func(o *options) { o.domainsPath = "/domains" }),
+		},
+		{
+			"command flags", []string{"renew", "-force", "-exclude", "b.test", "-config", "/sacme.toml", "a.test"}, EXIT_OK, "renew", []string{"a.test"},
+			defaults(func(o *options) { o.forceRenew, o.exclude, o.configPath = true, domainsFlag{"b.test"}, "/sacme.toml" }),
+		},
+		{"run flags before another command", []string{"-jobs", "2", "renew"}, EXIT_INVALID, "", nil, defaults(func(o *options) { o.jobs = 2 })},
+		{"unknown command", []string{"bogus"}, EXIT_INVALID, "", nil, defaults(func(o *options) {})},
+		{"help", []string{"help", "renew"}, EXIT_OK, "", nil, defaults(func(o *options) {})},
+	} {
+		var opts options
+		cmds := commands(&opts)
+		ran, ranArgs := "", []string(nil)
+		for _, c := range cmds {
+			name := c.name
+			c.run = func(_ *slog.Logger, args []string) int {
+				ran, ranArgs = name, args
+				return EXIT_OK
+			}
+		}
+
+		assert.Equal(t, test.code, dispatchCommands(testLogger(), test.args, &opts, cmds), test.name)
+		assert.Equal(t, test.ran, ran, test.name)
+		assert.Equal(t, test.ranArgs, ranArgs, test.name)
+		assert.Equal(t, test.opts, opts, test.name)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/exp/slog"
+
+	"github.com/lucat1/sacme"
+)
+
+// daemon keeps the certificates of all domains up to date, processing each
+// domain again when its renewal is due or its definition changes
+type daemon struct {
+	opts      options
+	runner    *runner
+	config    *sacme.Config
+	domains   []sacme.Domain
+	listeners sacme.Listeners
+	activated []net.Listener
+	// the domain defined by each domain file
+	files map[string]string
+
+	// when each domain is due to be processed again, and how many times in
+	// a row it failed
+	next     map[string]time.Time
+	failures map[string]int
+}
+
+func newDaemon(opts options, r *runner, config *sacme.Config, files []string, domains []sacme.Domain, listeners sacme.Listeners, activated []net.Listener) *daemon {
+	return &daemon{
+		opts:      opts,
+		runner:    r,
+		config:    config,
+		domains:   domains,
+		listeners: listeners,
+		activated: activated,
+		files:     domainFiles(files, domains),
+		next:      map[string]time.Time{},
+		failures:  map[string]int{},
+	}
+}
+
+func domainFiles(files []string, domains []sacme.Domain) map[string]string {
+	m := map[string]string{}
+	for i, file := range files {
+		m[file] = domains[i].Domain
+	}
+	return m
+}
+
+// run processes the due domains and sleeps until the next one is due, until
+// SIGTERM or SIGINT. SIGHUP reloads the domain definitions, and changes to
+// the domain files are applied as they happen. Signals and changes received
+// while domains are being processed are handled once they are done.
+func (d *daemon) run(slog *slog.Logger) int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	var events chan fsnotify.Event
+	var watchErrors chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(d.opts.domainsPath)
+	}
+	if err != nil {
+		slog.Error("could not watch domains path, changes are only applied on SIGHUP", err, "path", d.opts.domainsPath)
+	} else {
+		defer watcher.Close()
+		events, watchErrors = watcher.Events, watcher.Errors
+		slog.Info("watching domains path", "path", d.opts.domainsPath)
+	}
+
+	// files changed since they were last reconciled
+	changed := map[string]bool{}
+	var settle <-chan time.Time
+	for {
+		now := time.Now()
+		due := []sacme.Domain{}
+		for _, domain := range d.domains {
+			if d.opts.selects(domain.Domain) && !d.next[domain.Domain].After(now) {
+				due = append(due, domain)
+			}
+		}
+		if len(due) > 0 {
+			results := d.runner.processAll(slog, due, d.opts.jobs)
+			hooksFailed := runDeferred(slog, results)
+			summarize(slog, results, hooksFailed)
+			for i, res := range results {
+				d.schedule(slog, due[i], res, time.Now())
+			}
+		}
+
+		wake, next := time.Now().Add(sacme.DAEMON_MAX_INTERVAL), ""
+		for _, domain := range d.domains {
+			if at := d.next[domain.Domain]; d.opts.selects(domain.Domain) && at.Before(wake) {
+				wake, next = at, domain.Domain
+			}
+		}
+		slog.Info("sleeping until next renewal", "until", wake, "domain", next)
+
+		timer := time.NewTimer(time.Until(wake))
+	wait:
+		for {
+			select {
+			case <-timer.C:
+				break wait
+			case event := <-events:
+				name := filepath.Base(event.Name)
+				if event.Op == fsnotify.Chmod || !d.watched(name) {
+					continue
+				}
+				slog.Debug("domain file changed", "file", name, "op", event.Op)
+				changed[name] = true
+				settle = time.After(sacme.DAEMON_WATCH_DELAY)
+			case err := <-watchErrors:
+				if errors.Is(err, fsnotify.ErrEventOverflow) {
+					// changes may have been missed
+					changed[sacme.CONFIG_FILE_NAME] = true
+					settle = time.After(sacme.DAEMON_WATCH_DELAY)
+				}
+				slog.Warn("error while watching domains path", "err", err)
+			case <-settle:
+				settle = nil
+				d.reconcile(slog, changed)
+				changed = map[string]bool{}
+				break wait
+			case sig := <-signals:
+				if sig != syscall.SIGHUP {
+					timer.Stop()
+					slog.Info("shutting down", "signal", sig)
+					return EXIT_OK
+				}
+				slog.Info("reloading domains", "signal", sig)
+				d.reloadAll(slog)
+				break wait
+			}
+		}
+		timer.Stop()
+	}
+}
+
+// watched reports whether changes to a file in the domains path are applied
+func (d *daemon) watched(name string) bool {
+	return sacme.IsDomainFile(name) || (len(d.opts.configPath) <= 0 && name == sacme.CONFIG_FILE_NAME)
+}
+
+// schedule decides when a domain processed at now is due again: failed
+// domains are retried with a backoff, the others when their certificate is to
+// be renewed
+func (d *daemon) schedule(slog *slog.Logger, domain sacme.Domain, res domainResult, now time.Time) {
+	logger := slog.With("domain", domain.Domain)
+	err := res.Err
+	var at time.Time
+	if err == nil {
+		var state *sacme.State
+		state, err = d.runner.store.Load(domain)
+		if err == nil {
+			at, err = state.NextRenewal(domain.Renewal)
+		}
+	}
+
+	if err != nil {
+		d.failures[domain.Domain]++
+		backoff := sacme.RetryBackoff(d.failures[domain.Domain])
+		d.next[domain.Domain] = now.Add(backoff)
+		logger.Warn("retrying failed domain", "failures", d.failures[domain.Domain], "backoff", backoff)
+		return
+	}
+
+	delete(d.failures, domain.Domain)
+	// never spin on a certificate which is due again right after renewal
+	if earliest := now.Add(sacme.RETRY_BACKOFF_MIN); at.Before(earliest) {
+		at = earliest
+	}
+	d.next[domain.Domain] = at
+	logger.Info("scheduled renewal", "at", at)
+}
+
+// reloadAll reloads all domain definitions, keeping the current ones if
+// any of them is invalid, and uninstalls the domains no longer defined
+func (d *daemon) reloadAll(slog *slog.Logger) {
+	previous := d.domains
+	if err := d.reload(); err != nil {
+		slog.Error("could not reload, keeping the current domains", err)
+		return
+	}
+	slog.Info("reloaded domains", "len", len(d.domains))
+	for _, domain := range previous {
+		if !d.defined(domain.Domain) {
+			d.uninstall(slog, domain)
+		}
+	}
+}
+
+// reload loads the domain definitions again. All domains are processed
+// right away to apply any change to their installs. Changes to how the ACME
+// work is run require a restart and are rejected.
+func (d *daemon) reload() (err error) {
+	config, files, domains, err := loadDomains(d.opts)
+	if err != nil {
+		return
+	}
+	if duplicate := checkForDuplicateDomains(domains); duplicate != nil {
+		err = fmt.Errorf("duplicate domain %s", *duplicate)
+		return
+	}
+	if (config.Privileges == nil) != (d.config.Privileges == nil) || !sameUser(config.ACMEUser, d.config.ACMEUser) || !sameGroup(config.ACMEGroup, d.config.ACMEGroup) {
+		err = fmt.Errorf("changes to rootless, acme_user or acme_group require a restart")
+		return
+	}
+	if err = setupListeners(d.listeners, config, domains, d.activated); err != nil {
+		return
+	}
+
+	d.config, d.domains, d.files = config, domains, domainFiles(files, domains)
+	d.next, d.failures = map[string]time.Time{}, map[string]int{}
+	return
+}
+
+// reconcile applies the changes to the domain files. A change to the global
+// config reloads all domains. Otherwise only the domains of the changed files
+// are touched, and an invalid file leaves the previous definition in place.
+func (d *daemon) reconcile(slog *slog.Logger, changed map[string]bool) {
+	if changed[sacme.CONFIG_FILE_NAME] {
+		slog.Info("global config changed, reloading domains")
+		d.reloadAll(slog)
+		return
+	}
+
+	dir := os.DirFS(d.opts.domainsPath)
+	definitions := map[string]*sacme.Domain{}
+	for name := range changed {
+		domain, err := sacme.LoadDomainFile(dir, name, *d.config)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			definitions[name] = nil
+		case err != nil:
+			slog.Error("rejected changes to domain file, keeping the previous definition", err, "file", name)
+		default:
+			definitions[name] = domain
+		}
+	}
+	d.reconcileFiles(slog, definitions)
+}
+
+// reconcileFiles applies the definitions of the changed domain files, nil for
+// the files which are gone. The files which are gone are handled first, and
+// their domains are only removed if no file defines them once all changes are
+// applied, so that renaming a file or moving a domain to another file keeps
+// its installs in place.
+func (d *daemon) reconcileFiles(slog *slog.Logger, definitions map[string]*sacme.Domain) {
+	names := []string{}
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	orphans := map[string]bool{}
+	for _, name := range names {
+		if previous, known := d.files[name]; known && definitions[name] == nil {
+			slog.Info("domain file removed", "file", name, "domain", previous)
+			delete(d.files, name)
+			orphans[previous] = true
+		}
+	}
+	for _, name := range names {
+		domain := definitions[name]
+		if domain == nil {
+			continue
+		}
+		logger := slog.With("file", name)
+		previous, err := d.reconcileFile(&logger, name, *domain)
+		if err != nil {
+			logger.Error("rejected changes to domain file, keeping the previous definition", err)
+			continue
+		}
+		if orphans[domain.Domain] {
+			logger.Info("domain moved to another file", "domain", domain.Domain)
+			delete(orphans, domain.Domain)
+		}
+		if len(previous) > 0 {
+			orphans[previous] = true
+		}
+	}
+
+	removed := []string{}
+	for name := range orphans {
+		if !d.defined(name) {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		d.remove(slog, name)
+	}
+}
+
+// reconcileFile applies the new definition of a domain file, scheduling its
+// domain to be processed right away. It returns the domain the file defined
+// before, if it defined another one.
+func (d *daemon) reconcileFile(slog *slog.Logger, name string, domain sacme.Domain) (previous string, err error) {
+	for file, other := range d.files {
+		if file != name && other == domain.Domain {
+			err = fmt.Errorf("domain %s is already defined in %s", domain.Domain, file)
+			return
+		}
+	}
+	if err = setupListeners(d.listeners, d.config, []sacme.Domain{domain}, d.activated); err != nil {
+		return
+	}
+
+	if other, known := d.files[name]; known && other != domain.Domain {
+		slog.Info("domain file now defines another domain", "previous", other, "domain", domain.Domain)
+		previous = other
+	}
+	d.files[name] = domain.Domain
+	i := slices.IndexFunc(d.domains, func(other sacme.Domain) bool { return other.Domain == domain.Domain })
+	if i >= 0 {
+		d.domains[i] = domain
+	} else {
+		d.domains = append(d.domains, domain)
+	}
+	delete(d.next, domain.Domain)
+	delete(d.failures, domain.Domain)
+	slog.Info("domain file changed, reconciling", "domain", domain.Domain)
+	return
+}
+
+// defined reports whether a domain file defines the domain
+func (d *daemon) defined(name string) bool {
+	for _, other := range d.files {
+		if other == name {
+			return true
+		}
+	}
+	return false
+}
+
+// remove stops scheduling a domain which is no longer defined, uninstalling
+// its files
+func (d *daemon) remove(slog *slog.Logger, name string) {
+	i := slices.IndexFunc(d.domains, func(domain sacme.Domain) bool { return domain.Domain == name })
+	if i < 0 {
+		return
+	}
+	d.uninstall(slog, d.domains[i])
+	d.domains = append(d.domains[:i:i], d.domains[i+1:]...)
+	for file, other := range d.files {
+		if other == name {
+			delete(d.files, file)
+		}
+	}
+	delete(d.next, name)
+	delete(d.failures, name)
+}
+
+// uninstall removes the files of a domain which is no longer defined. The
+// files of domains which are not processed are left alone.
+func (d *daemon) uninstall(slog *slog.Logger, domain sacme.Domain) {
+	if !d.opts.selects(domain.Domain) {
+		return
+	}
+	logger := slog.With("domain", domain.Domain)
+	res := d.runner.removeDomain(&logger, domain)
+	if res.Err != nil {
+		logger.Error("could not clean up removed domain", res.Err)
+	} else {
+		logger.Info("removed domain", "uninstalled", res.Modified, "hooks_failed", res.HooksFailed)
+	}
+}
+
+func sameUser(a, b *user.User) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && a.Uid == b.Uid)
+}
+
+func sameGroup(a, b *user.Group) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && a.Gid == b.Gid)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fs "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lucat1/sacme"
+)
+
+// newTestDaemon returns a daemon for a domains path holding files, which
+// processes the domains with a fake CA
+func newTestDaemon(t *testing.T, files map[string]string) *daemon {
+	opts := options{domainsPath: t.TempDir(), jobs: 1}
+	for name, content := range files {
+		writeDomainFile(t, opts, name, content)
+	}
+	config, names, domains, err := loadDomains(opts)
+	assert.Nil(t, err)
+	return newDaemon(opts, newTestRunner(&fakeACME{}), config, names, domains, sacme.Listeners{}, nil)
+}
+
+func writeDomainFile(t *testing.T, opts options, name, content string) {
+	assert.Nil(t, os.WriteFile(filepath.Join(opts.domainsPath, name), []byte(content), 0644))
+}
+
+func domainNames(d *daemon) (names []string) {
+	for _, domain := range d.domains {
+		names = append(names, domain.Domain)
+	}
+	return
+}
+
+func TestDaemonSchedule(t *testing.T) {
+	d := newTestDaemon(t, map[string]string{"a.toml": testDomainFile(t, "a.test")})
+	domain := d.domains[0]
+	logger := testLogger()
+	now := time.Now()
+
+	// failures are retried with a growing backoff
+	failed := domainResult{Domain: "a.test", Err: fmt.Errorf("failed")}
+	d.schedule(logger, domain, failed, now)
+	assert.Equal(t, 1, d.failures["a.test"])
+	assert.Equal(t, now.Add(sacme.RETRY_BACKOFF_MIN), d.next["a.test"])
+	d.schedule(logger, domain, failed, now)
+	assert.Equal(t, 2, d.failures["a.test"])
+	assert.Equal(t, now.Add(sacme.RetryBackoff(2)), d.next["a.test"])
+
+	// a success resets the backoff, and a domain without a certificate is
+	// not processed right away again
+	d.schedule(logger, domain, domainResult{Domain: "a.test"}, now)
+	assert.NotContains(t, d.failures, "a.test")
+	assert.Equal(t, now.Add(sacme.RETRY_BACKOFF_MIN), d.next["a.test"])
+
+	res := d.runner.processDomain(logger, domain)
+	assert.Nil(t, res.Err)
+	d.schedule(logger, domain, res, now)
+	assert.NotContains(t, d.failures, "a.test")
+	state, err := d.runner.store.Load(domain)
+	assert.Nil(t, err)
+	at, err := state.NextRenewal(domain.Renewal)
+	assert.Nil(t, err)
+	assert.Equal(t, at, d.next["a.test"])
+	assert.True(t, at.After(now))
+
+	// a certificate which is already due is not renewed right away again
+	later := at.Add(time.Hour)
+	d.schedule(logger, domain, res, later)
+	assert.Equal(t, later.Add(sacme.RETRY_BACKOFF_MIN), d.next["a.test"])
+}
+
+func TestDaemonReload(t *testing.T) {
+	d := newTestDaemon(t, map[string]string{"a.toml": testDomainFile(t, "a.test")})
+	d.next["a.test"] = time.Now().Add(time.Hour)
+	d.failures["a.test"] = 1
+
+	writeDomainFile(t, d.opts, "b.toml", testDomainFile(t, "b.test"))
+	assert.Nil(t, d.reload())
+	assert.Equal(t, []string{"a.test", "b.test"}, domainNames(d))
+	assert.Equal(t, map[string]string{"a.toml": "a.test", "b.toml": "b.test"}, d.files)
+	// all domains are processed again
+	assert.Empty(t, d.next)
+	assert.Empty(t, d.failures)
+
+	// invalid definitions leave the current ones in place
+	writeDomainFile(t, d.opts, "c.toml", testDomainFile(t, "a.test"))
+	assert.ErrorContains(t, d.reload(), "duplicate domain a.test")
+	writeDomainFile(t, d.opts, "c.toml", "domain = [")
+	assert.NotNil(t, d.reload())
+	assert.Equal(t, []string{"a.test", "b.test"}, domainNames(d))
+	assert.Equal(t, map[string]string{"a.toml": "a.test", "b.toml": "b.test"}, d.files)
+
+	// domains no longer defined are uninstalled
+	logger := testLogger()
+	assert.Nil(t, d.runner.processDomain(logger, d.domains[0]).Err)
+	installed := func() bool {
+		exists, err := fs.Exists(d.runner.fs, "/ssl/a.test.key")
+		assert.Nil(t, err)
+		return exists
+	}
+	assert.True(t, installed())
+	assert.Nil(t, os.Remove(filepath.Join(d.opts.domainsPath, "a.toml")))
+	assert.Nil(t, os.Remove(filepath.Join(d.opts.domainsPath, "c.toml")))
+	d.reloadAll(logger)
+	assert.Equal(t, []string{"b.test"}, domainNames(d))
+	assert.Equal(t, map[string]string{"b.toml": "b.test"}, d.files)
+	assert.False(t, installed())
+}
+
+func TestDaemonReconcile(t *testing.T) {
+	d := newTestDaemon(t, map[string]string{"b.toml": testDomainFile(t, "x.test")})
+	logger := testLogger()
+	assert.Nil(t, d.runner.processDomain(logger, d.domains[0]).Err)
+	installed := func(name string) bool {
+		exists, err := fs.Exists(d.runner.fs, "/ssl/"+name+".key")
+		assert.Nil(t, err)
+		return exists
+	}
+	rename := func(from, to string) {
+		assert.Nil(t, os.Rename(filepath.Join(d.opts.domainsPath, from), filepath.Join(d.opts.domainsPath, to)))
+		d.reconcile(logger, map[string]bool{from: true, to: true})
+	}
+
+	// renaming a file keeps its domain, whichever file is handled first
+	rename("b.toml", "a.toml")
+	assert.Equal(t, map[string]string{"a.toml": "x.test"}, d.files)
+	assert.Equal(t, []string{"x.test"}, domainNames(d))
+	assert.True(t, installed("x.test"))
+	rename("a.toml", "c.toml")
+	assert.Equal(t, map[string]string{"c.toml": "x.test"}, d.files)
+	assert.Equal(t, []string{"x.test"}, domainNames(d))
+	assert.True(t, installed("x.test"))
+
+	// a new file is scheduled right away
+	d.next["x.test"] = time.Now().Add(time.Hour)
+	writeDomainFile(t, d.opts, "d.toml", testDomainFile(t, "y.test"))
+	d.reconcile(logger, map[string]bool{"d.toml": true})
+	assert.Equal(t, []string{"x.test", "y.test"}, domainNames(d))
+	assert.Contains(t, d.next, "x.test")
+	assert.NotContains(t, d.next, "y.test")
+
+	// invalid changes keep the previous definition
+	writeDomainFile(t, d.opts, "d.toml", testDomainFile(t, "x.test"))
+	d.reconcile(logger, map[string]bool{"d.toml": true})
+	writeDomainFile(t, d.opts, "c.toml", "domain = [")
+	d.reconcile(logger, map[string]bool{"c.toml": true})
+	assert.Equal(t, map[string]string{"c.toml": "x.test", "d.toml": "y.test"}, d.files)
+
+	// a domain no longer defined is removed, uninstalling its files
+	writeDomainFile(t, d.opts, "d.toml", testDomainFile(t, "z.test"))
+	assert.Nil(t, os.Remove(filepath.Join(d.opts.domainsPath, "c.toml")))
+	d.reconcile(logger, map[string]bool{"c.toml": true, "d.toml": true})
+	assert.Equal(t, map[string]string{"d.toml": "z.test"}, d.files)
+	assert.Equal(t, []string{"z.test"}, domainNames(d))
+	assert.False(t, installed("x.test"))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/lucat1/sacme"
+)
+
+// parseTime parses a date or an RFC 3339 time. Dates are in local time and,
+// when end is set, include the whole day.
+func parseTime(s string, end bool) (t time.Time, err error) {
+	if t, err = time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return
+	}
+	if t, err = time.Parse(time.RFC3339, s); err != nil {
+		err = fmt.Errorf("invalid time %s, expected a date like 2006-01-02 or an RFC 3339 time", s)
+	}
+	return
+}
+
+// timeFlag is a flag holding a point in time
+type timeFlag struct {
+	time.Time
+	end bool
+}
+
+func (f *timeFlag) String() string {
+	if f == nil || f.IsZero() {
+		return ""
+	}
+	return f.Format(time.RFC3339)
+}
+
+func (f *timeFlag) Set(s string) (err error) {
+	f.Time, err = parseTime(s, f.end)
+	return
+}
+
+// window is a change freeze, including both ends
+type window struct {
+	raw         string
+	from, until time.Time
+}
+
+func (w window) contains(t time.Time) bool {
+	return !t.Before(w.from) && !t.After(w.until)
+}
+
+// windowsFlag is a repeatable flag holding change freezes
+type windowsFlag []window
+
+func (f *windowsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	raws := []string{}
+	for _, w := range *f {
+		raws = append(raws, w.raw)
+	}
+	return strings.Join(raws, ", ")
+}
+
+func (f *windowsFlag) Set(s string) (err error) {
+	from, until, ok := strings.Cut(s, "..")
+	if !ok {
+		return fmt.Errorf("invalid freeze window %s, expected FROM..UNTIL", s)
+	}
+	w := window{raw: s}
+	if w.from, err = parseTime(from, false); err != nil {
+		return
+	}
+	if w.until, err = parseTime(until, true); err != nil {
+		return
+	}
+	if w.until.Before(w.from) {
+		return fmt.Errorf("freeze window %s ends before it starts", s)
+	}
+	*f = append(*f, w)
+	return
+}
+
+// frozen describes the freeze windows containing t, if any
+func (f windowsFlag) frozen(what string, t time.Time) (flags []string) {
+	for _, w := range f {
+		if w.contains(t) {
+			flags = append(flags, fmt.Sprintf("%s in freeze %s", what, w.raw))
+		}
+	}
+	return
+}
+
+func newForecastCommand(opts *options) *command {
+	c := newCommand(opts, "forecast", "[domain...]", "list the renewals planned between -from and -until for the given domains, or all domains, from the stored certificates")
+	from := timeFlag{}
+	until := timeFlag{end: true}
+	var freezes windowsFlag
+	c.flags.Var(&from, "from", "start of the forecast, as a date or an RFC 3339 time (default now)")
+	c.flags.Var(&until, "until", "end of the forecast, as a date or an RFC 3339 time (default 90 days after -from)")
+	c.flags.Var(&freezes, "freeze", "a change freeze as FROM..UNTIL, flagging the renewals and expiries in it; can be repeated")
+	c.run = func(slog *slog.Logger, args []string) int {
+		if from.IsZero() {
+			from.Time = time.Now()
+		}
+		if until.IsZero() {
+			until.Time = from.Add(sacme.DEFAULT_FORECAST_PERIOD)
+		}
+		if until.Before(from.Time) {
+			return c.usage("-until is before -from")
+		}
+		e, code := load(slog, *opts)
+		if e == nil {
+			return code
+		}
+		domains, err := e.selectDomains(args)
+		if err != nil {
+			return c.usage("%v", err)
+		}
+
+		code = EXIT_OK
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "DOMAIN\tRENEWAL\tEXPIRES\tFREEZE\n")
+		for _, domain := range domains {
+			state, err := e.store.Load(domain)
+			if err == nil {
+				err = printForecast(w, domain, state, from.Time, until.Time, freezes)
+			}
+			if err != nil {
+				slog.Error("could not forecast renewals", err, "domain", domain.Domain)
+				code = EXIT_PARTIAL_FAILURE
+			}
+		}
+		w.Flush()
+		return code
+	}
+	return c
+}
+
+// printForecast prints a row for each renewal of the domain planned between
+// from and until, or a single row if there is none
+func printForecast(w io.Writer, domain sacme.Domain, state *sacme.State, from, until time.Time, freezes windowsFlag) (err error) {
+	certificate, renewals, err := state.Forecast(domain.Renewal, from, until)
+	if err != nil {
+		return
+	}
+	if certificate == nil {
+		fmt.Fprintf(w, "%s\tobtained on the next run\t-\t\n", domain.Domain)
+		return
+	}
+	if len(renewals) <= 0 {
+		flags := freezes.frozen("expiry", certificate.NotAfter)
+		fmt.Fprintf(w, "%s\tnone\t%s\t%s\n", domain.Domain, formatTime(certificate.NotAfter), strings.Join(flags, ", "))
+		return
+	}
+	for _, renewal := range renewals {
+		flags := append(freezes.frozen("renewal", renewal.At), freezes.frozen("expiry", renewal.Expires)...)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", domain.Domain, formatTime(renewal.At), formatTime(renewal.Expires), strings.Join(flags, ", "))
+	}
+	return
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format("2006-01-02 15:04 MST")
+}
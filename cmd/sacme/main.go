@@ -2,33 +2,19 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net"
 	"os"
-	"os/exec"
-	"time"
+	"slices"
+	"strings"
 
 	"golang.org/x/exp/slog"
 
 	"github.com/lucat1/sacme"
+	"github.com/lucat1/sacme/pkg/file"
 	fs "github.com/spf13/afero"
 )
 
-// Taken from go builtin's "slices" module, which is not available in Go1.19
-// Copyright 2021 The Go Authors. All rights reserved.
-func IndexFunc[S ~[]E, E any](s S, f func(E) bool) int {
-	for i := range s {
-		if f(s[i]) {
-			return i
-		}
-	}
-	return -1
-}
-
-func ContainsFunc[S ~[]E, E any](s S, f func(E) bool) bool {
-	return IndexFunc(s, f) >= 0
-}
-
-// End of section copied from go's slices module
-
 // checkForDuplicateDomains checks if any domain definition are duplicate (i.e.,
 // are for the same domain name) and returns the duplicate record if found.
 func checkForDuplicateDomains(domains []sacme.Domain) *string {
@@ -43,210 +29,202 @@ func checkForDuplicateDomains(domains []sacme.Domain) *string {
 	return nil
 }
 
-func obtainCertificate(slog *slog.Logger, domain sacme.Domain, state *sacme.State, rootFS fs.Fs) {
-	slog.Info("obtaining certificate")
+// Exit codes for the outcome of a command. Codes below EXIT_HOOKS_FAILED stop
+// the command before any domain is processed.
+const (
+	EXIT_OK = 0
+	// the domains could not be loaded or the ACME work could not be set up
+	EXIT_SETUP = 1
+	// invalid command line or duplicate domain definitions
+	EXIT_INVALID      = 2
+	EXIT_HOOKS_FAILED = 11
+	// some domains could not be processed, the others were
+	EXIT_PARTIAL_FAILURE = 12
+	// no domain could be processed
+	EXIT_FAILURE = 13
+)
 
-	err := sacme.ObtainCertificate(domain, state, rootFS)
-	if err != nil {
-		slog.Error("error while obtaining certificate with ACME", err)
-		os.Exit(4)
+// summarize logs the outcome of every domain and returns the exit code
+func summarize(slog *slog.Logger, results []domainResult, hooksFailed bool) int {
+	failed, modified := 0, 0
+	for _, res := range results {
+		switch {
+		case res.Err != nil:
+			failed++
+			slog.Error("domain failed", res.Err, "domain", res.Domain)
+		case res.Modified:
+			modified++
+			slog.Info("domain updated", "domain", res.Domain, "rolled_back", res.RolledBack, "hooks_failed", res.HooksFailed)
+		default:
+			slog.Info("domain unchanged", "domain", res.Domain, "rolled_back", res.RolledBack, "hooks_failed", res.HooksFailed)
+		}
+		hooksFailed = hooksFailed || res.HooksFailed
 	}
-
-	slog.Info("obtained certificate")
-}
-
-func renewCertificate(slog *slog.Logger, domain sacme.Domain, state *sacme.State, rootFS fs.Fs) {
-	slog.Info("renewing certificate")
-
-	err := sacme.RenewCertificate(domain, state, rootFS)
-	if err != nil {
-		slog.Error("error while renewing certificate with ACME", err)
-		os.Exit(7)
+	slog.Info("summary", "domains", len(results), "failed", failed, "updated", modified, "unchanged", len(results)-failed-modified, "hooks_failed", hooksFailed)
+
+	switch {
+	case failed > 0 && failed == len(results):
+		return EXIT_FAILURE
+	case failed > 0:
+		return EXIT_PARTIAL_FAILURE
+	case hooksFailed:
+		return EXIT_HOOKS_FAILED
 	}
-
-	slog.Info("renewed certificate")
+	return EXIT_OK
 }
 
-func saveState(slog *slog.Logger, store *sacme.StateStore, domain sacme.Domain, state *sacme.State, cause string) {
-	slog.Info("saving state", "cause", cause)
-	err := store.Store(domain, state)
+// runHelper serves a request from the privileged parent process, performing
+// the ACME work as an unprivileged user
+func runHelper() {
+	slog := slog.New(slog.NewTextHandler(os.Stderr)).With("helper", os.Getpid())
+	err := sacme.ServeHelper(os.Stdin, os.Stdout, file.NewRootlessFs(fs.NewOsFs()))
 	if err != nil {
-		slog.Error("error while saving updated state", err)
-		os.Exit(8)
+		slog.Error("could not serve ACME request", err)
+		os.Exit(1)
 	}
-
-	slog.Info("state saved", "cause", cause)
+	os.Exit(0)
 }
 
-func uninstall(slog *slog.Logger, i sacme.InstallState, rootFS fs.Fs) {
-	err := i.Uninstall(rootFS)
-	if err != nil {
-		slog.Error("could not uninstall files", err)
-		os.Exit(9)
-	}
-	slog.Info("uninstalled", "key", i.Key, "crt", i.Crt, "ca", i.CA, "concat", i.Concat)
+// options are the command line flags shared by the commands
+type options struct {
+	domainsPath    string
+	configPath     string
+	stateStorePath string
+	skipHooks      bool
+	jobs           int
+	dryRun         bool
+	// process only these domains, or all of them, except the excluded ones
+	only       domainsFlag
+	exclude    domainsFlag
+	forceRenew bool
 }
 
-func main() {
-	domainsPath := flag.String("domains-path", sacme.DEFAULT_DOMAIN_PATH, "path containing domain definition files")
-	stateStorePath := flag.String("state-store-path", sacme.DEFAULT_STATE_STORE_PATH, "path containing the state of certificate renewal")
-	skipHooks := flag.Bool("skip-hooks", sacme.DEFAULT_SKIP_HOOKS, "wether to skip install hooks")
-	// TODO: when slog is upgraded, restore the logic to set the log level
-	// logLevel := flag.Int("log-level", sacme.DEFAULT_LOG_LEVEL, "verbosity of log output: debug (-4), info (0), warn (4), error (8)")
-	flag.Parse()
-
-	rootFS := fs.NewOsFs()
-
-	// slog := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-	// 	Level: slog.Level(*logLevel),
-	// }))
-	slog := slog.New(slog.NewTextHandler(os.Stderr))
+// domainsFlag is a repeatable flag holding comma separated domain names
+type domainsFlag []string
 
-	domains, err := sacme.LoadDomains(os.DirFS(*domainsPath))
-	if err != nil {
-		slog.Error("could not load configured domains", err)
-		os.Exit(1)
+func (f *domainsFlag) String() string {
+	if f == nil {
+		return ""
 	}
+	return strings.Join(*f, ",")
+}
 
-	slog.Info("loaded domains", "len", len(domains))
-	for _, domain := range domains {
-		slog.Info("definition for", "domain", domain.Domain, "account", domain.Account, "authentication", domain.Authentication)
+func (f *domainsFlag) Set(s string) error {
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			*f = append(*f, name)
+		}
 	}
+	return nil
+}
 
-	duplicate := checkForDuplicateDomains(domains)
-	if duplicate != nil {
-		slog.Error("duplicate domain", nil, "domain", *duplicate)
-		os.Exit(2)
+// selects reports whether a domain is processed according to -only and
+// -exclude
+func (o options) selects(domain string) bool {
+	is := func(name string) bool { return name == domain }
+	if len(o.only) > 0 && !slices.ContainsFunc(o.only, is) {
+		return false
 	}
+	return !slices.ContainsFunc(o.exclude, is)
+}
 
-	store := sacme.NewStateStore(fs.NewBasePathFs(rootFS, *stateStorePath))
-	modified := false
-	for _, domain := range domains {
-		slog := slog.With("domain", domain.Domain)
-
-		slog.Info("processing domain")
-
-		state, err := store.Load(domain)
-		if err != nil {
-			slog.Error("could not load domain state", err)
-			os.Exit(3)
+// checkSelection makes sure that -only and -exclude name defined domains
+func (o options) checkSelection(domains []sacme.Domain) error {
+	for _, name := range append(append([]string{}, o.only...), o.exclude...) {
+		if !slices.ContainsFunc(domains, func(d sacme.Domain) bool { return d.Domain == name }) {
+			return fmt.Errorf("no definition for domain %s", name)
 		}
+	}
+	return nil
+}
 
-		slog.Info("loaded domain state", "account", state.Account)
-
-		if !state.IsRegistered() {
-			slog.Info("registering account", "email", domain.Account.Email)
-
-			err = sacme.RegisterAccount(domain, state)
-			if err != nil {
-				slog.Error("could not register ACME account", err)
-				os.Exit(3)
-			}
-
-			slog.Info("registered account")
-		}
+// registerGlobal registers the flags accepted by all commands
+func (o *options) registerGlobal(f *flag.FlagSet) {
+	f.StringVar(&o.domainsPath, "domains-path", sacme.DEFAULT_DOMAIN_PATH, "path containing domain definition files")
+	f.StringVar(&o.configPath, "config", "", "path to the global config file (defaults to "+sacme.CONFIG_FILE_NAME+" in the domains path)")
+	f.StringVar(&o.stateStorePath, "state-store-path", sacme.DEFAULT_STATE_STORE_PATH, "path containing the state of certificate renewal")
+}
 
-		newCertificate := false
-		if state.ACME.Empty() {
-			obtainCertificate(&slog, domain, state, rootFS)
-			newCertificate = true
-		}
+// registerProcess registers the flags of the commands processing domains
+func (o *options) registerProcess(f *flag.FlagSet) {
+	f.BoolVar(&o.skipHooks, "skip-hooks", sacme.DEFAULT_SKIP_HOOKS, "wether to skip install and domain hooks")
+	f.IntVar(&o.jobs, "jobs", sacme.DEFAULT_JOBS, "maximum number of domains processed at the same time")
+	f.BoolVar(&o.dryRun, "dry-run", false, "print what would be done, without contacting the CA or changing any file or state")
+	f.Var(&o.only, "only", "comma separated domains to process, skipping all others; can be repeated")
+	f.Var(&o.exclude, "exclude", "comma separated domains not to process; can be repeated")
+	f.BoolVar(&o.forceRenew, "force-renew", false, "renew the certificates of the processed domains even if they are not due")
+}
 
-		certificates, err := state.ACME.Certificates()
-		if err != nil {
-			slog.Error("could not parse certificate bundle", err)
-			os.Exit(6)
-		}
-		certificate := certificates[0]
-		now := time.Now()
-		elapsedTime := now.Sub(certificate.NotBefore)
-		duration := certificate.NotAfter.Sub(certificate.NotBefore)
-		halfTime := duration / 2
-		slog.Info("loaded certificate", "notBefore", certificate.NotBefore, "now", now, "notAfter", certificate.NotAfter, "elapsedtime", elapsedTime, "halfTime", halfTime)
-
-		if elapsedTime >= duration {
-			obtainCertificate(&slog, domain, state, rootFS)
-			newCertificate = true
-		} else if elapsedTime >= halfTime {
-			renewCertificate(&slog, domain, state, rootFS)
-			newCertificate = true
+// loadDomains loads the global config and all the domain definitions, along
+// with the file each of them was loaded from
+func loadDomains(opts options) (config *sacme.Config, files []string, domains []sacme.Domain, err error) {
+	if len(opts.configPath) > 0 {
+		var content []byte
+		content, err = os.ReadFile(opts.configPath)
+		if err == nil {
+			config, err = sacme.ParseConfig(content)
 		}
+	} else {
+		config, err = sacme.LoadConfig(os.DirFS(opts.domainsPath))
+	}
+	if err != nil {
+		err = fmt.Errorf("could not load config: %w", err)
+		return
+	}
 
-		if newCertificate {
-			saveState(&slog, &store, domain, state, "new_certificate")
-		}
+	files, domains, err = sacme.LoadDomains(os.DirFS(opts.domainsPath), *config)
+	if err != nil {
+		err = fmt.Errorf("could not load configured domains: %w", err)
+	}
+	return
+}
 
-		installs := []sacme.InstallState{}
-		modifiedInstalls := false
-		if !newCertificate {
-			// If we haven't obtained a nwe certificate, then old installs
-			// may be still relevant. Here we filter out installs and remove old files
-			for _, i := range state.Installs {
-				matches := ContainsFunc(domain.Installs, i.Matches)
-				slog.Debug("installed install matches", "install", i, "matches", matches)
-				if !matches {
-					uninstall(&slog, i, rootFS)
-					modifiedInstalls = true
-				} else {
-					installs = append(installs, i)
-				}
-			}
-		} else {
-			// If we've obtained a new certificate all old files can be uninstalled
-			for _, i := range state.Installs {
-				uninstall(&slog, i, rootFS)
-				modifiedInstalls = true
-			}
+// setupListeners opens or assigns the listeners for the http-01/standalone
+// challenge, which are only needed when they are socket activated or the
+// ACME work runs as another user. Existing listeners are extended.
+func setupListeners(listeners sacme.Listeners, config *sacme.Config, domains []sacme.Domain, activated []net.Listener) (err error) {
+	if len(activated) > 0 {
+		if err = listeners.Activate(domains, activated); err != nil {
+			err = fmt.Errorf("could not assign socket activated listeners: %w", err)
 		}
-
-		slog.Debug("valid current install paths", "count", len(installs))
-
-		// Install new installs
-		for _, i := range domain.Installs {
-			matches := ContainsFunc(installs, i.Matches)
-			slog.Debug("defined install matches", "install", i, "matches", matches)
-			if !matches {
-				is, err := i.Install(rootFS, state)
-				if err != nil {
-					slog.Error("could not install files", err)
-					os.Exit(10)
-				}
-				slog.Info("installed", "key", is.Key, "crt", is.Crt, "ca", is.CA, "concat", is.Concat)
-				modifiedInstalls = true
-				installs = append(installs, *is)
-
-				if len(i.Hooks) > 0 {
-					if *skipHooks {
-						slog.Info("avoiding running hooks", "hooks", i.Hooks)
-					} else {
-						slog.Info("running hooks for install", "hooks", i.Hooks)
-						for _, hook := range i.Hooks {
-							slog := slog.With("hook", hook)
-							cmd := exec.Command(sacme.DEFAULT_SHELL, "-c", hook)
-							stdout, err := cmd.Output()
-							if err != nil {
-								slog.Error("error while running hook", err)
-							} else {
-								slog.Info("ran hook", "stdout", string(stdout))
-							}
-						}
-					}
-				}
-			}
+	} else if config.ACMEUser != nil {
+		if err = listeners.Open(domains); err != nil {
+			err = fmt.Errorf("could not open challenge listeners: %w", err)
 		}
+	}
+	return
+}
 
-		if modifiedInstalls {
-			state.Installs = installs
-			saveState(&slog, &store, domain, state, "install")
+// runDeferred runs the deferred hooks queued by the domains, in the order of
+// the domains, and reports whether any of them failed
+func runDeferred(slog *slog.Logger, results []domainResult) (hooksFailed bool) {
+	deferred := sacme.NewDeferredHooks()
+	for _, res := range results {
+		for _, hook := range res.Deferred {
+			deferred.Add(hook, res.Domain)
 		}
+	}
 
-		modified = modified || newCertificate || modifiedInstalls
-		slog.Info("finished processing")
+	for _, hook := range deferred.Hooks() {
+		slog := slog.With("domains", hook.Domains)
+		slog.Info("running deferred hook")
+		failure := runHooks(&slog, []sacme.Hook{hook.Hook}, hook.Env())
+		hooksFailed = hooksFailed || failure != sacme.ON_FAILURE_IGNORE
 	}
+	return
+}
 
-	if !modified {
-		slog.Info("unchanged")
+func main() {
+	if os.Getenv(sacme.HELPER_ENV) != "" {
+		runHelper()
 	}
 
-	os.Exit(0)
+	// TODO: when slog is upgraded, restore the logic to set the log level
+	// logLevel := flag.Int("log-level", sacme.DEFAULT_LOG_LEVEL, "verbosity of log output: debug (-4), info (0), warn (4), error (8)")
+	// slog := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+	// 	Level: slog.Level(*logLevel),
+	// }))
+	slog := slog.New(slog.NewTextHandler(os.Stderr))
+
+	os.Exit(dispatch(&slog, os.Args[1:]))
 }
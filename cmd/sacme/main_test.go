@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lucat1/sacme"
+)
+
+func TestSelection(t *testing.T) {
+	domains := []sacme.Domain{{Domain: "a.test"}, {Domain: "b.test"}, {Domain: "c.test"}}
+
+	for _, test := range []struct {
+		name string
+		args []string
+		// the domains selected, or the error checking the selection
+		selected   []string
+		err        string
+		forceRenew bool
+	}{
+		{"all", nil, []string{"a.test", "b.test", "c.test"}, "", false},
+		{"only", []string{"-only", "a.test,c.test"}, []string{"a.test", "c.test"}, "", false},
+		{"exclude", []string{"-exclude", "b.test"}, []string{"a.test", "c.test"}, "", false},
+		{"repeated", []string{"-only", "a.test", "-only", " b.test, ", "-exclude", "a.test", "-exclude", "a.test"}, []string{"b.test"}, "", false},
+		{"overlapping", []string{"-only", "a.test,b.test", "-exclude", "b.test,c.test"}, []string{"a.test"}, "", false},
+		{"force renew", []string{"-force-renew", "-only", "c.test"}, []string{"c.test"}, "", true},
+		{"unknown only", []string{"-only", "a.test,d.test"}, nil, "no definition for domain d.test", false},
+		{"unknown exclude", []string{"-exclude", "d.test"}, nil, "no definition for domain d.test", false},
+	} {
+		var opts options
+		f := flag.NewFlagSet("test", flag.ContinueOnError)
+		opts.registerProcess(f)
+		assert.Nil(t, f.Parse(test.args), test.name)
+
+		err := opts.checkSelection(domains)
+		if len(test.err) > 0 {
+			assert.EqualError(t, err, test.err, test.name)
+			continue
+		}
+		assert.Nil(t, err, test.name)
+		selected := []string{}
+		for _, domain := range domains {
+			if opts.selects(domain.Domain) {
+				selected = append(selected, domain.Domain)
+			}
+		}
+		assert.Equal(t, test.selected, selected, test.name)
+		assert.Equal(t, test.forceRenew, opts.forceRenew, test.name)
+	}
+}
+
+func TestDomainsFlag(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		values []string
+		flag   domainsFlag
+	}{
+		{"single", []string{"a.test"}, domainsFlag{"a.test"}},
+		{"comma separated", []string{"a.test,b.test"}, domainsFlag{"a.test", "b.test"}},
+		{"repeated", []string{"a.test", "b.test,c.test"}, domainsFlag{"a.test", "b.test", "c.test"}},
+		{"blanks", []string{" a.test ,, ", ""}, domainsFlag{"a.test"}},
+	} {
+		var f domainsFlag
+		for _, value := range test.values {
+			assert.Nil(t, f.Set(value), test.name)
+		}
+		assert.Equal(t, test.flag, f, test.name)
+		assert.Equal(t, strings.Join(test.flag, ","), f.String(), test.name)
+	}
+	assert.Equal(t, "", (*domainsFlag)(nil).String())
+}
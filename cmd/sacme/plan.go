@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/lucat1/sacme"
+	"github.com/lucat1/sacme/pkg/file"
+	fs "github.com/spf13/afero"
+)
+
+// issuance is what has to happen to the account and the certificate of a
+// domain
+type issuance struct {
+	register bool
+	// obtain a certificate, or renew the current one if renew is set
+	issue  bool
+	renew  bool
+	reason string
+}
+
+// planIssuance decides whether the account of a domain has to be registered
+// and its certificate obtained or renewed at now
+func (r *runner) planIssuance(domain sacme.Domain, state *sacme.State, now time.Time) (iss issuance, err error) {
+	iss.register = !state.IsRegistered()
+	if state.ACME.Empty() {
+		iss.issue, iss.reason = true, "there is no certificate"
+		return
+	}
+
+	certificates, err := state.ACME.Certificates()
+	if err != nil {
+		err = fmt.Errorf("could not parse certificate bundle: %w", err)
+		return
+	}
+	certificate := certificates[0]
+	renewAt := domain.Renewal.RenewAt(certificate)
+	switch {
+	case !now.Before(certificate.NotAfter):
+		iss.issue, iss.reason = true, fmt.Sprintf("the certificate expired at %s", certificate.NotAfter.Format(time.RFC3339))
+	case r.forceRenew:
+		iss.issue, iss.renew, iss.reason = true, true, "renewal is forced"
+	case !now.Before(renewAt):
+		iss.issue, iss.renew, iss.reason = true, true, fmt.Sprintf("the certificate is due since %s", renewAt.Format(time.RFC3339))
+	}
+	return
+}
+
+// installPlan is how the installs of a domain are brought in line with its
+// definition
+type installPlan struct {
+	// installs left as they are
+	keep      []sacme.InstallState
+	uninstall []sacme.InstallState
+	// versioned installs, by link, which are archived once a new version
+	// takes their place
+	superseded map[string]sacme.InstallState
+	install    []sacme.Install
+	// paths uninstalled for good, for the on_uninstall hooks
+	gone []string
+}
+
+func (p installPlan) modified() bool {
+	return len(p.uninstall) > 0 || len(p.superseded) > 0 || len(p.install) > 0
+}
+
+// staleInstalls reports whether some installs were written with a certificate
+// other than the current one, with serial, e.g. because a previous run failed
+// to replace them or a hook rolled them back. The files of installs saved
+// before their serial was recorded are compared with the certificate instead.
+func staleInstalls(f fs.Fs, state *sacme.State, serial string) bool {
+	return slices.ContainsFunc(state.Installs, func(i sacme.InstallState) bool {
+		if len(i.Serial) <= 0 {
+			return !i.Holds(f, state.ACME)
+		}
+		return i.Serial != serial
+	})
+}
+
+// planInstalls compares the installs in the state with the resolved ones,
+// which are all installed again if reinstall is set
+func planInstalls(state *sacme.State, resolved []sacme.Install, reinstall bool) (p installPlan) {
+	p.superseded = map[string]sacme.InstallState{}
+	for _, i := range state.Installs {
+		versioned := slices.ContainsFunc(resolved, func(ri sacme.Install) bool {
+			return ri.Live != nil && ri.Live.Link == i.Link
+		})
+		switch {
+		case !reinstall && slices.ContainsFunc(resolved, i.Matches):
+			p.keep = append(p.keep, i)
+		// a new version, or the same version written again, takes the
+		// place of the current one, which keeps its archive
+		case len(i.Link) > 0 && versioned:
+			p.superseded[i.Link] = i
+		default:
+			p.uninstall = append(p.uninstall, i)
+		}
+	}
+	for _, i := range resolved {
+		if !slices.ContainsFunc(p.keep, i.Matches) {
+			p.install = append(p.install, i)
+		}
+	}
+
+	// Files rewritten by a new install are not uninstalled for good
+	installed := map[string]bool{}
+	for _, i := range p.keep {
+		for _, path := range i.Paths() {
+			installed[path] = true
+		}
+	}
+	for _, i := range p.install {
+		for _, path := range i.Paths() {
+			installed[path] = true
+		}
+	}
+	for _, i := range p.uninstall {
+		for _, path := range i.Paths() {
+			if !installed[path] {
+				p.gone = append(p.gone, path)
+			}
+		}
+	}
+	return
+}
+
+// planDomain prints what processing a domain would do, without contacting
+// the CA or changing any file or state. Paths depending on a certificate
+// which is yet to be issued are printed with their placeholders.
+func (r *runner) planDomain(w io.Writer, domain sacme.Domain, now time.Time) (err error) {
+	state, err := r.store.Load(domain)
+	if err != nil {
+		err = fmt.Errorf("could not load domain state: %w", err)
+		return
+	}
+	iss, err := r.planIssuance(domain, state, now)
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(w, "%s:\n", domain.Domain)
+	steps := 0
+	step := func(format string, a ...any) {
+		fmt.Fprintf(w, "  "+format+"\n", a...)
+		steps++
+	}
+	hooks := func(name string, hooks []sacme.Hook) {
+		if r.skipHooks {
+			return
+		}
+		for _, hook := range hooks {
+			if hook.Deferred {
+				step("defer %s hook: %s", name, hook.Command)
+			} else {
+				step("run %s hook: %s", name, hook.Command)
+			}
+		}
+	}
+
+	if iss.register {
+		step("register account %s with %s", domain.Account.Email, domain.Account.Directroy)
+	}
+	placeholders := map[string]string{sacme.PLACEHOLDER_DOMAIN: domain.Domain}
+	if iss.issue {
+		hooks("pre_issue", domain.Hooks.PreIssue)
+		action := "obtain"
+		if iss.renew {
+			action = "renew"
+		}
+		step("%s certificate: %s", action, iss.reason)
+		hooks("post_issue", domain.Hooks.PostIssue)
+	} else if placeholders, err = state.ACME.Placeholders(); err != nil {
+		err = fmt.Errorf("could not compute install placeholders: %w", err)
+		return
+	}
+
+	resolved := []sacme.Install{}
+	for _, i := range domain.Installs {
+		resolved = append(resolved, i.Resolve(placeholders))
+	}
+	reinstall := r.reinstall || iss.issue || staleInstalls(r.fs, state, placeholders[sacme.PLACEHOLDER_SERIAL])
+	p := planInstalls(state, resolved, reinstall)
+
+	for _, i := range p.uninstall {
+		for _, path := range i.Paths() {
+			step("uninstall %s", path)
+		}
+		if i.Dir != nil {
+			step("uninstall %s and %s", i.Dir.Path, i.Link)
+		}
+	}
+	for _, i := range p.install {
+		for _, pp := range i.PathPerms() {
+			step("install %s", describePathPerm(pp))
+		}
+		if i.Live != nil {
+			step("link %s to %s", i.Live.Link, describePathPerm(i.Live.Dir))
+			if previous, ok := p.superseded[i.Live.Link]; ok && previous.Dir != nil && previous.Dir.Path != i.Live.Dir.Path {
+				step("archive %s, keeping %d versions", previous.Dir.Path, i.Live.Keep)
+			}
+		}
+		hooks("install", i.Hooks)
+		if i.Reload != nil && !r.skipHooks {
+			step("reload %s %s", i.Reload.Method, i.Reload.Target)
+		}
+	}
+	if len(p.gone) > 0 {
+		hooks("on_uninstall", domain.Hooks.OnUninstall)
+	}
+
+	if steps <= 0 {
+		step("nothing to do")
+	}
+	return
+}
+
+func describePathPerm(pp file.PathPerm) string {
+	owner, group := "-", "-"
+	if pp.Owner != nil {
+		owner = pp.Owner.Username
+	}
+	if pp.Group != nil {
+		group = pp.Group.Name
+	}
+	return fmt.Sprintf("%s (mode %04o, owner %s:%s)", pp.Path, os.FileMode(pp.Perm).Perm(), owner, group)
+}
+
+// planAll prints what processing the domains would do, returning the exit
+// code
+func (r *runner) planAll(slog *slog.Logger, w io.Writer, domains []sacme.Domain) int {
+	now := time.Now()
+	failed := 0
+	for _, domain := range domains {
+		if err := r.planDomain(w, domain, now); err != nil {
+			slog.Error("could not plan domain", err, "domain", domain.Domain)
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		return EXIT_OK
+	case failed < len(domains):
+		return EXIT_PARTIAL_FAILURE
+	default:
+		return EXIT_FAILURE
+	}
+}
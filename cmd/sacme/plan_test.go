@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lucat1/sacme"
+)
+
+func TestPlanIssuance(t *testing.T) {
+	domain := testDomain(t, "a.test")
+	acme, err := newCertificate("a.test", time.Now().Add(90*24*time.Hour))
+	assert.Nil(t, err)
+	registered := sacme.AccountState{Registration: &registration.Resource{URI: "https://ca.test/acct/1"}}
+
+	for _, test := range []struct {
+		name  string
+		state sacme.State
+		force bool
+		// the time of the plan, from now
+		after time.Duration
+		iss   issuance
+	}{
+		{"no account", sacme.State{}, false, 0, issuance{register: true, issue: true}},
+		{"no certificate", sacme.State{Account: registered}, false, 0, issuance{issue: true}},
+		{"valid", sacme.State{Account: registered, ACME: acme}, false, 0, issuance{}},
+		{"due", sacme.State{Account: registered, ACME: acme}, false, 60 * 24 * time.Hour, issuance{issue: true, renew: true}},
+		{"expired", sacme.State{Account: registered, ACME: acme}, false, 100 * 24 * time.Hour, issuance{issue: true}},
+		{"forced", sacme.State{Account: registered, ACME: acme}, true, 0, issuance{issue: true, renew: true}},
+		{"forced and expired", sacme.State{Account: registered, ACME: acme}, true, 100 * 24 * time.Hour, issuance{issue: true}},
+	} {
+		r := &runner{forceRenew: test.force}
+		iss, err := r.planIssuance(domain, &test.state, time.Now().Add(test.after))
+		assert.Nil(t, err, test.name)
+		assert.Equal(t, test.iss.register, iss.register, test.name)
+		assert.Equal(t, test.iss.issue, iss.issue, test.name)
+		assert.Equal(t, test.iss.renew, iss.renew, test.name)
+		assert.Equal(t, iss.issue, len(iss.reason) > 0, test.name)
+	}
+
+	_, err = (&runner{}).planIssuance(domain, &sacme.State{ACME: sacme.ACMEState{Certificate: []byte("garbage")}}, time.Now())
+	assert.NotNil(t, err)
+}
+
+func TestPlanInstalls(t *testing.T) {
+	domain := testDomain(t, "a.test")
+	current := domain.Installs[0].Resolve(map[string]string{sacme.PLACEHOLDER_DOMAIN: "a.test"})
+	moved := current
+	key := *current.Key
+	key.Path = "/ssl/moved.key"
+	moved.Key = &key
+
+	versioned := func(dir string) sacme.Install {
+		i := current
+		live := sacme.Live{Dir: current.Key.PathPerm, Link: "/ssl/live", Keep: 1}
+		live.Dir.Path = dir
+		i.Live = &live
+		return i
+	}
+	v1, v2 := versioned("/ssl/v1"), versioned("/ssl/v2")
+
+	states := func(installs ...sacme.Install) (s []sacme.InstallState) {
+		for _, i := range installs {
+			is, err := i.State()
+			assert.Nil(t, err)
+			s = append(s, is)
+		}
+		return
+	}
+
+	for _, test := range []struct {
+		name       string
+		state      []sacme.Install
+		resolved   []sacme.Install
+		reinstall  bool
+		keep       []sacme.Install
+		uninstall  []sacme.Install
+		superseded []string
+		install    []sacme.Install
+		gone       []string
+	}{
+		{name: "new", resolved: []sacme.Install{current}, install: []sacme.Install{current}},
+		{name: "keep", state: []sacme.Install{current}, resolved: []sacme.Install{current}, keep: []sacme.Install{current}},
+		{
+			name: "reinstall", state: []sacme.Install{current}, resolved: []sacme.Install{current}, reinstall: true,
+			uninstall: []sacme.Install{current}, install: []sacme.Install{current},
+		},
+		{
+			name: "changed", state: []sacme.Install{current}, resolved: []sacme.Install{moved},
+			uninstall: []sacme.Install{current}, install: []sacme.Install{moved}, gone: []string{"/ssl/a.test.key"},
+		},
+		{
+			name: "gone", state: []sacme.Install{current},
+			uninstall: []sacme.Install{current}, gone: []string{"/ssl/a.test.key", "/ssl/a.test.crt"},
+		},
+		{
+			name: "supersede", state: []sacme.Install{v1}, resolved: []sacme.Install{v2},
+			superseded: []string{"/ssl/live"}, install: []sacme.Install{v2},
+		},
+		{
+			name: "supersede same version", state: []sacme.Install{v1}, resolved: []sacme.Install{v1}, reinstall: true,
+			superseded: []string{"/ssl/live"}, install: []sacme.Install{v1},
+		},
+		{
+			name: "no longer versioned", state: []sacme.Install{v1}, resolved: []sacme.Install{current},
+			uninstall: []sacme.Install{v1}, install: []sacme.Install{current},
+		},
+	} {
+		state := &sacme.State{Installs: states(test.state...)}
+		p := planInstalls(state, test.resolved, test.reinstall)
+		assert.Equal(t, states(test.keep...), p.keep, test.name)
+		assert.Equal(t, states(test.uninstall...), p.uninstall, test.name)
+		superseded := []string{}
+		for link := range p.superseded {
+			superseded = append(superseded, link)
+		}
+		assert.ElementsMatch(t, test.superseded, superseded, test.name)
+		assert.Equal(t, test.install, p.install, test.name)
+		assert.Equal(t, test.gone, p.gone, test.name)
+		assert.Equal(t, len(test.uninstall)+len(test.superseded)+len(test.install) > 0, p.modified(), test.name)
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/lucat1/sacme"
+	"github.com/lucat1/sacme/pkg/file"
+	fs "github.com/spf13/afero"
+)
+
+// runner holds what is shared while processing all domains
+type runner struct {
+	store     *sacme.StateStore
+	acme      sacme.ACME
+	fs        fs.Fs
+	skipHooks bool
+	// renew the certificates even if they are not due
+	forceRenew bool
+	// install all files again even if they are up to date
+	reinstall bool
+}
+
+// domainResult is the outcome of processing a single domain
+type domainResult struct {
+	Domain      string
+	Modified    bool
+	HooksFailed bool
+	RolledBack  bool
+	// deferred hooks of the changed installs, to be queued once all domains
+	// have been processed
+	Deferred []sacme.Hook
+	Err      error
+}
+
+func obtainCertificate(slog *slog.Logger, domain sacme.Domain, state *sacme.State, acme sacme.ACME) (err error) {
+	slog.Info("obtaining certificate")
+
+	err = acme.Obtain(domain, state)
+	if err != nil {
+		err = fmt.Errorf("error while obtaining certificate with ACME: %w", err)
+		return
+	}
+
+	slog.Info("obtained certificate")
+	return
+}
+
+func renewCertificate(slog *slog.Logger, domain sacme.Domain, state *sacme.State, acme sacme.ACME) (err error) {
+	slog.Info("renewing certificate")
+
+	err = acme.Renew(domain, state)
+	if err != nil {
+		err = fmt.Errorf("error while renewing certificate with ACME: %w", err)
+		return
+	}
+
+	slog.Info("renewed certificate")
+	return
+}
+
+// issueCertificate obtains or renews the certificate of the domain, running
+// the domain's pre_issue, on_renew_failure and post_issue hooks around it.
+func (r *runner) issueCertificate(slog *slog.Logger, domain sacme.Domain, state *sacme.State, renew bool, res *domainResult) (err error) {
+	hooks := domain.Hooks
+	if r.skipHooks {
+		hooks = sacme.DomainHooks{}
+	}
+	env := []string{sacme.HOOK_ENV_DOMAIN + "=" + domain.Domain}
+
+	if len(hooks.PreIssue) > 0 {
+		slog.Info("running pre_issue hooks", "hooks", len(hooks.PreIssue))
+	}
+	if runHooks(slog, hooks.PreIssue, env) != sacme.ON_FAILURE_IGNORE {
+		res.HooksFailed = true
+		err = fmt.Errorf("%w: pre_issue hook failed, not issuing certificate", sacme.HookFailed)
+	} else if renew {
+		err = renewCertificate(slog, domain, state, r.acme)
+	} else {
+		err = obtainCertificate(slog, domain, state, r.acme)
+	}
+
+	result := sacme.HOOK_RESULT_SUCCESS
+	if err != nil {
+		result = sacme.HOOK_RESULT_FAILURE
+		if len(hooks.OnRenewFailure) > 0 {
+			slog.Info("running on_renew_failure hooks", "hooks", len(hooks.OnRenewFailure))
+		}
+		failure := runHooks(slog, hooks.OnRenewFailure, append(env, sacme.HOOK_ENV_ERROR+"="+err.Error()))
+		res.HooksFailed = res.HooksFailed || failure != sacme.ON_FAILURE_IGNORE
+	}
+	// post_issue hooks always run, e.g. to restart a service stopped by a
+	// pre_issue hook
+	if len(hooks.PostIssue) > 0 {
+		slog.Info("running post_issue hooks", "hooks", len(hooks.PostIssue))
+	}
+	failure := runHooks(slog, hooks.PostIssue, append(env, sacme.HOOK_ENV_RESULT+"="+result))
+	res.HooksFailed = res.HooksFailed || failure != sacme.ON_FAILURE_IGNORE
+	return
+}
+
+func saveState(slog *slog.Logger, store *sacme.StateStore, domain sacme.Domain, state *sacme.State, cause string) (err error) {
+	slog.Info("saving state", "cause", cause)
+	err = store.Store(domain, state)
+	if err != nil {
+		err = fmt.Errorf("error while saving updated state: %w", err)
+		return
+	}
+
+	slog.Info("state saved", "cause", cause)
+	return
+}
+
+// uninstall removes the files of an install
+func uninstall(slog *slog.Logger, i sacme.InstallState, rootFS fs.Fs) (err error) {
+	kept, err := i.Uninstall(rootFS)
+	if err != nil {
+		err = fmt.Errorf("could not uninstall files: %w", err)
+		return
+	}
+	slog.Info("uninstalled", "paths", i.Paths())
+	if len(kept) > 0 {
+		slog.Info("directories not empty, leaving them in place", "dirs", kept)
+	}
+	return
+}
+
+// runHooks runs a list of hooks in order, stopping at the first one failing
+// with a policy other than ignore, whose policy is returned
+func runHooks(slog *slog.Logger, hooks []sacme.Hook, env []string) sacme.OnFailure {
+	for _, hook := range hooks {
+		slog := slog.With("hook", hook.Command)
+		res, err := hook.Run(env)
+		if err != nil {
+			slog.Error("error while running hook", err, "on_failure", hook.OnFailure, "exit_code", res.ExitCode, "duration", res.Duration, "stdout", res.Stdout, "stderr", res.Stderr)
+			if hook.OnFailure != sacme.ON_FAILURE_IGNORE {
+				return hook.OnFailure
+			}
+			continue
+		}
+		slog.Info("ran hook", "duration", res.Duration, "stdout", res.Stdout, "stderr", res.Stderr)
+	}
+	return sacme.ON_FAILURE_IGNORE
+}
+
+// runReload reloads the service using an install, returning the failure
+// policy of the reload if it failed
+func runReload(slog *slog.Logger, reload sacme.Reload) sacme.OnFailure {
+	attrs := []any{"reload", reload.Method, "target", reload.Target}
+	if reload.Method != sacme.RELOAD_METHOD_UNIT {
+		attrs = append(attrs, "signal", reload.Signal)
+	}
+	logger := slog.With(attrs...)
+	if err := reload.Check(); err != nil {
+		logger.Warn("reload target not found", "err", err)
+	}
+	res, err := reload.Run()
+	if err != nil {
+		logger.Error("error while reloading", err, "on_failure", reload.OnFailure, "pids", res.Pids, "duration", res.Duration, "output", res.Output)
+		return reload.OnFailure
+	}
+	logger.Info("reloaded", "pids", res.Pids, "duration", res.Duration, "output", res.Output)
+	return sacme.ON_FAILURE_IGNORE
+}
+
+// processAll processes the domains with at most jobs workers. Domains sharing
+// exclusive resources are processed one after another by the same worker.
+// The results are in the order of domains.
+func (r *runner) processAll(slog *slog.Logger, domains []sacme.Domain, jobs int) []domainResult {
+	position := map[string]int{}
+	for i, domain := range domains {
+		position[domain.Domain] = i
+	}
+	groups := sacme.ExclusiveGroups(domains)
+	if jobs > len(groups) {
+		jobs = len(groups)
+	}
+	slog.Info("processing domains", "domains", len(domains), "groups", len(groups), "jobs", jobs)
+
+	results := make([]domainResult, len(domains))
+	queue := make(chan []sacme.Domain)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range queue {
+				for _, domain := range group {
+					slog := slog.With("domain", domain.Domain)
+					res := r.processDomain(&slog, domain)
+					if res.Err != nil {
+						slog.Error("could not process domain", res.Err)
+					}
+					// each worker writes distinct elements
+					results[position[domain.Domain]] = res
+				}
+			}
+		}()
+	}
+	for _, group := range groups {
+		queue <- group
+	}
+	close(queue)
+	wg.Wait()
+	return results
+}
+
+// processDomain renews the certificate of a domain if needed and brings its
+// installs up to date. Errors are returned rather than aborting the run, and
+// file changes are rolled back if they cannot all be made.
+func (r *runner) processDomain(slog *slog.Logger, domain sacme.Domain) (res domainResult) {
+	res.Domain = domain.Domain
+	res.Err = r.process(slog, domain, &res)
+	return
+}
+
+func (r *runner) process(slog *slog.Logger, domain sacme.Domain, res *domainResult) (err error) {
+	slog.Info("processing domain")
+
+	state, err := r.store.Load(domain)
+	if err != nil {
+		err = fmt.Errorf("could not load domain state: %w", err)
+		return
+	}
+
+	slog.Info("loaded domain state", "account", state.Account)
+
+	iss, err := r.planIssuance(domain, state, time.Now())
+	if err != nil {
+		return
+	}
+
+	if iss.register {
+		slog.Info("registering account", "email", domain.Account.Email)
+
+		err = r.acme.Register(domain, state)
+		if err != nil {
+			err = fmt.Errorf("could not register ACME account: %w", err)
+			return
+		}
+
+		slog.Info("registered account")
+	}
+
+	// A certificate which could not be renewed is still valid, so its
+	// installs are brought up to date before reporting the failure
+	var renewErr error
+	issued := false
+	if iss.issue {
+		slog.Info("issuing certificate", "renew", iss.renew, "reason", iss.reason)
+		if err = r.issueCertificate(slog, domain, state, iss.renew, res); err != nil {
+			if !iss.renew {
+				return
+			}
+			slog.Warn("keeping the current certificate after renewal failure")
+			renewErr, err = err, nil
+		} else {
+			// The certificate is kept even if installing it fails below,
+			// and the installs are retried on the next run
+			if err = saveState(slog, r.store, domain, state, "new_certificate"); err != nil {
+				return
+			}
+			res.Modified = true
+			issued = true
+		}
+	}
+
+	placeholders, err := state.ACME.Placeholders()
+	if err != nil {
+		err = fmt.Errorf("could not compute install placeholders: %w", err)
+		return
+	}
+	resolved := []sacme.Install{}
+	for _, i := range domain.Installs {
+		resolved = append(resolved, i.Resolve(placeholders))
+	}
+
+	// Installs left behind with another certificate are all installed again
+	reinstall := r.reinstall || issued || staleInstalls(r.fs, state, placeholders[sacme.PLACEHOLDER_SERIAL])
+
+	if err = r.apply(slog, domain, state, planInstalls(state, resolved, reinstall), res); err != nil {
+		if renewErr != nil {
+			err = fmt.Errorf("%w; %v", renewErr, err)
+		}
+		return
+	}
+	slog.Info("finished processing", "rolled_back", res.RolledBack)
+	err = renewErr
+	return
+}
+
+// removeDomain uninstalls all the files of a domain which is no longer
+// defined, running its on_uninstall hooks. The certificate is kept in the
+// state, so that it can be reused if the domain is defined again.
+func (r *runner) removeDomain(slog *slog.Logger, domain sacme.Domain) (res domainResult) {
+	res.Domain = domain.Domain
+	slog.Info("removing domain")
+
+	state, err := r.store.Load(domain)
+	if err != nil {
+		res.Err = fmt.Errorf("could not load domain state: %w", err)
+		return
+	}
+	if len(state.Installs) > 0 {
+		res.Err = r.apply(slog, domain, state, planInstalls(state, nil, false), &res)
+	}
+	return
+}
+
+// apply carries out the install plan of a domain, saving the state when the
+// installs change. All file changes go through a journal, so that
+// they are rolled back if they fail or a hook requires it.
+func (r *runner) apply(slog *slog.Logger, domain sacme.Domain, state *sacme.State, plan installPlan, res *domainResult) (err error) {
+	tx := file.NewJournal(r.fs)
+	pending, installs, err := r.install(slog, domain, state, plan, tx, res)
+	if err != nil {
+		slog.Warn("rolling back install changes after failure")
+		if rerr := tx.Rollback(); rerr != nil {
+			err = fmt.Errorf("%w; could not roll back install changes: %v", err, rerr)
+		}
+		return
+	}
+	if res.RolledBack {
+		slog.Warn("rolling back install changes after hook failure")
+		if err = tx.Rollback(); err != nil {
+			err = fmt.Errorf("could not roll back install changes: %w", err)
+		}
+		return
+	}
+
+	res.Deferred = pending
+
+	if plan.modified() {
+		state.Installs = installs
+		if err = saveState(slog, r.store, domain, state, "install"); err != nil {
+			return
+		}
+	}
+
+	res.Modified = res.Modified || plan.modified()
+	return
+}
+
+// install carries out the install plan of a domain through tx, running the
+// hooks of the changed installs. It returns the deferred hooks to queue once
+// the changes stick, and the installs in place afterwards. res.RolledBack is
+// set when a hook asks for a rollback.
+func (r *runner) install(slog *slog.Logger, domain sacme.Domain, state *sacme.State, plan installPlan, tx *file.Journal, res *domainResult) (pending []sacme.Hook, installs []sacme.InstallState, err error) {
+	for _, i := range plan.uninstall {
+		if err = uninstall(slog, i, tx); err != nil {
+			return
+		}
+	}
+	installs = append(installs, plan.keep...)
+	slog.Debug("valid current install paths", "count", len(installs))
+
+	superseded := map[string]sacme.InstallState{}
+	for link, i := range plan.superseded {
+		superseded[link] = i
+	}
+	for _, i := range plan.install {
+		var is *sacme.InstallState
+		is, err = i.Install(tx, state)
+		if err != nil {
+			err = fmt.Errorf("could not install files: %w", err)
+			return
+		}
+		slog.Info("installed", "paths", is.Paths(), "link", is.Link)
+		if previous, ok := superseded[is.Link]; i.Live != nil && ok {
+			delete(superseded, is.Link)
+			for _, pruned := range is.Supersede(previous, i.Live.Keep) {
+				if err = uninstall(slog, pruned, tx); err != nil {
+					return
+				}
+			}
+		}
+		installs = append(installs, *is)
+
+		if len(i.Hooks) <= 0 && i.Reload == nil {
+			continue
+		}
+		if r.skipHooks {
+			slog.Info("avoiding running hooks", "hooks", len(i.Hooks), "reload", i.Reload != nil)
+			continue
+		}
+
+		immediate := []sacme.Hook{}
+		for _, hook := range i.Hooks {
+			if hook.Deferred {
+				pending = append(pending, hook)
+			} else {
+				immediate = append(immediate, hook)
+			}
+		}
+
+		failure := sacme.ON_FAILURE_IGNORE
+		if len(immediate) > 0 {
+			var env []string
+			env, err = i.HookEnv(state)
+			if err != nil {
+				err = fmt.Errorf("could not prepare hook environment: %w", err)
+				return
+			}
+			slog.Info("running hooks for install", "hooks", len(immediate))
+			failure = runHooks(slog, immediate, env)
+		}
+		if failure == sacme.ON_FAILURE_IGNORE && i.Reload != nil {
+			failure = runReload(slog, *i.Reload)
+		}
+		res.HooksFailed = res.HooksFailed || failure != sacme.ON_FAILURE_IGNORE
+		if failure == sacme.ON_FAILURE_ROLLBACK {
+			res.RolledBack = true
+			return
+		}
+	}
+
+	for _, i := range superseded {
+		if err = uninstall(slog, i, tx); err != nil {
+			return
+		}
+	}
+
+	if len(plan.gone) > 0 && len(domain.Hooks.OnUninstall) > 0 {
+		if r.skipHooks {
+			slog.Info("avoiding running on_uninstall hooks", "hooks", len(domain.Hooks.OnUninstall))
+		} else {
+			slog.Info("running on_uninstall hooks", "hooks", len(domain.Hooks.OnUninstall), "paths", plan.gone)
+			env := []string{
+				sacme.HOOK_ENV_DOMAIN + "=" + domain.Domain,
+				sacme.HOOK_ENV_PATHS + "=" + strings.Join(plan.gone, " "),
+			}
+			failure := runHooks(slog, domain.Hooks.OnUninstall, env)
+			res.HooksFailed = res.HooksFailed || failure != sacme.ON_FAILURE_IGNORE
+		}
+	}
+	return
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"os/user"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/registration"
+	fs "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+
+	"github.com/lucat1/sacme"
+)
+
+// fakeACME issues certificates signed by a throwaway CA instead of contacting
+// one, refusing to issue for the domains in fail
+type fakeACME struct {
+	mu     sync.Mutex
+	fail   map[string]bool
+	issued []string
+}
+
+func (a *fakeACME) Register(domain sacme.Domain, state *sacme.State) error {
+	state.Account.Registration = &registration.Resource{URI: "https://ca.test/acct/" + domain.Domain}
+	return nil
+}
+
+func (a *fakeACME) Obtain(domain sacme.Domain, state *sacme.State) error {
+	return a.issue(domain, state)
+}
+
+func (a *fakeACME) Renew(domain sacme.Domain, state *sacme.State) error {
+	return a.issue(domain, state)
+}
+
+func (a *fakeACME) Revoke(domain sacme.Domain, state *sacme.State) error {
+	return nil
+}
+
+func (a *fakeACME) Deactivate(domain sacme.Domain, state *sacme.State) error {
+	return nil
+}
+
+func (a *fakeACME) issue(domain sacme.Domain, state *sacme.State) (err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.fail[domain.Domain] {
+		return fmt.Errorf("the CA refused to issue a certificate for %s", domain.Domain)
+	}
+	state.ACME, err = newCertificate(domain.Domain, time.Now().Add(90*24*time.Hour))
+	if err == nil {
+		a.issued = append(a.issued, domain.Domain)
+	}
+	return
+}
+
+// newCertificate returns a certificate for domain expiring at notAfter,
+// signed by a throwaway CA and bundled with its issuer
+func newCertificate(domain string, notAfter time.Time) (acme sacme.ACMEState, err error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sacme test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+
+	leafPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	acme = sacme.ACMEState{
+		Domain:            domain,
+		PrivateKey:        pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		Certificate:       append(append([]byte{}, leafPEM...), caPEM...),
+		IssuerCertificate: caPEM,
+	}
+	return
+}
+
+// testDomainFile returns a definition of name installing its key and
+// certificate in /ssl, owned by the running user. The lines in extra are
+// added to the install.
+func testDomainFile(t *testing.T, name string, extra ...string) string {
+	u, err := user.Current()
+	assert.Nil(t, err)
+	g, err := user.LookupGroupId(u.Gid)
+	assert.Nil(t, err)
+
+	return fmt.Sprintf(`
+domain = "%s"
+
+[account]
+email = "admin@%s"
+
+[[installs]]
+%s
+
+[installs.key]
+path = "/ssl/{domain}.key"
+perm = "0600"
+owner = "%s"
+group = "%s"
+
+[installs.crt]
+path = "/ssl/{domain}.crt"
+perm = "0644"
+owner = "%s"
+group = "%s"
+`, name, name, strings.Join(extra, "\n"), u.Username, g.Name, u.Username, g.Name)
+}
+
+// testDomain parses the definition returned by testDomainFile
+func testDomain(t *testing.T, name string, extra ...string) sacme.Domain {
+	config, err := sacme.ValidateConfig(sacme.RawConfig{})
+	assert.Nil(t, err)
+	d, err := sacme.ParseDomain([]byte(testDomainFile(t, name, extra...)), *config)
+	assert.Nil(t, err)
+	return *d
+}
+
+func newTestRunner(acme sacme.ACME) *runner {
+	store := sacme.NewStateStore(fs.NewMemMapFs())
+	return &runner{store: &store, acme: acme, fs: fs.NewMemMapFs()}
+}
+
+func testLogger() *slog.Logger {
+	logger := slog.New(slog.NewTextHandler(io.Discard))
+	return &logger
+}
+
+func TestProcessAllIsolatesDomains(t *testing.T) {
+	acme := &fakeACME{fail: map[string]bool{"a.test": true}}
+	r := newTestRunner(acme)
+	domains := []sacme.Domain{testDomain(t, "a.test"), testDomain(t, "b.test"), testDomain(t, "c.test")}
+
+	results := r.processAll(testLogger(), domains, 2)
+	assert.Len(t, results, 3)
+	assert.ErrorContains(t, results[0].Err, "the CA refused to issue a certificate for a.test")
+	assert.False(t, results[0].Modified)
+	for i, name := range []string{"b.test", "c.test"} {
+		res := results[i+1]
+		assert.Equal(t, name, res.Domain)
+		assert.Nil(t, res.Err)
+		assert.True(t, res.Modified)
+		exists, err := fs.Exists(r.fs, "/ssl/"+name+".crt")
+		assert.Nil(t, err)
+		assert.True(t, exists, name)
+	}
+	exists, err := fs.Exists(r.fs, "/ssl/a.test.crt")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	assert.ElementsMatch(t, []string{"b.test", "c.test"}, acme.issued)
+	assert.Equal(t, EXIT_PARTIAL_FAILURE, summarize(testLogger(), results, false))
+}
+
+func TestSummarize(t *testing.T) {
+	failed := fmt.Errorf("failed")
+	for _, test := range []struct {
+		name        string
+		results     []domainResult
+		hooksFailed bool
+		code        int
+	}{
+		{"unchanged", []domainResult{{Domain: "a.test"}, {Domain: "b.test"}}, false, EXIT_OK},
+		{"updated", []domainResult{{Domain: "a.test", Modified: true}}, false, EXIT_OK},
+		{"hook failed", []domainResult{{Domain: "a.test"}, {Domain: "b.test", HooksFailed: true}}, false, EXIT_HOOKS_FAILED},
+		{"deferred hook failed", []domainResult{{Domain: "a.test"}}, true, EXIT_HOOKS_FAILED},
+		{"partial failure", []domainResult{{Domain: "a.test", Err: failed}, {Domain: "b.test", HooksFailed: true}}, true, EXIT_PARTIAL_FAILURE},
+		{"failure", []domainResult{{Domain: "a.test", Err: failed}, {Domain: "b.test", Err: failed}}, false, EXIT_FAILURE},
+	} {
+		assert.Equal(t, test.code, summarize(testLogger(), test.results, test.hooksFailed), test.name)
+	}
+}
+
+func TestProcessSavesCertificateAfterInstallFailure(t *testing.T) {
+	acme := &fakeACME{}
+	r := newTestRunner(acme)
+	root := r.fs
+	r.fs = fs.NewReadOnlyFs(root)
+	domain := testDomain(t, "a.test")
+
+	logger := testLogger()
+	res := r.processDomain(logger, domain)
+	assert.ErrorContains(t, res.Err, "could not install files")
+	state, err := r.store.Load(domain)
+	assert.Nil(t, err)
+	assert.False(t, state.ACME.Empty())
+	assert.True(t, state.IsRegistered())
+	assert.Empty(t, state.Installs)
+
+	// the installs are retried with the saved certificate
+	r.fs = root
+	res = r.processDomain(logger, domain)
+	assert.Nil(t, res.Err)
+	assert.True(t, res.Modified)
+	assert.Equal(t, []string{"a.test"}, acme.issued)
+	state, err = r.store.Load(domain)
+	assert.Nil(t, err)
+	assert.Len(t, state.Installs, 1)
+	exists, err := fs.Exists(r.fs, "/ssl/a.test.key")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+}
+
+func TestProcessInstallsAfterRenewalFailure(t *testing.T) {
+	acme := &fakeACME{fail: map[string]bool{}}
+	r := newTestRunner(acme)
+	logger := testLogger()
+	res := r.processDomain(logger, testDomain(t, "a.test"))
+	assert.Nil(t, res.Err)
+
+	// the current certificate is still valid, so the changed install is
+	// written with it
+	acme.fail["a.test"] = true
+	r.forceRenew = true
+	domain := testDomain(t, "a.test", `hooks = ["true"]`)
+	domain.Installs[0].Key.Path = "/ssl/moved.key"
+	res = r.processDomain(logger, domain)
+	assert.ErrorContains(t, res.Err, "the CA refused to issue a certificate for a.test")
+	assert.True(t, res.Modified)
+	exists, err := fs.Exists(r.fs, "/ssl/moved.key")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	exists, err = fs.Exists(r.fs, "/ssl/a.test.key")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	state, err := r.store.Load(domain)
+	assert.Nil(t, err)
+	assert.Equal(t, "/ssl/moved.key", state.Installs[0].Key.Path)
+}
+
+func TestProcessReinstallsAfterRollback(t *testing.T) {
+	acme := &fakeACME{}
+	r := newTestRunner(acme)
+	logger := testLogger()
+	// the hook fails once the file exists
+	fail := t.TempDir() + "/fail"
+	domain := testDomain(t, "a.test", fmt.Sprintf(`hooks = [{ command = "test ! -e %s", on_failure = "rollback" }]`, fail))
+	res := r.processDomain(logger, domain)
+	assert.Nil(t, res.Err)
+
+	// the serial is not recorded in states saved by older versions, whose
+	// files are left alone if they hold the current certificate
+	state, err := r.store.Load(domain)
+	assert.Nil(t, err)
+	state.Installs[0].Serial = ""
+	assert.Nil(t, r.store.Store(domain, state))
+	res = r.processDomain(logger, domain)
+	assert.Nil(t, res.Err)
+	assert.False(t, res.Modified)
+	installed, err := fs.ReadFile(r.fs, "/ssl/a.test.crt")
+	assert.Nil(t, err)
+
+	// the new certificate is kept, while its files are rolled back
+	assert.Nil(t, fs.WriteFile(fs.NewOsFs(), fail, nil, 0644))
+	r.forceRenew = true
+	res = r.processDomain(logger, domain)
+	assert.Nil(t, res.Err)
+	assert.True(t, res.RolledBack)
+	crt, err := fs.ReadFile(r.fs, "/ssl/a.test.crt")
+	assert.Nil(t, err)
+	assert.Equal(t, installed, crt)
+
+	// the files rolled back are written again with the new certificate
+	assert.Nil(t, fs.NewOsFs().Remove(fail))
+	r.forceRenew = false
+	res = r.processDomain(logger, domain)
+	assert.Nil(t, res.Err)
+	assert.False(t, res.RolledBack)
+	assert.Len(t, acme.issued, 2)
+	state, err = r.store.Load(domain)
+	assert.Nil(t, err)
+	expected, err := state.ACME.Part(sacme.INSTALL_PART_CRT)
+	assert.Nil(t, err)
+	crt, err = fs.ReadFile(r.fs, "/ssl/a.test.crt")
+	assert.Nil(t, err)
+	assert.Equal(t, expected, crt)
+	assert.NotEqual(t, installed, crt)
+	assert.NotEmpty(t, state.Installs[0].Serial)
+}
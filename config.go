@@ -0,0 +1,259 @@
+package sacme
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+type RawInstallDefaults struct {
+	KeyPerm  string `toml:"key_perm"`
+	CertPerm string `toml:"cert_perm"`
+	DirPerm  string `toml:"dir_perm"`
+	Owner    string `toml:"owner"`
+	Group    string `toml:"group"`
+}
+
+// InstallDefaults holds the values used for the fields left unset in install
+// targets. Targets containing private keys use KeyPerm, all other files
+// CertPerm, and directories DirPerm.
+type InstallDefaults struct {
+	KeyPerm  os.FileMode
+	CertPerm os.FileMode
+	DirPerm  os.FileMode
+	Owner    *user.User
+	Group    *user.Group
+}
+
+// PathPermDefaults returns the defaults for a single file, depending on
+// whether it contains a private key or not.
+func (d InstallDefaults) PathPermDefaults(key bool) PathPermDefaults {
+	perm := d.CertPerm
+	if key {
+		perm = d.KeyPerm
+	}
+	return PathPermDefaults{
+		Perm:    perm,
+		DirPerm: d.DirPerm,
+		Owner:   d.Owner,
+		Group:   d.Group,
+	}
+}
+
+// ValidateInstallDefaults parses a RawInstallDefaults into an InstallDefaults
+// struct. Unset perms take the built-in defaults, while the owner and group
+// default to the running user and its primary group.
+func ValidateInstallDefaults(raw RawInstallDefaults) (d *InstallDefaults, err error) {
+	var defaults InstallDefaults
+
+	perms := []struct {
+		name  string
+		raw   string
+		def   string
+		value *os.FileMode
+	}{
+		{"key_perm", raw.KeyPerm, DEFAULT_KEY_PERM, &defaults.KeyPerm},
+		{"cert_perm", raw.CertPerm, DEFAULT_CERT_PERM, &defaults.CertPerm},
+		{"dir_perm", raw.DirPerm, DEFAULT_DIR_PERM, &defaults.DirPerm},
+	}
+	for _, perm := range perms {
+		value := perm.def
+		if len(perm.raw) > 0 {
+			value = perm.raw
+		}
+		*perm.value, err = parsePerm(value)
+		if err != nil {
+			err = fmt.Errorf("invalid default `%s`: %w", perm.name, atKey(err, perm.name))
+			return
+		}
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		err = fmt.Errorf("could not find the running user: %w", err)
+		return
+	}
+
+	defaults.Owner = current
+	if len(raw.Owner) > 0 {
+		defaults.Owner, err = lookupUser(raw.Owner)
+		if err != nil {
+			err = fmt.Errorf("could not find default owner user: %w", err)
+			return
+		}
+	}
+
+	if len(raw.Group) > 0 {
+		defaults.Group, err = lookupGroup(raw.Group)
+	} else {
+		defaults.Group, err = lookupGroup(current.Gid)
+	}
+	if err != nil {
+		err = fmt.Errorf("could not find default group: %w", err)
+		return
+	}
+
+	d = &defaults
+	return
+}
+
+type RawConfig struct {
+	// run as an unprivileged user, see Privileges
+	Rootless bool `toml:"rootless"`
+	// user and group the ACME work is performed as, see HelperACME
+	ACMEUser  string             `toml:"acme_user"`
+	ACMEGroup string             `toml:"acme_group"`
+	Install   RawInstallDefaults `toml:"install"`
+	// defaults for all domains, see RawDomain
+	Account        RawAccount     `toml:"account"`
+	Authentication Authentication `toml:"authentication"`
+	Renewal        RawRenewal     `toml:"renewal"`
+	Hooks          RawDomainHooks `toml:"hooks"`
+}
+
+type Config struct {
+	Install InstallDefaults
+	// merged under the values of each domain by ValidateDomain
+	Defaults RawDomain
+	// only set in rootless mode, to check domains against
+	Privileges *Privileges
+	// only set when privileges have to be dropped for the ACME work
+	ACMEUser  *user.User
+	ACMEGroup *user.Group
+}
+
+// ValidateConfig parses a RawConfig into a Config struct. An empty RawConfig
+// yields the built-in defaults.
+func ValidateConfig(raw RawConfig) (c *Config, err error) {
+	var config Config
+
+	install, err := ValidateInstallDefaults(raw.Install)
+	if err != nil {
+		err = fmt.Errorf("could not validate install defaults: %w", atKey(err, "install"))
+		return
+	}
+	config.Install = *install
+
+	config.Defaults = RawDomain{
+		Account:        raw.Account,
+		Authentication: raw.Authentication,
+		Renewal:        raw.Renewal,
+		Hooks:          raw.Hooks,
+	}
+	if err = validateDomainDefaults(config.Defaults); err != nil {
+		return
+	}
+
+	if raw.Rootless {
+		config.Privileges, err = CurrentPrivileges()
+		if err != nil {
+			err = fmt.Errorf("could not determine privileges for rootless mode: %w", err)
+			return
+		}
+	}
+
+	if len(raw.ACMEUser) > 0 {
+		config.ACMEUser, config.ACMEGroup, err = validateACMEUser(raw)
+		if err != nil {
+			err = fmt.Errorf("invalid user for ACME work: %w", atKey(err, "acme_user"))
+			return
+		}
+	} else if len(raw.ACMEGroup) > 0 {
+		err = atKey(fmt.Errorf("`acme_group` requires `acme_user` to be set"), "acme_group")
+		return
+	}
+
+	c = &config
+	return
+}
+
+// validateDomainDefaults checks the defaults for all domains on their own.
+// The email is only required once they are merged into a domain.
+func validateDomainDefaults(raw RawDomain) (err error) {
+	if _, err = validateAccountOptions(raw.Account); err != nil {
+		err = fmt.Errorf("could not validate default account definition: %w", atKey(err, "account"))
+		return
+	}
+	if _, err = ValidateAuthentication(raw.Authentication); err != nil {
+		err = fmt.Errorf("could not validate default authentication definition: %w", atKey(err, "authentication"))
+		return
+	}
+	if _, err = ValidateRenewal(raw.Renewal); err != nil {
+		err = fmt.Errorf("could not validate default renewal definition: %w", atKey(err, "renewal"))
+		return
+	}
+	if _, err = ValidateDomainHooks(raw.Hooks); err != nil {
+		err = fmt.Errorf("could not validate default hooks definition: %w", atKey(err, "hooks"))
+		return
+	}
+	return
+}
+
+// validateACMEUser looks up the user and group to drop privileges to, which
+// defaults to the primary group of the user. Nothing is returned when the
+// running user is already the requested one.
+func validateACMEUser(raw RawConfig) (u *user.User, g *user.Group, err error) {
+	u, err = lookupUser(raw.ACMEUser)
+	if err != nil {
+		return
+	}
+	if len(raw.ACMEGroup) > 0 {
+		g, err = lookupGroup(raw.ACMEGroup)
+	} else {
+		g, err = lookupGroup(u.Gid)
+	}
+	if err != nil {
+		return
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		err = fmt.Errorf("could not find the running user: %w", err)
+		return
+	}
+	if current.Uid == u.Uid && current.Gid == g.Gid {
+		u, g = nil, nil
+		return
+	}
+	if current.Uid != "0" {
+		err = fmt.Errorf("%w: switching to %s:%s as %s", RequiresPrivileges, u.Username, g.Name, current.Username)
+		return
+	}
+	return
+}
+
+func ParseConfig(data []byte) (c *Config, err error) {
+	var config RawConfig
+	err = toml.Unmarshal(data, &config)
+	if err != nil {
+		err = fmt.Errorf("could not parse config TOML definition: %w", err)
+		return
+	}
+
+	c, err = ValidateConfig(config)
+	if err != nil {
+		err = fmt.Errorf("could not verify config definition: %w", err)
+		return
+	}
+
+	return
+}
+
+// LoadConfig loads the global configuration file from the domains directory,
+// falling back to the built-in defaults when the file does not exist.
+func LoadConfig(f fs.FS) (c *Config, err error) {
+	content, err := fs.ReadFile(f, CONFIG_FILE_NAME)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ValidateConfig(RawConfig{})
+	}
+	if err != nil {
+		err = fmt.Errorf("could not read config file: %w", err)
+		return
+	}
+
+	return ParseConfig(content)
+}
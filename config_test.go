@@ -0,0 +1,105 @@
+package sacme_test
+
+import (
+	"os"
+	"os/user"
+	"testing"
+	"time"
+
+	"github.com/lucat1/sacme"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConfig(t *testing.T) {
+	u, err := user.Current()
+	assert.Nil(t, err)
+
+	config, err := sacme.ParseConfig([]byte(`
+[install]
+key_perm = "0640"
+owner = "` + u.Uid + `"
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0640), config.Install.KeyPerm)
+	assert.Equal(t, os.FileMode(0644), config.Install.CertPerm)
+	assert.Equal(t, os.FileMode(0755), config.Install.DirPerm)
+	assert.Equal(t, u.Uid, config.Install.Owner.Uid)
+	assert.Equal(t, u.Gid, config.Install.Group.Gid)
+
+	_, err = sacme.ParseConfig([]byte("[install]\ncert_perm = \"rw\"\n"))
+	assert.NotNil(t, err)
+}
+
+func TestConfigDomainDefaults(t *testing.T) {
+	config, err := sacme.ParseConfig([]byte(`
+[account]
+email = "admin@example.com"
+accept_tos = true
+directory = "https://acme.example.com/directory"
+
+[authentication]
+method = "dns-01/acmedns"
+options = { username = "user", password = "secret", subdomain = "sub" }
+
+[renewal]
+before_expiry = "720h"
+
+[hooks]
+post_issue = ["true"]
+hook_timeout = "1m"
+`))
+	assert.Nil(t, err)
+
+	d, err := sacme.ParseDomain([]byte(`
+domain = "example.com"
+
+[authentication]
+options = { subdomain = "other" }
+
+[hooks]
+pre_issue = ["false"]
+`), *config)
+	assert.Nil(t, err)
+	assert.Equal(t, "admin@example.com", d.Account.Email)
+	assert.True(t, d.Account.AcceptTOS)
+	assert.Equal(t, "https://acme.example.com/directory", d.Account.Directroy.String())
+	assert.Equal(t, sacme.AUTHENTICATION_METHOD_DNS01_ACMEDNS, d.Authentication.Method)
+	assert.Equal(t, "user", d.Authentication.Options[sacme.AUTHENTICATION_OPTION_USERNAME])
+	assert.Equal(t, "other", d.Authentication.Options[sacme.AUTHENTICATION_OPTION_SUBDOMAIN])
+	assert.Equal(t, 720*time.Hour, d.Renewal.BeforeExpiry)
+	assert.Len(t, d.Hooks.PreIssue, 1)
+	assert.Len(t, d.Hooks.PostIssue, 1)
+	assert.Equal(t, time.Minute, d.Hooks.PreIssue[0].Timeout)
+
+	// options are not inherited by another method, and domain values win
+	d, err = sacme.ParseDomain([]byte(`
+domain = "example.com"
+
+[account]
+email = "root@example.com"
+accept_tos = false
+
+[authentication]
+method = "http-01/standalone"
+
+[renewal]
+fraction = 0.75
+`), *config)
+	assert.Nil(t, err)
+	assert.Equal(t, "root@example.com", d.Account.Email)
+	assert.False(t, d.Account.AcceptTOS)
+	assert.Equal(t, sacme.DEFAULT_AUTHENTICATION_OPTIONS[sacme.AUTHENTICATION_METHOD_HTTP01_STANDALONE], d.Authentication.Options)
+	assert.Equal(t, 0.75, d.Renewal.Fraction)
+	assert.Zero(t, d.Renewal.BeforeExpiry)
+
+	// the defaults are checked on their own, and the email is still required
+	_, err = sacme.ParseConfig([]byte("[renewal]\nfraction = 2\n"))
+	assert.ErrorIs(t, err, sacme.InvalidRenewal)
+	_, err = sacme.ParseDomain([]byte(`domain = "example.com"`), *DefaultConfig(t))
+	assert.ErrorIs(t, err, sacme.MissingEmail)
+	_, err = sacme.ParseConfig([]byte("[account]\nkey_type = \"bogus\"\n"))
+	assert.ErrorContains(t, err, "invalid key type: bogus")
+	config, err = sacme.ParseConfig([]byte("[account]\nkey_type = \"rsa4096\"\n"))
+	assert.Nil(t, err)
+	assert.Empty(t, config.Defaults.Account.Email)
+}
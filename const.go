@@ -1,19 +1,126 @@
 package sacme
 
-import "golang.org/x/exp/slog"
+import (
+	"syscall"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
 
 const DOMAIN_FILE_SUFFIX = ".toml"
 
+// The global config file, looked up in the domains directory
+const CONFIG_FILE_NAME = "sacme.toml"
+
 const DEFAULT_DIRECTORY = "https://acme-v02.api.letsencrypt.org/directory"
 const DEFAULT_DOMAIN_PATH = "/etc/sacme"
 const DEFAULT_STATE_STORE_PATH = "/var/lib/sacme"
 const DEFAULT_SKIP_HOOKS = false
 
+// Domains are processed one at a time unless asked otherwise
+const DEFAULT_JOBS = 1
+
+// By default, certificates are renewed halfway through their validity
+const DEFAULT_RENEWAL_FRACTION = 0.5
+
+// In daemon mode, failed domains are retried with an exponential backoff
+// between these bounds, and the domains are checked at least this often
+const (
+	RETRY_BACKOFF_MIN   = time.Minute
+	RETRY_BACKOFF_MAX   = 6 * time.Hour
+	DAEMON_MAX_INTERVAL = 24 * time.Hour
+)
+
+// Changes to the domain files are applied once no more changes have been
+// seen for this long, so that editors are done writing them
+const DAEMON_WATCH_DELAY = 500 * time.Millisecond
+
+// Renewals are forecast this far ahead unless asked otherwise
+const DEFAULT_FORECAST_PERIOD = 90 * 24 * time.Hour
+
 // NOTE: replace with slog.LevelInfo on newer slog versions
 const DEFAULT_LOG_LEVEL = int(slog.InfoLevel)
 
 const DEFAULT_SHELL = "/bin/sh"
 
+type OnFailure string
+
+// What to do when a hook fails
+const (
+	// log the failure and carry on
+	ON_FAILURE_IGNORE = OnFailure("ignore")
+	// skip the remaining hooks of the install and exit with an error
+	ON_FAILURE_FAIL = OnFailure("fail")
+	// additionally revert the files changed for the domain
+	ON_FAILURE_ROLLBACK = OnFailure("rollback")
+)
+
+var VALID_ON_FAILURES = map[OnFailure]bool{
+	ON_FAILURE_IGNORE:   true,
+	ON_FAILURE_FAIL:     true,
+	ON_FAILURE_ROLLBACK: true,
+}
+
+const DEFAULT_ON_FAILURE = ON_FAILURE_IGNORE
+const DEFAULT_HOOK_TIMEOUT = "5m"
+
+// Environment variables describing the installed certificate to hooks. Paths
+// of install targets are passed as HOOK_ENV_PREFIX + TARGET + HOOK_ENV_PATH,
+// e.g. SACME_KEY_PATH.
+const (
+	HOOK_ENV_PREFIX = "SACME_"
+	HOOK_ENV_PATH   = "_PATH"
+	HOOK_ENV_DOMAIN = "SACME_DOMAIN"
+	// for deferred hooks, the space separated domains which queued them
+	HOOK_ENV_DOMAINS    = "SACME_DOMAINS"
+	HOOK_ENV_SERIAL     = "SACME_SERIAL"
+	HOOK_ENV_NOT_BEFORE = "SACME_NOT_BEFORE"
+	HOOK_ENV_NOT_AFTER  = "SACME_NOT_AFTER"
+	HOOK_ENV_LIVE_DIR   = "SACME_LIVE_DIR"
+	HOOK_ENV_LIVE_LINK  = "SACME_LIVE_LINK"
+	// for post_issue hooks, either HOOK_RESULT_SUCCESS or HOOK_RESULT_FAILURE
+	HOOK_ENV_RESULT = "SACME_RESULT"
+	// for on_renew_failure hooks, the error which made issuance fail
+	HOOK_ENV_ERROR = "SACME_ERROR"
+	// for on_uninstall hooks, the space separated paths which were removed
+	HOOK_ENV_PATHS = "SACME_PATHS"
+)
+
+const (
+	HOOK_RESULT_SUCCESS = "success"
+	HOOK_RESULT_FAILURE = "failure"
+)
+
+type ReloadMethod string
+
+// How a reload action reaches the service
+const (
+	// signal the process whose pid is in a pidfile
+	RELOAD_METHOD_PIDFILE = ReloadMethod("pidfile")
+	// run systemctl reload on a unit
+	RELOAD_METHOD_UNIT = ReloadMethod("unit")
+	// signal the processes with a given name, but not their children of the
+	// same name (e.g. the master of nginx, not its workers)
+	RELOAD_METHOD_PROCESS = ReloadMethod("process")
+)
+
+var VALID_RELOAD_SIGNALS = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"TERM":  syscall.SIGTERM,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"WINCH": syscall.SIGWINCH,
+}
+
+const DEFAULT_RELOAD_SIGNAL = "HUP"
+const SYSTEMCTL = "systemctl"
+const PROC_PATH = "/proc"
+
+// Set in the environment of the unprivileged helper process doing ACME work
+const HELPER_ENV = "SACME_ACME_HELPER"
+
 type KeyType string
 
 // TODO: differentiate between KeyType for the certificate and for the accoutn
@@ -32,6 +139,95 @@ var VALID_KEY_TYPES = map[KeyType]bool{
 
 const DEFAULT_KEY_TYPE = KEY_TYPE_P256
 
+type InstallPart string
+
+// The parts of a certificate which can be installed, either as a standalone
+// target or as part of a concat target.
+const (
+	INSTALL_PART_KEY       = InstallPart("key")
+	INSTALL_PART_CRT       = InstallPart("crt")
+	INSTALL_PART_CA        = InstallPart("ca")
+	INSTALL_PART_LEAF      = InstallPart("leaf")
+	INSTALL_PART_CHAIN     = InstallPart("chain")
+	INSTALL_PART_FULLCHAIN = InstallPart("fullchain")
+)
+
+var VALID_INSTALL_PARTS = map[InstallPart]bool{
+	INSTALL_PART_KEY:       true,
+	INSTALL_PART_CRT:       true,
+	INSTALL_PART_CA:        true,
+	INSTALL_PART_LEAF:      true,
+	INSTALL_PART_CHAIN:     true,
+	INSTALL_PART_FULLCHAIN: true,
+}
+
+var DEFAULT_CONCAT_PARTS = []InstallPart{INSTALL_PART_KEY, INSTALL_PART_CRT}
+
+// Parts which always consist of a single key or certificate
+var SINGLE_BLOCK_INSTALL_PARTS = map[InstallPart]bool{
+	INSTALL_PART_KEY:  true,
+	INSTALL_PART_CA:   true,
+	INSTALL_PART_LEAF: true,
+}
+
+type Format string
+
+const (
+	// PEM blocks as returned by the CA
+	FORMAT_PEM = Format("pem")
+	// binary DER encoding, keys are encoded as PKCS#8
+	FORMAT_DER = Format("der")
+	// PEM with keys encoded as PKCS#8
+	FORMAT_PKCS8_PEM = Format("pkcs8-pem")
+	// PEM with keys encoded in their traditional format: PKCS#1 for RSA and
+	// SEC1 for EC keys
+	FORMAT_PKCS1_PEM = Format("pkcs1-pem")
+)
+
+var VALID_FORMATS = map[Format]bool{
+	FORMAT_PEM:       true,
+	FORMAT_DER:       true,
+	FORMAT_PKCS8_PEM: true,
+	FORMAT_PKCS1_PEM: true,
+}
+
+const DEFAULT_FORMAT = FORMAT_PEM
+
+// Placeholders which can be used in install paths, resolved against the
+// current certificate at install time
+const (
+	PLACEHOLDER_DOMAIN     = "{domain}"
+	PLACEHOLDER_SERIAL     = "{serial}"
+	PLACEHOLDER_NOT_BEFORE = "{not_before}"
+	PLACEHOLDER_NOT_AFTER  = "{not_after}"
+)
+
+var VALID_PLACEHOLDERS = map[string]bool{
+	PLACEHOLDER_DOMAIN:     true,
+	PLACEHOLDER_SERIAL:     true,
+	PLACEHOLDER_NOT_BEFORE: true,
+	PLACEHOLDER_NOT_AFTER:  true,
+}
+
+// Placeholders which differ on every issuance, one of which is required in
+// the directory of versioned installs
+var ISSUANCE_PLACEHOLDERS = map[string]bool{
+	PLACEHOLDER_SERIAL:     true,
+	PLACEHOLDER_NOT_BEFORE: true,
+	PLACEHOLDER_NOT_AFTER:  true,
+}
+
+const PLACEHOLDER_TIME_FORMAT = "20060102T150405Z"
+
+const DEFAULT_LIVE_KEEP = 2
+
+// Default permissions for installed files and created directories
+const (
+	DEFAULT_KEY_PERM  = "0600"
+	DEFAULT_CERT_PERM = "0644"
+	DEFAULT_DIR_PERM  = "0755"
+)
+
 type AuthenticationMethod string
 
 const (
@@ -91,9 +287,10 @@ var DEFAULT_AUTHENTICATION_OPTIONS = map[AuthenticationMethod]map[string]string{
 		AUTHENTICATION_OPTION_PORT:      "80",
 	},
 	AUTHENTICATION_METHOD_HTTP01_WEBROOT: {
-		AUTHENTICATION_OPTION_PATH:  "",
-		AUTHENTICATION_OPTION_OWNER: "root",
-		AUTHENTICATION_OPTION_GROUP: "root",
+		AUTHENTICATION_OPTION_PATH: "",
+		// the running user and its primary group
+		AUTHENTICATION_OPTION_OWNER: "",
+		AUTHENTICATION_OPTION_GROUP: "",
 		AUTHENTICATION_OPTION_PERM:  "0660",
 	},
 	AUTHENTICATION_METHOD_DNS01_ACMEDNS: {
@@ -103,3 +300,12 @@ var DEFAULT_AUTHENTICATION_OPTIONS = map[AuthenticationMethod]map[string]string{
 		AUTHENTICATION_OPTION_SUBDOMAIN: "",
 	},
 }
+
+// Parameters of the keystore password digests kept in the state
+const (
+	KEYSTORE_SALT_SIZE         = 16
+	KEYSTORE_DIGEST_ITERATIONS = 10000
+)
+
+// REDACTED_VALUE replaces secrets when the effective domain config is shown
+const REDACTED_VALUE = "<redacted>"
@@ -1,12 +1,18 @@
 package sacme
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
 	"os/user"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/lucat1/sacme/pkg/file"
 	"github.com/pelletier/go-toml/v2"
@@ -15,7 +21,7 @@ import (
 type RawAccount struct {
 	Email     string  `toml:"email"`
 	KeyType   KeyType `toml:"key_type"`
-	AcceptTOS bool    `toml:"accept_tos"`
+	AcceptTOS *bool   `toml:"accept_tos"`
 	Directroy *string `toml:"directory"`
 }
 
@@ -30,14 +36,19 @@ type Account struct {
 // ValidateAccount parses a RawAccount into an Account struct, resolving the URL
 // for the ACME directory or using the default value for it.
 func ValidateAccount(raw RawAccount) (a *Account, err error) {
-	acc := Account{
-		Email:     raw.Email,
-		AcceptTOS: raw.AcceptTOS,
+	if len(raw.Email) <= 0 {
+		err = atKey(fmt.Errorf("%w: domain definition lacks email", MissingEmail), "email")
+		return
 	}
+	return validateAccountOptions(raw)
+}
 
-	if len(acc.Email) <= 0 {
-		err = fmt.Errorf("%w: domain definition lacks email", MissingEmail)
-		return
+// validateAccountOptions is ValidateAccount without requiring an email, which
+// the defaults of the global config leave to each domain
+func validateAccountOptions(raw RawAccount) (a *Account, err error) {
+	acc := Account{
+		Email:     raw.Email,
+		AcceptTOS: raw.AcceptTOS != nil && *raw.AcceptTOS,
 	}
 
 	acc.KeyType = DEFAULT_KEY_TYPE
@@ -45,7 +56,7 @@ func ValidateAccount(raw RawAccount) (a *Account, err error) {
 		acc.KeyType = raw.KeyType
 	}
 	if !VALID_KEY_TYPES[acc.KeyType] {
-		err = fmt.Errorf("invalid key type: %s", acc.KeyType)
+		err = atKey(fmt.Errorf("invalid key type: %s", acc.KeyType), "key_type")
 		return
 	}
 
@@ -55,7 +66,7 @@ func ValidateAccount(raw RawAccount) (a *Account, err error) {
 	}
 	acc.Directroy, err = url.Parse(dir)
 	if err != nil {
-		err = fmt.Errorf("could not parse ACME directory URL: %w", err)
+		err = fmt.Errorf("could not parse ACME directory URL: %w", atKey(err, "directory"))
 		return
 	}
 
@@ -78,14 +89,18 @@ func ValidateAuthentication(raw Authentication) (a *Authentication, err error) {
 		auth.Method = raw.Method
 	}
 	if !VALID_AUTHENTICATION_METHODS[auth.Method] {
-		err = fmt.Errorf("invalid authentication method: %s", auth.Method)
+		err = atKey(fmt.Errorf("invalid authentication method: %s", auth.Method), "method")
 		return
 	}
 
-	auth.Options = DEFAULT_AUTHENTICATION_OPTIONS[auth.Method]
+	// the defaults are shared by all domains, so they are copied
+	auth.Options = map[string]string{}
+	for key, val := range DEFAULT_AUTHENTICATION_OPTIONS[auth.Method] {
+		auth.Options[key] = val
+	}
 	for key, val := range raw.Options {
 		if !VALID_AUTHENTICATION_OPTIONS[auth.Method][key] {
-			err = fmt.Errorf("unexpected option %s for method %s", key, auth.Method)
+			err = atKey(fmt.Errorf("unexpected option %s for method %s", key, auth.Method), "options", key)
 			return
 		}
 
@@ -102,103 +117,926 @@ type RawPathPerm struct {
 	Perm  string `toml:"perm"`
 	Owner string `toml:"owner"`
 	Group string `toml:"group"`
+	// When any of these is set, missing parent directories are created
+	DirPerm  string `toml:"dir_perm"`
+	DirOwner string `toml:"dir_owner"`
+	DirGroup string `toml:"dir_group"`
+}
+
+// PathPermDefaults provides the values for the fields left unset in a
+// RawPathPerm
+type PathPermDefaults struct {
+	Perm    os.FileMode
+	DirPerm os.FileMode
+	Owner   *user.User
+	Group   *user.Group
 }
 
 // PrasePathPerm parses a RawPathPerm into an PathPerm struct, resolving the
 // install path to absolute, as well as querying the getent system for
-// user/group data.
-func ValidatePathPerm(raw RawPathPerm) (p *file.PathPerm, err error) {
-	var perm file.PathPerm
+// user/group data. Unset fields are taken from the defaults.
+func ValidatePathPerm(raw RawPathPerm, defaults PathPermDefaults) (p *file.PathPerm, err error) {
+	perm := file.PathPerm{
+		Perm:  defaults.Perm,
+		Owner: defaults.Owner,
+		Group: defaults.Group,
+	}
 
 	perm.Path, err = filepath.Abs(raw.Path)
 	if err != nil {
 		err = fmt.Errorf("could not convert install path to absolute: %w", err)
 		return
 	}
-	pp, err := strconv.ParseInt(raw.Perm, 0, 0)
+	if len(raw.Perm) > 0 {
+		perm.Perm, err = parsePerm(raw.Perm)
+		if err != nil {
+			return
+		}
+	}
+	if len(raw.Owner) > 0 {
+		perm.Owner, err = lookupUser(raw.Owner)
+		if err != nil {
+			err = fmt.Errorf("could not find owner user for install: %w", err)
+			return
+		}
+	}
+	if perm.Owner == nil {
+		err = fmt.Errorf("%w: missing owner for %s", InvalidOwner, perm.Path)
+		return
+	}
+	if len(raw.Group) > 0 {
+		perm.Group, err = lookupGroup(raw.Group)
+		if err != nil {
+			err = fmt.Errorf("could not find group for install: %w", err)
+			return
+		}
+	}
+	if perm.Group == nil {
+		err = fmt.Errorf("%w: missing group for %s", InvalidGroup, perm.Path)
+		return
+	}
+
+	if len(raw.DirPerm) > 0 || len(raw.DirOwner) > 0 || len(raw.DirGroup) > 0 {
+		perm.Parents, err = validateParents(raw, perm, defaults.DirPerm)
+		if err != nil {
+			return
+		}
+	}
+
+	p = &perm
+	return
+}
+
+// validateParents parses the settings for missing parent directories,
+// which are by default owned by the same user/group as the file itself.
+func validateParents(raw RawPathPerm, pp file.PathPerm, dirPerm os.FileMode) (p *file.Parents, err error) {
+	parents := file.Parents{
+		Perm:  dirPerm,
+		Owner: pp.Owner,
+		Group: pp.Group,
+	}
+
+	if len(raw.DirPerm) > 0 {
+		parents.Perm, err = parsePerm(raw.DirPerm)
+		if err != nil {
+			err = fmt.Errorf("invalid directory permission: %w", err)
+			return
+		}
+	}
+
+	if len(raw.DirOwner) > 0 {
+		parents.Owner, err = lookupUser(raw.DirOwner)
+		if err != nil {
+			err = fmt.Errorf("could not find owner user for directories: %w", err)
+			return
+		}
+	}
+	if len(raw.DirGroup) > 0 {
+		parents.Group, err = lookupGroup(raw.DirGroup)
+		if err != nil {
+			err = fmt.Errorf("could not find group for directories: %w", err)
+			return
+		}
+	}
+
+	p = &parents
+	return
+}
+
+// lookupUser finds a user by name or by numeric uid. Numeric ids unknown to
+// the system are accepted as they are.
+func lookupUser(name string) (u *user.User, err error) {
+	u, err = user.Lookup(name)
+	if err == nil {
+		return
+	}
+	if _, perr := strconv.ParseUint(name, 10, 32); perr != nil {
+		return
+	}
+
+	u, err = user.LookupId(name)
+	if errors.As(err, new(user.UnknownUserIdError)) {
+		u = &user.User{Uid: name, Gid: name, Username: name}
+		err = nil
+	}
+	return
+}
+
+// lookupGroup finds a group by name or by numeric gid. Numeric ids unknown to
+// the system are accepted as they are.
+func lookupGroup(name string) (g *user.Group, err error) {
+	g, err = user.LookupGroup(name)
+	if err == nil {
+		return
+	}
+	if _, perr := strconv.ParseUint(name, 10, 32); perr != nil {
+		return
+	}
+
+	g, err = user.LookupGroupId(name)
+	if errors.As(err, new(user.UnknownGroupIdError)) {
+		g = &user.Group{Gid: name, Name: name}
+		err = nil
+	}
+	return
+}
+
+func parsePerm(raw string) (perm os.FileMode, err error) {
+	pp, err := strconv.ParseInt(raw, 0, 0)
 	if err != nil {
 		err = fmt.Errorf("could not parse permission value (should start with 0): %w", err)
 		return
 	}
-	perm.Perm = os.FileMode(pp)
-	perm.Owner, err = user.Lookup(raw.Owner)
+	perm = os.FileMode(pp)
+	return
+}
+
+var placeholderRegexp = regexp.MustCompile(`\{[^{}]*\}`)
+
+// validatePathTemplate checks that all placeholders used in an install path
+// are known, returning the ones found.
+func validatePathTemplate(path string) (placeholders map[string]bool, err error) {
+	placeholders = map[string]bool{}
+	for _, placeholder := range placeholderRegexp.FindAllString(path, -1) {
+		if !VALID_PLACEHOLDERS[placeholder] {
+			err = fmt.Errorf("%w: unknown placeholder %s in path %s", InvalidPlaceholder, placeholder, path)
+			return
+		}
+		placeholders[placeholder] = true
+	}
+	return
+}
+
+type RawKeystore struct {
+	RawPathPerm
+	Password     string `toml:"password"`
+	PasswordFile string `toml:"password_file"`
+	Alias        string `toml:"alias"`
+}
+
+type Keystore struct {
+	file.PathPerm
+	Password string
+	// only for jks, when empty the domain name is used as the alias of the
+	// entry
+	Alias string
+}
+
+// ValidateKeystore parses a RawKeystore into a Keystore struct, reading the
+// password from the configured password file when necessary.
+func ValidateKeystore(raw RawKeystore, defaults InstallDefaults) (k *Keystore, err error) {
+	ks := Keystore{
+		Password: raw.Password,
+		Alias:    raw.Alias,
+	}
+
+	pp, err := ValidatePathPerm(raw.RawPathPerm, defaults.PathPermDefaults(true))
 	if err != nil {
-		err = fmt.Errorf("could not find owner user for install: %w", err)
 		return
 	}
-	perm.Group, err = user.LookupGroup(raw.Group)
+	ks.PathPerm = *pp
+	if _, err = validatePathTemplate(ks.Path); err != nil {
+		return
+	}
+
+	if len(raw.Password) > 0 && len(raw.PasswordFile) > 0 {
+		err = fmt.Errorf("only one of `password` and `password_file` can be set")
+		return
+	}
+	if len(raw.PasswordFile) > 0 {
+		var content []byte
+		content, err = os.ReadFile(raw.PasswordFile)
+		if err != nil {
+			err = fmt.Errorf("could not read keystore password file: %w", err)
+			return
+		}
+		ks.Password = strings.TrimRight(string(content), "\r\n")
+	}
+	if len(ks.Password) <= 0 {
+		err = fmt.Errorf("%w: keystores require a password", MissingPassword)
+		return
+	}
+
+	k = &ks
+	return
+}
+
+type RawTarget struct {
+	RawPathPerm
+	Format Format `toml:"format"`
+}
+
+type Target struct {
+	file.PathPerm
+	Format Format
+}
+
+// ValidateTarget parses a RawTarget into a Target struct, checking that the
+// requested format can represent all the given parts. Targets holding the
+// private key default to the stricter key permissions.
+func ValidateTarget(raw RawTarget, defaults InstallDefaults, parts ...InstallPart) (t *Target, err error) {
+	target := Target{
+		Format: DEFAULT_FORMAT,
+	}
+
+	hasKey := false
+	for _, part := range parts {
+		hasKey = hasKey || part == INSTALL_PART_KEY
+	}
+
+	pp, err := ValidatePathPerm(raw.RawPathPerm, defaults.PathPermDefaults(hasKey))
 	if err != nil {
-		err = fmt.Errorf("could not find group for install: %w", err)
+		return
+	}
+	target.PathPerm = *pp
+	if _, err = validatePathTemplate(target.Path); err != nil {
 		return
 	}
 
-	p = &perm
+	if len(raw.Format) > 0 {
+		target.Format = raw.Format
+	}
+	if !VALID_FORMATS[target.Format] {
+		err = fmt.Errorf("%w: unknown format %s", InvalidFormat, target.Format)
+		return
+	}
+
+	switch target.Format {
+	case FORMAT_DER:
+		if len(parts) != 1 || !SINGLE_BLOCK_INSTALL_PARTS[parts[0]] {
+			err = fmt.Errorf("%w: format %s can only hold a single key or certificate", InvalidFormat, target.Format)
+			return
+		}
+	case FORMAT_PKCS8_PEM, FORMAT_PKCS1_PEM:
+		if !hasKey {
+			err = fmt.Errorf("%w: format %s only applies to private keys", InvalidFormat, target.Format)
+			return
+		}
+	}
+
+	t = &target
+	return
+}
+
+type RawConcat struct {
+	RawTarget
+	Parts []InstallPart `toml:"parts"`
+}
+
+type Concat struct {
+	Target
+	Parts []InstallPart
+}
+
+// ValidateConcat parses a RawConcat into a Concat struct, checking the
+// requested parts and defaulting to the key followed by the certificate.
+func ValidateConcat(raw RawConcat, defaults InstallDefaults) (c *Concat, err error) {
+	concat := Concat{
+		Parts: DEFAULT_CONCAT_PARTS,
+	}
+
+	if raw.Parts != nil {
+		if len(raw.Parts) <= 0 {
+			err = fmt.Errorf("%w: concat requires at least one part", InvalidPart)
+			return
+		}
+		for _, part := range raw.Parts {
+			if !VALID_INSTALL_PARTS[part] {
+				err = fmt.Errorf("%w: unknown concat part %s", InvalidPart, part)
+				return
+			}
+		}
+		concat.Parts = raw.Parts
+	}
+
+	target, err := ValidateTarget(raw.RawTarget, defaults, concat.Parts...)
+	if err != nil {
+		return
+	}
+	concat.Target = *target
+
+	c = &concat
+	return
+}
+
+type RawLive struct {
+	// the version directory, created with the given permissions
+	RawPathPerm
+	Link string `toml:"link"`
+	Keep *int   `toml:"keep"`
+}
+
+type Live struct {
+	Dir  file.PathPerm
+	Link string
+	// the number of previous versions to retain
+	Keep int
+}
+
+// ValidateLive parses a RawLive into a Live struct, making sure that the
+// version directory changes on every issuance while the link does not.
+func ValidateLive(raw RawLive, defaults InstallDefaults) (l *Live, err error) {
+	live := Live{
+		Keep: DEFAULT_LIVE_KEEP,
+	}
+
+	dirDefaults := defaults.PathPermDefaults(false)
+	dirDefaults.Perm = defaults.DirPerm
+	dir, err := ValidatePathPerm(raw.RawPathPerm, dirDefaults)
+	if err != nil {
+		return
+	}
+	live.Dir = *dir
+
+	placeholders, err := validatePathTemplate(live.Dir.Path)
+	if err != nil {
+		return
+	}
+	versioned := false
+	for placeholder := range placeholders {
+		versioned = versioned || ISSUANCE_PLACEHOLDERS[placeholder]
+	}
+	if !versioned {
+		err = fmt.Errorf("%w: version directory %s must contain one of %s, %s or %s", InvalidLive, live.Dir.Path, PLACEHOLDER_SERIAL, PLACEHOLDER_NOT_BEFORE, PLACEHOLDER_NOT_AFTER)
+		return
+	}
+
+	if len(raw.Link) <= 0 {
+		err = fmt.Errorf("%w: missing link path", InvalidLive)
+		return
+	}
+	live.Link, err = filepath.Abs(raw.Link)
+	if err != nil {
+		err = fmt.Errorf("could not convert link path to absolute: %w", err)
+		return
+	}
+	placeholders, err = validatePathTemplate(live.Link)
+	if err != nil {
+		return
+	}
+	for placeholder := range placeholders {
+		if ISSUANCE_PLACEHOLDERS[placeholder] {
+			err = fmt.Errorf("%w: link %s cannot contain %s", InvalidLive, live.Link, placeholder)
+			return
+		}
+	}
+
+	if raw.Keep != nil {
+		if *raw.Keep < 0 {
+			err = fmt.Errorf("%w: cannot keep %d versions", InvalidLive, *raw.Keep)
+			return
+		}
+		live.Keep = *raw.Keep
+	}
+
+	l = &live
+	return
+}
+
+type RawHook struct {
+	Command   string    `toml:"command"`
+	Timeout   string    `toml:"timeout"`
+	OnFailure OnFailure `toml:"on_failure"`
+	Defer     bool      `toml:"defer"`
+}
+
+type Hook struct {
+	HookContext
+	Command   string
+	Timeout   time.Duration
+	OnFailure OnFailure
+	// deferred hooks run once after all domains are processed
+	Deferred bool
+}
+
+// RawHookContext restricts how the hooks of an install or a domain run.
+// Installs inherit the unset values from the hooks of their domain.
+type RawHookContext struct {
+	User  string `toml:"hook_user"`
+	Group string `toml:"hook_group"`
+	Dir   string `toml:"hook_dir"`
+	// names of the variables passed on from the environment of sacme
+	Env []string `toml:"hook_env"`
+}
+
+// inherit returns the context with the unset values taken from parent
+func (r RawHookContext) inherit(parent RawHookContext) RawHookContext {
+	if len(r.User) <= 0 {
+		r.User = parent.User
+	}
+	if len(r.Group) <= 0 {
+		r.Group = parent.Group
+	}
+	if len(r.Dir) <= 0 {
+		r.Dir = parent.Dir
+	}
+	if r.Env == nil {
+		r.Env = parent.Env
+	}
+	return r
+}
+
+type HookContext struct {
+	// the identity hooks run as, both nil to keep the one of sacme
+	User  *user.User
+	Group *user.Group
+	// the working directory, empty to keep the one of sacme
+	Dir string
+	// the allowed variables of the inherited environment, nil for all
+	Env []string
+}
+
+// ValidateHookContext parses a RawHookContext into a HookContext struct. When
+// only one of the user or group is given, the other defaults to the primary
+// group of the user or the running user respectively.
+func ValidateHookContext(raw RawHookContext) (c *HookContext, err error) {
+	ctx := HookContext{Dir: raw.Dir, Env: raw.Env}
+
+	if len(raw.User) > 0 || len(raw.Group) > 0 {
+		name := raw.User
+		if len(name) <= 0 {
+			var current *user.User
+			current, err = user.Current()
+			if err != nil {
+				err = fmt.Errorf("could not find the running user: %w", err)
+				return
+			}
+			name = current.Username
+		}
+		ctx.User, err = lookupUser(name)
+		if err != nil {
+			err = fmt.Errorf("%w: invalid hook_user %s: %v", InvalidHook, name, err)
+			return
+		}
+
+		name = raw.Group
+		if len(name) <= 0 {
+			name = ctx.User.Gid
+		}
+		ctx.Group, err = lookupGroup(name)
+		if err != nil {
+			err = fmt.Errorf("%w: invalid hook_group %s: %v", InvalidHook, name, err)
+			return
+		}
+	}
+
+	if len(ctx.Dir) > 0 && !filepath.IsAbs(ctx.Dir) {
+		err = fmt.Errorf("%w: hook_dir must be an absolute path, got %s", InvalidHook, ctx.Dir)
+		return
+	}
+
+	for _, name := range ctx.Env {
+		if len(name) <= 0 || strings.ContainsRune(name, '=') {
+			err = fmt.Errorf("%w: invalid variable name %q in hook_env", InvalidHook, name)
+			return
+		}
+	}
+
+	c = &ctx
+	return
+}
+
+// decodeRawHook accepts either a plain command or an inline table
+// describing the hook
+func decodeRawHook(raw interface{}) (h RawHook, err error) {
+	switch v := raw.(type) {
+	case string:
+		h.Command = v
+	case map[string]interface{}:
+		var data []byte
+		data, err = toml.Marshal(v)
+		if err != nil {
+			err = fmt.Errorf("%w: could not encode hook table: %v", InvalidHook, err)
+			return
+		}
+		decoder := toml.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&h); err != nil {
+			err = fmt.Errorf("%w: %v", InvalidHook, err)
+			return
+		}
+	default:
+		err = fmt.Errorf("%w: expected a command or a table, got %T", InvalidHook, raw)
+	}
+	return
+}
+
+// ValidateHook parses a RawHook into a Hook struct. The timeout and failure
+// policy default to the given values when unset.
+func ValidateHook(raw RawHook, timeout string, onFailure OnFailure) (h *Hook, err error) {
+	hook := Hook{
+		Command:   raw.Command,
+		OnFailure: onFailure,
+		Deferred:  raw.Defer,
+	}
+
+	if len(hook.Command) <= 0 {
+		err = fmt.Errorf("%w: missing command", InvalidHook)
+		return
+	}
+
+	if len(raw.Timeout) > 0 {
+		timeout = raw.Timeout
+	}
+	hook.Timeout, err = time.ParseDuration(timeout)
+	if err != nil {
+		err = fmt.Errorf("%w: invalid timeout %s: %v", InvalidHook, timeout, err)
+		return
+	}
+	if hook.Timeout <= 0 {
+		err = fmt.Errorf("%w: timeout must be positive, got %s", InvalidHook, timeout)
+		return
+	}
+
+	if len(raw.OnFailure) > 0 {
+		hook.OnFailure = raw.OnFailure
+	}
+	if !VALID_ON_FAILURES[hook.OnFailure] {
+		err = fmt.Errorf("%w: unknown on_failure policy %s", InvalidHook, hook.OnFailure)
+		return
+	}
+	if hook.Deferred && hook.OnFailure == ON_FAILURE_ROLLBACK {
+		err = fmt.Errorf("%w: deferred hooks run after all installs and cannot roll them back", InvalidHook)
+		return
+	}
+
+	h = &hook
+	return
+}
+
+// validateHooks parses a list of raw hooks, each either a command or a
+// RawHook table, applying the given defaults when set and the context
+func validateHooks(raws []interface{}, timeout string, onFailure OnFailure, ctx HookContext) (hooks []Hook, err error) {
+	if len(timeout) <= 0 {
+		timeout = DEFAULT_HOOK_TIMEOUT
+	}
+	if len(onFailure) <= 0 {
+		onFailure = DEFAULT_ON_FAILURE
+	}
+	for j, rawHook := range raws {
+		var rh RawHook
+		rh, err = decodeRawHook(rawHook)
+		if err != nil {
+			err = fmt.Errorf("invalid hook at position %d: %w", j, atKey(err, strconv.Itoa(j)))
+			return
+		}
+		var hook *Hook
+		hook, err = ValidateHook(rh, timeout, onFailure)
+		if err != nil {
+			err = fmt.Errorf("invalid hook at position %d: %w", j, atKey(err, strconv.Itoa(j)))
+			return
+		}
+		hook.HookContext = ctx
+		hooks = append(hooks, *hook)
+	}
+	return
+}
+
+// RawReload describes a built-in reload of the service using an install.
+// Exactly one of Pidfile, Unit or Process must be set.
+type RawReload struct {
+	Pidfile   string    `toml:"pidfile"`
+	Unit      string    `toml:"unit"`
+	Process   string    `toml:"process"`
+	Signal    string    `toml:"signal"`
+	Timeout   string    `toml:"timeout"`
+	OnFailure OnFailure `toml:"on_failure"`
+}
+
+type Reload struct {
+	Method ReloadMethod
+	// the pidfile, unit or process name
+	Target string
+	// not used for units, which reload as their unit file describes
+	Signal    syscall.Signal
+	Timeout   time.Duration
+	OnFailure OnFailure
+	// the reload signals or calls systemctl as the user of the context
+	HookContext
+}
+
+// ValidateReload parses a RawReload into a Reload struct. Whether its target
+// exists is only known when reloading, and is reported by Check. The timeout
+// and failure policy default to the given values when unset.
+func ValidateReload(raw RawReload, timeout string, onFailure OnFailure, ctx HookContext) (r *Reload, err error) {
+	var reload Reload
+	set := 0
+	for _, method := range []struct {
+		method ReloadMethod
+		target string
+	}{
+		{RELOAD_METHOD_PIDFILE, raw.Pidfile},
+		{RELOAD_METHOD_UNIT, raw.Unit},
+		{RELOAD_METHOD_PROCESS, raw.Process},
+	} {
+		if len(method.target) > 0 {
+			reload.Method, reload.Target = method.method, method.target
+			set++
+		}
+	}
+	if set != 1 {
+		err = fmt.Errorf("%w: exactly one of pidfile, unit or process is required", InvalidReload)
+		return
+	}
+	if reload.Method == RELOAD_METHOD_PIDFILE && !filepath.IsAbs(reload.Target) {
+		err = fmt.Errorf("%w: pidfile must be an absolute path, got %s", InvalidReload, reload.Target)
+		return
+	}
+
+	signal := DEFAULT_RELOAD_SIGNAL
+	if len(raw.Signal) > 0 {
+		if reload.Method == RELOAD_METHOD_UNIT {
+			err = fmt.Errorf("%w: units cannot be reloaded with a signal", InvalidReload)
+			return
+		}
+		signal = strings.TrimPrefix(strings.ToUpper(raw.Signal), "SIG")
+	}
+	var ok bool
+	if reload.Signal, ok = VALID_RELOAD_SIGNALS[signal]; !ok {
+		err = fmt.Errorf("%w: unknown signal %s", InvalidReload, raw.Signal)
+		return
+	}
+
+	if len(raw.Timeout) > 0 {
+		timeout = raw.Timeout
+	}
+	reload.Timeout, err = time.ParseDuration(timeout)
+	if err != nil || reload.Timeout <= 0 {
+		err = fmt.Errorf("%w: invalid timeout %s", InvalidReload, timeout)
+		return
+	}
+
+	reload.OnFailure = onFailure
+	if len(raw.OnFailure) > 0 {
+		reload.OnFailure = raw.OnFailure
+	}
+	if !VALID_ON_FAILURES[reload.OnFailure] {
+		err = fmt.Errorf("%w: unknown on_failure policy %s", InvalidReload, reload.OnFailure)
+		return
+	}
+
+	reload.HookContext = ctx
+	r = &reload
 	return
 }
 
 type RawInstall struct {
-	Key    *RawPathPerm `json:"key"`
-	Crt    *RawPathPerm `json:"crt"`
-	CA     *RawPathPerm `json:"ca"`
-	Concat *RawPathPerm `json:"concat"`
-	Hooks  []string     `json:"hooks"`
+	Key       *RawTarget   `json:"key"`
+	Crt       *RawTarget   `json:"crt"`
+	CA        *RawTarget   `json:"ca"`
+	Leaf      *RawTarget   `toml:"leaf"`
+	Chain     *RawTarget   `toml:"chain"`
+	Fullchain *RawTarget   `toml:"fullchain"`
+	Concat    *RawConcat   `json:"concat"`
+	PKCS12    *RawKeystore `toml:"pkcs12"`
+	JKS       *RawKeystore `toml:"jks"`
+	Live      *RawLive     `toml:"live"`
+	// each hook is either a command or a RawHook table
+	Hooks []interface{} `json:"hooks"`
+	// run after the hooks
+	Reload *RawReload `toml:"reload"`
+	// defaults for the hooks of the install
+	HookTimeout string    `toml:"hook_timeout"`
+	OnFailure   OnFailure `toml:"on_failure"`
+	RawHookContext
 }
 
 type Install struct {
-	Key    *file.PathPerm
-	Crt    *file.PathPerm
-	CA     *file.PathPerm
-	Concat *file.PathPerm
-	Hooks  []string
+	Key       *Target
+	Crt       *Target
+	CA        *Target
+	Leaf      *Target
+	Chain     *Target
+	Fullchain *Target
+	Concat    *Concat
+	PKCS12    *Keystore
+	JKS       *Keystore
+	Live      *Live
+	Hooks     []Hook
+	Reload    *Reload
 }
 
 // PraseInstall parses a RawInstall into an Install struct by validating all
-// RawPathPerm structs
-func ValidateInstall(raw RawInstall) (i *Install, err error) {
-	inst := Install{
-		Hooks: raw.Hooks,
+// RawPathPerm structs, filling unset fields from the defaults
+func ValidateInstall(raw RawInstall, defaults InstallDefaults) (i *Install, err error) {
+	var inst Install
+
+	var ctx *HookContext
+	ctx, err = ValidateHookContext(raw.RawHookContext)
+	if err != nil {
+		err = fmt.Errorf("invalid hook context: %w", err)
+		return
+	}
+	inst.Hooks, err = validateHooks(raw.Hooks, raw.HookTimeout, raw.OnFailure, *ctx)
+	if err != nil {
+		err = atKey(err, "hooks")
+		return
+	}
+
+	if raw.Reload != nil {
+		timeout := DEFAULT_HOOK_TIMEOUT
+		if len(raw.HookTimeout) > 0 {
+			timeout = raw.HookTimeout
+		}
+		onFailure := DEFAULT_ON_FAILURE
+		if len(raw.OnFailure) > 0 {
+			onFailure = raw.OnFailure
+		}
+		inst.Reload, err = ValidateReload(*raw.Reload, timeout, onFailure, *ctx)
+		if err != nil {
+			err = fmt.Errorf("invalid install definition for `reload`: %w", atKey(err, "reload"))
+			return
+		}
 	}
 
 	if raw.Key != nil {
-		inst.Key, err = ValidatePathPerm(*raw.Key)
+		inst.Key, err = ValidateTarget(*raw.Key, defaults, INSTALL_PART_KEY)
 		if err != nil {
-			err = fmt.Errorf("invalid install definition for `key`: %w", err)
+			err = fmt.Errorf("invalid install definition for `key`: %w", atKey(err, "key"))
 			return
 		}
 	}
 
 	if raw.Crt != nil {
-		inst.Crt, err = ValidatePathPerm(*raw.Crt)
+		inst.Crt, err = ValidateTarget(*raw.Crt, defaults, INSTALL_PART_CRT)
 		if err != nil {
-			err = fmt.Errorf("invalid install definition for `crt`: %w", err)
+			err = fmt.Errorf("invalid install definition for `crt`: %w", atKey(err, "crt"))
 			return
 		}
 	}
 
 	if raw.CA != nil {
-		inst.CA, err = ValidatePathPerm(*raw.CA)
+		inst.CA, err = ValidateTarget(*raw.CA, defaults, INSTALL_PART_CA)
+		if err != nil {
+			err = fmt.Errorf("invalid install definition for `ca`: %w", atKey(err, "ca"))
+			return
+		}
+	}
+
+	if raw.Leaf != nil {
+		inst.Leaf, err = ValidateTarget(*raw.Leaf, defaults, INSTALL_PART_LEAF)
 		if err != nil {
-			err = fmt.Errorf("invalid install definition for `ca`: %w", err)
+			err = fmt.Errorf("invalid install definition for `leaf`: %w", atKey(err, "leaf"))
+			return
+		}
+	}
+
+	if raw.Chain != nil {
+		inst.Chain, err = ValidateTarget(*raw.Chain, defaults, INSTALL_PART_CHAIN)
+		if err != nil {
+			err = fmt.Errorf("invalid install definition for `chain`: %w", atKey(err, "chain"))
+			return
+		}
+	}
+
+	if raw.Fullchain != nil {
+		inst.Fullchain, err = ValidateTarget(*raw.Fullchain, defaults, INSTALL_PART_FULLCHAIN)
+		if err != nil {
+			err = fmt.Errorf("invalid install definition for `fullchain`: %w", atKey(err, "fullchain"))
 			return
 		}
 	}
 
 	if raw.Concat != nil {
-		inst.Concat, err = ValidatePathPerm(*raw.Concat)
+		inst.Concat, err = ValidateConcat(*raw.Concat, defaults)
 		if err != nil {
-			err = fmt.Errorf("invalid install definition for `concat`: %w", err)
+			err = fmt.Errorf("invalid install definition for `concat`: %w", atKey(err, "concat"))
 			return
 		}
 	}
 
+	if raw.PKCS12 != nil {
+		inst.PKCS12, err = ValidateKeystore(*raw.PKCS12, defaults)
+		if err == nil && len(raw.PKCS12.Alias) > 0 {
+			err = atKey(fmt.Errorf("`alias` is only supported for jks keystores"), "alias")
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid install definition for `pkcs12`: %w", atKey(err, "pkcs12"))
+			return
+		}
+	}
+
+	if raw.JKS != nil {
+		inst.JKS, err = ValidateKeystore(*raw.JKS, defaults)
+		if err != nil {
+			err = fmt.Errorf("invalid install definition for `jks`: %w", atKey(err, "jks"))
+			return
+		}
+	}
+
+	if raw.Live != nil {
+		inst.Live, err = ValidateLive(*raw.Live, defaults)
+		if err != nil {
+			err = fmt.Errorf("invalid install definition for `live`: %w", atKey(err, "live"))
+			return
+		}
+
+		for _, path := range inst.Paths() {
+			if filepath.Dir(path) != inst.Live.Dir.Path {
+				err = fmt.Errorf("%w: versioned install path %s is not inside %s", InvalidLive, path, inst.Live.Dir.Path)
+				return
+			}
+		}
+	}
+
 	i = &inst
 	return
 }
 
+// RawDomainHooks are the hooks run around the issuance of the certificate of
+// a domain, each either a command or a RawHook table
+type RawDomainHooks struct {
+	PreIssue       []interface{} `toml:"pre_issue"`
+	PostIssue      []interface{} `toml:"post_issue"`
+	OnRenewFailure []interface{} `toml:"on_renew_failure"`
+	OnUninstall    []interface{} `toml:"on_uninstall"`
+	// defaults for all the hooks of the domain
+	HookTimeout string    `toml:"hook_timeout"`
+	OnFailure   OnFailure `toml:"on_failure"`
+	// also inherited by the hooks of the installs
+	RawHookContext
+}
+
+type DomainHooks struct {
+	// run before obtaining or renewing the certificate
+	PreIssue []Hook
+	// run after obtaining or renewing the certificate, even when it failed
+	PostIssue []Hook
+	// run when obtaining or renewing the certificate failed
+	OnRenewFailure []Hook
+	// run when files of removed installs have been uninstalled
+	OnUninstall []Hook
+}
+
+// ValidateDomainHooks parses a RawDomainHooks into a DomainHooks struct.
+// Domain hooks run outside of any install, so they can be neither deferred
+// nor roll files back.
+func ValidateDomainHooks(raw RawDomainHooks) (h *DomainHooks, err error) {
+	var hooks DomainHooks
+	ctx, err := ValidateHookContext(raw.RawHookContext)
+	if err != nil {
+		err = fmt.Errorf("invalid hook context: %w", err)
+		return
+	}
+	for _, list := range []struct {
+		name string
+		raw  []interface{}
+		dst  *[]Hook
+	}{
+		{"pre_issue", raw.PreIssue, &hooks.PreIssue},
+		{"post_issue", raw.PostIssue, &hooks.PostIssue},
+		{"on_renew_failure", raw.OnRenewFailure, &hooks.OnRenewFailure},
+		{"on_uninstall", raw.OnUninstall, &hooks.OnUninstall},
+	} {
+		*list.dst, err = validateHooks(list.raw, raw.HookTimeout, raw.OnFailure, *ctx)
+		if err != nil {
+			err = fmt.Errorf("invalid `%s` hooks: %w", list.name, atKey(err, list.name))
+			return
+		}
+		for j, hook := range *list.dst {
+			switch {
+			case hook.Deferred:
+				err = fmt.Errorf("%w: `%s` hook at position %d cannot be deferred", InvalidHook, list.name, j)
+			case hook.OnFailure == ON_FAILURE_ROLLBACK:
+				err = fmt.Errorf("%w: `%s` hook at position %d has no install to roll back", InvalidHook, list.name, j)
+			}
+			if err != nil {
+				err = atKey(err, list.name, strconv.Itoa(j))
+				return
+			}
+		}
+	}
+
+	h = &hooks
+	return
+}
+
 type RawDomain struct {
 	Domain         string         `toml:"domain"`
 	Account        RawAccount     `toml:"account"`
 	Authentication Authentication `toml:"authentication"`
+	Renewal        RawRenewal     `toml:"renewal"`
+	Hooks          RawDomainHooks `toml:"hooks"`
 	Installs       []RawInstall   `toml:"installs"`
 }
 
@@ -206,51 +1044,151 @@ type Domain struct {
 	Domain         string
 	Account        Account
 	Authentication Authentication
+	Renewal        Renewal
+	Hooks          DomainHooks
 	Installs       []Install
 }
 
+// inherit fills the values left unset in a domain definition from the
+// defaults of the global config. Authentication options are only inherited
+// along with the authentication method they are for, and the renewal policy
+// as a whole.
+func (r RawDomain) inherit(defaults RawDomain) RawDomain {
+	if len(r.Account.Email) <= 0 {
+		r.Account.Email = defaults.Account.Email
+	}
+	if len(r.Account.KeyType) <= 0 {
+		r.Account.KeyType = defaults.Account.KeyType
+	}
+	if r.Account.AcceptTOS == nil {
+		r.Account.AcceptTOS = defaults.Account.AcceptTOS
+	}
+	if r.Account.Directroy == nil {
+		r.Account.Directroy = defaults.Account.Directroy
+	}
+
+	method := func(m AuthenticationMethod) AuthenticationMethod {
+		if len(m) <= 0 {
+			return DEFAULT_AUTHENTICATION_METHOD
+		}
+		return m
+	}
+	if len(r.Authentication.Method) <= 0 {
+		r.Authentication.Method = defaults.Authentication.Method
+	}
+	if method(r.Authentication.Method) == method(defaults.Authentication.Method) && len(defaults.Authentication.Options) > 0 {
+		options := map[string]string{}
+		for key, val := range defaults.Authentication.Options {
+			options[key] = val
+		}
+		for key, val := range r.Authentication.Options {
+			options[key] = val
+		}
+		r.Authentication.Options = options
+	}
+
+	if r.Renewal == (RawRenewal{}) {
+		r.Renewal = defaults.Renewal
+	}
+
+	for _, list := range []struct {
+		dst *[]interface{}
+		def []interface{}
+	}{
+		{&r.Hooks.PreIssue, defaults.Hooks.PreIssue},
+		{&r.Hooks.PostIssue, defaults.Hooks.PostIssue},
+		{&r.Hooks.OnRenewFailure, defaults.Hooks.OnRenewFailure},
+		{&r.Hooks.OnUninstall, defaults.Hooks.OnUninstall},
+	} {
+		if *list.dst == nil {
+			*list.dst = list.def
+		}
+	}
+	if len(r.Hooks.HookTimeout) <= 0 {
+		r.Hooks.HookTimeout = defaults.Hooks.HookTimeout
+	}
+	if len(r.Hooks.OnFailure) <= 0 {
+		r.Hooks.OnFailure = defaults.Hooks.OnFailure
+	}
+	r.Hooks.RawHookContext = r.Hooks.RawHookContext.inherit(defaults.Hooks.RawHookContext)
+	return r
+}
+
 // PraseDomain parses a RawDomain into an Domain struct by parsing all
-// RawPathPerm structs
-func ValidateDomain(raw RawDomain) (d *Domain, err error) {
+// RawPathPerm structs, using the defaults from the global config
+func ValidateDomain(raw RawDomain, config Config) (d *Domain, err error) {
+	d, errs := validateDomain(raw, config)
+	if len(errs) > 0 {
+		err = errs[0]
+	}
+	return
+}
+
+// validateDomain validates all sections of a RawDomain, going on after an
+// invalid one to collect the errors of the others. The domain is nil when
+// any error is returned.
+func validateDomain(raw RawDomain, config Config) (d *Domain, errs []error) {
+	raw = raw.inherit(config.Defaults)
 	dom := Domain{
 		Domain: raw.Domain,
 	}
 	if len(dom.Domain) <= 0 {
-		err = fmt.Errorf("missing domain record: %w", err)
-		return
+		errs = append(errs, atKey(fmt.Errorf("%w: missing domain record", InvalidDomain), "domain"))
 	}
 
-	var acc *Account
-	acc, err = ValidateAccount(raw.Account)
+	acc, err := ValidateAccount(raw.Account)
 	if err != nil {
-		err = fmt.Errorf("could not validate account definition: %w", err)
-		return
+		errs = append(errs, fmt.Errorf("could not validate account definition: %w", atKey(err, "account")))
+	} else {
+		dom.Account = *acc
 	}
-	dom.Account = *acc
 
-	var auth *Authentication
-	auth, err = ValidateAuthentication(raw.Authentication)
+	auth, err := ValidateAuthentication(raw.Authentication)
 	if err != nil {
-		err = fmt.Errorf("could not validate authentication definition: %w", err)
-		return
+		errs = append(errs, fmt.Errorf("could not validate authentication definition: %w", atKey(err, "authentication")))
+	} else {
+		dom.Authentication = *auth
+	}
+
+	renewal, err := ValidateRenewal(raw.Renewal)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("could not validate renewal definition: %w", atKey(err, "renewal")))
+	} else {
+		dom.Renewal = *renewal
+	}
+
+	hooks, err := ValidateDomainHooks(raw.Hooks)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("could not validate hooks definition: %w", atKey(err, "hooks")))
+	} else {
+		dom.Hooks = *hooks
 	}
-	dom.Authentication = *auth
 
 	for i, rawInst := range raw.Installs {
-		var inst *Install
-		inst, err = ValidateInstall(rawInst)
+		rawInst.RawHookContext = rawInst.RawHookContext.inherit(raw.Hooks.RawHookContext)
+		inst, err := ValidateInstall(rawInst, config.Install)
 		if err != nil {
-			err = fmt.Errorf("could not validate install definition at position %d: %w", i, err)
-			return
+			errs = append(errs, fmt.Errorf("could not validate install definition at position %d: %w", i, atKey(err, "installs", strconv.Itoa(i))))
+			continue
 		}
 		dom.Installs = append(dom.Installs, *inst)
 	}
+	if len(errs) > 0 {
+		return
+	}
+
+	if config.Privileges != nil {
+		if err = config.Privileges.CheckDomain(dom); err != nil {
+			errs = append(errs, fmt.Errorf("domain cannot be served in rootless mode: %w", err))
+			return
+		}
+	}
 
 	d = &dom
 	return
 }
 
-func ParseDomain(data []byte) (d *Domain, err error) {
+func ParseDomain(data []byte, config Config) (d *Domain, err error) {
 	var domain RawDomain
 	err = toml.Unmarshal(data, &domain)
 	if err != nil {
@@ -258,7 +1196,7 @@ func ParseDomain(data []byte) (d *Domain, err error) {
 		return
 	}
 
-	d, err = ValidateDomain(domain)
+	d, err = ValidateDomain(domain, config)
 	if err != nil {
 		err = fmt.Errorf("could not verify domain definition: %w", err)
 		return
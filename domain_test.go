@@ -2,6 +2,7 @@ package sacme_test
 
 import (
 	"fmt"
+	"os"
 	"os/user"
 	"testing"
 
@@ -47,9 +48,15 @@ group = "%s"
 	return
 }
 
+func DefaultConfig(t *testing.T) *sacme.Config {
+	config, err := sacme.ValidateConfig(sacme.RawConfig{})
+	assert.Nil(t, err)
+	return config
+}
+
 func TestParseDomainCorrect(t *testing.T) {
 	rawDomain, u, g := ValidRawDomain(t)
-	d, err := sacme.ParseDomain([]byte(rawDomain))
+	d, err := sacme.ParseDomain([]byte(rawDomain), *DefaultConfig(t))
 	assert.Nil(t, err)
 	assert.NotNil(t, d)
 
@@ -65,13 +72,79 @@ func TestParseDomainCorrect(t *testing.T) {
 		Perm:  0600,
 		Owner: u,
 		Group: g,
-	}, inst0.Key)
+	}, &inst0.Key.PathPerm)
+	assert.Equal(t, sacme.FORMAT_PEM, inst0.Key.Format)
 	assert.EqualValues(t, &file.PathPerm{
 		Path:  "/test/path.crt",
 		Perm:  0644,
 		Owner: u,
 		Group: g,
-	}, inst0.Crt)
+	}, &inst0.Crt.PathPerm)
 	assert.Equal(t, sacme.DEFAULT_AUTHENTICATION_METHOD, d.Authentication.Method)
 	assert.Len(t, d.Authentication.Options, len(sacme.DEFAULT_AUTHENTICATION_OPTIONS[d.Authentication.Method]))
 }
+
+func TestParseDomainDefaults(t *testing.T) {
+	u, err := user.Current()
+	assert.Nil(t, err)
+	config := DefaultConfig(t)
+
+	d, err := sacme.ParseDomain([]byte(fmt.Sprintf(`
+domain = "example.com"
+
+[account]
+email = "root@example.com"
+
+[[installs]]
+[installs.key]
+path = "/test/path.key"
+
+[installs.fullchain]
+path = "/test/fullchain.pem"
+owner = "%s"
+
+[installs.concat]
+path = "/test/haproxy.pem"
+group = "4242"
+`, u.Uid)), *config)
+	assert.Nil(t, err)
+	inst0 := d.Installs[0]
+
+	assert.Equal(t, os.FileMode(0600), inst0.Key.Perm)
+	assert.Equal(t, u.Uid, inst0.Key.Owner.Uid)
+	assert.Equal(t, u.Gid, inst0.Key.Group.Gid)
+	assert.Equal(t, os.FileMode(0644), inst0.Fullchain.Perm)
+	assert.Equal(t, u.Uid, inst0.Fullchain.Owner.Uid)
+	// concat targets include the key by default
+	assert.Equal(t, os.FileMode(0600), inst0.Concat.Perm)
+	assert.Equal(t, "4242", inst0.Concat.Group.Gid)
+}
+
+func TestParseDomainOptionsCopied(t *testing.T) {
+	rawDomain, _, _ := ValidRawDomain(t)
+	d, err := sacme.ParseDomain([]byte(rawDomain+"\n[authentication]\noptions = { port = \"8080\" }\n"), *DefaultConfig(t))
+	assert.Nil(t, err)
+	assert.Equal(t, "8080", d.Authentication.Options[sacme.AUTHENTICATION_OPTION_PORT])
+	assert.Equal(t, "80", sacme.DEFAULT_AUTHENTICATION_OPTIONS[sacme.AUTHENTICATION_METHOD_HTTP01_STANDALONE][sacme.AUTHENTICATION_OPTION_PORT])
+}
+
+func TestParseDomainKeystoreAlias(t *testing.T) {
+	raw := `
+domain = "example.com"
+
+[account]
+email = "root@example.com"
+
+[[installs]]
+[installs.%s]
+path = "/test/example.keystore"
+password = "changeit"
+alias = "tomcat"
+`
+	d, err := sacme.ParseDomain([]byte(fmt.Sprintf(raw, "jks")), *DefaultConfig(t))
+	assert.Nil(t, err)
+	assert.Equal(t, "tomcat", d.Installs[0].JKS.Alias)
+
+	_, err = sacme.ParseDomain([]byte(fmt.Sprintf(raw, "pkcs12")), *DefaultConfig(t))
+	assert.ErrorContains(t, err, "only supported for jks")
+}
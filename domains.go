@@ -6,8 +6,14 @@ import (
 	"strings"
 )
 
+// IsDomainFile reports whether a file in the domains directory *should*
+// contain a domain definition
+func IsDomainFile(name string) bool {
+	return name != CONFIG_FILE_NAME && strings.HasSuffix(name, DOMAIN_FILE_SUFFIX)
+}
+
 // ListDomainFiles returns a list of paths of files which *should* contain a
-// domain definition
+// domain definition, skipping the global config file
 func ListDomainFiles(f fs.FS) (paths []string, err error) {
 	entries, err := fs.ReadDir(f, ".")
 	if err != nil {
@@ -16,7 +22,7 @@ func ListDomainFiles(f fs.FS) (paths []string, err error) {
 	}
 
 	for _, entry := range entries {
-		if strings.HasSuffix(entry.Name(), DOMAIN_FILE_SUFFIX) {
+		if IsDomainFile(entry.Name()) {
 			paths = append(paths, entry.Name())
 		}
 	}
@@ -24,26 +30,20 @@ func ListDomainFiles(f fs.FS) (paths []string, err error) {
 }
 
 // LoadDomains loads all domain definitions from all eligible domain files
-// found in the provided filesystem.
+// found in the provided filesystem, using the defaults from config. files
+// lists the file each domain is defined in.
 // As soon as an error is encountered the function aborts.
-func LoadDomains(f fs.FS) (domains []Domain, err error) {
-	files, err := ListDomainFiles(f)
+func LoadDomains(f fs.FS, config Config) (files []string, domains []Domain, err error) {
+	files, err = ListDomainFiles(f)
 	if err != nil {
 		return
 	}
 
 	for _, file := range files {
-		var content []byte
-		content, err = fs.ReadFile(f, file)
-		if err != nil {
-			err = fmt.Errorf("could not read domain file: %w", err)
-			return
-		}
-
 		var domain *Domain
-		domain, err = ParseDomain(content)
+		domain, err = LoadDomainFile(f, file, config)
 		if err != nil {
-			err = fmt.Errorf("could not parse domain: %w", err)
+			err = fmt.Errorf("%s: %w", file, err)
 			return
 		}
 		domains = append(domains, *domain)
@@ -51,3 +51,19 @@ func LoadDomains(f fs.FS) (domains []Domain, err error) {
 
 	return
 }
+
+// LoadDomainFile loads the domain definition from a single domain file
+func LoadDomainFile(f fs.FS, file string, config Config) (d *Domain, err error) {
+	content, err := fs.ReadFile(f, file)
+	if err != nil {
+		err = fmt.Errorf("could not read domain file: %w", err)
+		return
+	}
+
+	d, err = ParseDomain(content, config)
+	if err != nil {
+		err = fmt.Errorf("could not parse domain: %w", err)
+		return
+	}
+	return
+}
@@ -1,6 +1,7 @@
 package sacme_test
 
 import (
+	iofs "io/fs"
 	"testing"
 	"testing/fstest"
 
@@ -14,11 +15,44 @@ func TestLoadDomains(t *testing.T) {
 		"example.com.toml": &fstest.MapFile{
 			Data: []byte(rawDomain),
 		},
+		sacme.CONFIG_FILE_NAME: &fstest.MapFile{
+			Data: []byte("[install]\nkey_perm = \"0640\"\n"),
+		},
 	}
 
-	domains, err := sacme.LoadDomains(fs)
+	files, domains, err := sacme.LoadDomains(fs, *DefaultConfig(t))
 	assert.Nil(t, err)
+	assert.Equal(t, []string{"example.com.toml"}, files)
 	assert.Len(t, domains, 1)
 	d := domains[0]
 	assert.Equal(t, "example.com", d.Domain)
+
+	fs["invalid.toml"] = &fstest.MapFile{Data: []byte("domain = [")}
+	_, _, err = sacme.LoadDomains(fs, *DefaultConfig(t))
+	assert.ErrorContains(t, err, "invalid.toml: ")
+}
+
+func TestLoadDomainFile(t *testing.T) {
+	rawDomain, _, _ := ValidRawDomain(t)
+	fs := fstest.MapFS{
+		"example.com.toml": &fstest.MapFile{
+			Data: []byte(rawDomain),
+		},
+		"invalid.toml": &fstest.MapFile{
+			Data: []byte("domain = ["),
+		},
+	}
+
+	assert.True(t, sacme.IsDomainFile("example.com.toml"))
+	assert.False(t, sacme.IsDomainFile(sacme.CONFIG_FILE_NAME))
+	assert.False(t, sacme.IsDomainFile("example.com.toml.swp"))
+
+	d, err := sacme.LoadDomainFile(fs, "example.com.toml", *DefaultConfig(t))
+	assert.Nil(t, err)
+	assert.Equal(t, "example.com", d.Domain)
+
+	_, err = sacme.LoadDomainFile(fs, "invalid.toml", *DefaultConfig(t))
+	assert.NotNil(t, err)
+	_, err = sacme.LoadDomainFile(fs, "missing.toml", *DefaultConfig(t))
+	assert.ErrorIs(t, err, iofs.ErrNotExist)
 }
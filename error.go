@@ -14,6 +14,14 @@ var InvalidPath = errors.New("invalid_path")
 var InvalidPerm = errors.New("invalid_perm")
 var InvalidOwner = errors.New("invalid_owner")
 var InvalidGroup = errors.New("invalid_group")
+var MissingPassword = errors.New("missing_password")
+var InvalidPart = errors.New("invalid_part")
+var InvalidFormat = errors.New("invalid_format")
+var InvalidPlaceholder = errors.New("invalid_placeholder")
+var InvalidLive = errors.New("invalid_live")
+var InvalidHook = errors.New("invalid_hook")
+var InvalidReload = errors.New("invalid_reload")
+var InvalidRenewal = errors.New("invalid_renewal")
 
 var InvalidAccount = errors.New("invaild_account")
 var InvalidAuthentication = errors.New("invaild_authentication")
@@ -37,6 +45,7 @@ var ProviderHTTP01Standalone = errors.New("provider_http01_standalone")
 var ProviderSetup = errors.New("provider_setup")
 var CertificateObtain = errors.New("certificate_obtain")
 var CertificateRenew = errors.New("certificate_renew")
+var ACMEHelper = errors.New("acme_helper")
 
 // State erorrs
 var GenerateKey = errors.New("generate_key")
@@ -52,4 +61,13 @@ var ParseCertificates = errors.New("parse_certificates")
 var InstallFile = errors.New("install_file")
 var RemoveFile = errors.New("remove_file")
 var WriteToFile = errors.New("write_to_file")
+var TranscodeContent = errors.New("transcode_content")
 var UnfinishedWrite = errors.New("unfinished_write")
+
+// Hook errors
+var HookFailed = errors.New("hook_failed")
+var HookTimeout = errors.New("hook_timeout")
+var ReloadFailed = errors.New("reload_failed")
+
+// Rootless operation
+var RequiresPrivileges = errors.New("requires_privileges")
@@ -0,0 +1,100 @@
+package sacme
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+// Transcode converts the PEM blocks in content to the requested format.
+// Certificates are left untouched unless DER is requested, while private keys
+// are re-encoded according to the format.
+func Transcode(content []byte, format Format) (out []byte, err error) {
+	if format == FORMAT_PEM {
+		out = content
+		return
+	}
+	if !VALID_FORMATS[format] {
+		err = fmt.Errorf("%w: %s", InvalidFormat, format)
+		return
+	}
+
+	var blocks []*pem.Block
+	for rest := content; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+	if len(blocks) <= 0 {
+		err = fmt.Errorf("%w: no PEM blocks to convert to %s", TranscodeContent, format)
+		return
+	}
+	if format == FORMAT_DER && len(blocks) > 1 {
+		err = fmt.Errorf("%w: cannot encode %d PEM blocks as a single DER", TranscodeContent, len(blocks))
+		return
+	}
+
+	for _, block := range blocks {
+		switch block.Type {
+		case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY":
+			block, err = transcodeKey(block, format)
+			if err != nil {
+				return
+			}
+		}
+
+		if format == FORMAT_DER {
+			out = append(out, block.Bytes...)
+		} else {
+			out = append(out, pem.EncodeToMemory(block)...)
+		}
+	}
+
+	return
+}
+
+func transcodeKey(block *pem.Block, format Format) (out *pem.Block, err error) {
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: could not parse %s: %v", TranscodeContent, block.Type, err)
+		return
+	}
+
+	switch format {
+	case FORMAT_DER, FORMAT_PKCS8_PEM:
+		out = &pem.Block{Type: "PRIVATE KEY"}
+		out.Bytes, err = x509.MarshalPKCS8PrivateKey(key)
+	case FORMAT_PKCS1_PEM:
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			out = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+		case *ecdsa.PrivateKey:
+			out = &pem.Block{Type: "EC PRIVATE KEY"}
+			out.Bytes, err = x509.MarshalECPrivateKey(k)
+		default:
+			err = fmt.Errorf("keys of type %T have no traditional encoding", key)
+		}
+	default:
+		err = fmt.Errorf("%w: %s", InvalidFormat, format)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: could not encode key as %s: %v", TranscodeContent, format, err)
+		return
+	}
+
+	return
+}
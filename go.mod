@@ -1,14 +1,18 @@
 module github.com/lucat1/sacme
 
-go 1.19
+go 1.22.0
 
 require (
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/go-acme/lego/v4 v4.9.1
 	github.com/hashicorp/go-retryablehttp v0.7.7
+	github.com/pavlo-v-chernykh/keystore-go/v4 v4.5.0
 	github.com/pelletier/go-toml/v2 v2.2.0
 	github.com/spf13/afero v1.12.0
 	github.com/stretchr/testify v1.10.0
+	golang.org/x/crypto v0.33.0
 	golang.org/x/exp v0.0.0-20221028150844-83b7d23a625f
+	software.sslmate.com/src/go-pkcs12 v0.5.0
 )
 
 require (
@@ -17,7 +21,6 @@ require (
 	github.com/hashicorp/go-cleanhttp v0.5.2 // indirect
 	github.com/miekg/dns v1.1.62 // indirect
 	github.com/pmezard/go-difflib v1.0.1-0.20181226105442-5d4384ee4fb2 // indirect
-	golang.org/x/crypto v0.33.0 // indirect
 	golang.org/x/mod v0.23.0 // indirect
 	golang.org/x/net v0.35.0 // indirect
 	golang.org/x/sync v0.11.0 // indirect
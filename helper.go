@@ -0,0 +1,192 @@
+package sacme
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"syscall"
+
+	fs "github.com/spf13/afero"
+)
+
+type ACMEOperation string
+
+const (
+	ACME_OPERATION_REGISTER   = ACMEOperation("register")
+	ACME_OPERATION_OBTAIN     = ACMEOperation("obtain")
+	ACME_OPERATION_RENEW      = ACMEOperation("renew")
+	ACME_OPERATION_REVOKE     = ACMEOperation("revoke")
+	ACME_OPERATION_DEACTIVATE = ACMEOperation("deactivate")
+)
+
+// ACMERequest is sent to the helper process on its standard input
+type ACMERequest struct {
+	Operation ACMEOperation
+	// the domain definition, without installs
+	Domain Domain
+	State  State
+	// the addresses served by each of the listeners passed as extra files,
+	// in order
+	Listeners [][]string
+}
+
+// ACMEResponse is written by the helper process on its standard output
+type ACMEResponse struct {
+	State *State
+	Error string
+}
+
+// HelperACME performs the ACME work in a child process running as an
+// unprivileged user, handing it the pre-opened challenge listeners. The
+// calling process keeps its privileges for installs and hooks.
+type HelperACME struct {
+	Credential *syscall.Credential
+	Listeners  Listeners
+}
+
+func NewHelperACME(u *user.User, g *user.Group, listeners Listeners) (h *HelperACME, err error) {
+	cred, err := credential(u, g)
+	if err != nil {
+		return
+	}
+
+	h = &HelperACME{
+		Credential: cred,
+		Listeners:  listeners,
+	}
+	return
+}
+
+func (h HelperACME) Register(domain Domain, state *State) error {
+	return h.run(ACME_OPERATION_REGISTER, domain, state)
+}
+
+func (h HelperACME) Obtain(domain Domain, state *State) error {
+	return h.run(ACME_OPERATION_OBTAIN, domain, state)
+}
+
+func (h HelperACME) Renew(domain Domain, state *State) error {
+	return h.run(ACME_OPERATION_RENEW, domain, state)
+}
+
+func (h HelperACME) Revoke(domain Domain, state *State) error {
+	return h.run(ACME_OPERATION_REVOKE, domain, state)
+}
+
+func (h HelperACME) Deactivate(domain Domain, state *State) error {
+	return h.run(ACME_OPERATION_DEACTIVATE, domain, state)
+}
+
+func (h HelperACME) run(op ACMEOperation, domain Domain, state *State) (err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		err = fmt.Errorf("%w: could not find own executable: %v", ACMEHelper, err)
+		return
+	}
+
+	addrs, files, err := h.Listeners.Files()
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ACMEHelper, err)
+		return
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	domain.Installs = nil
+	req, err := json.Marshal(ACMERequest{
+		Operation: op,
+		Domain:    domain,
+		State:     *state,
+		Listeners: addrs,
+	})
+	if err != nil {
+		err = fmt.Errorf("%w: could not encode request: %v", ACMEHelper, err)
+		return
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(exe)
+	cmd.Env = append(os.Environ(), HELPER_ENV+"=1")
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: h.Credential}
+	if err = cmd.Run(); err != nil {
+		err = fmt.Errorf("%w: helper process for %s failed: %v", ACMEHelper, op, err)
+		return
+	}
+
+	var res ACMEResponse
+	if err = json.Unmarshal(stdout.Bytes(), &res); err != nil {
+		err = fmt.Errorf("%w: could not decode response: %v", ACMEHelper, err)
+		return
+	}
+	if len(res.Error) > 0 {
+		err = fmt.Errorf("%w: %s", ACMEHelper, res.Error)
+		return
+	}
+	if res.State == nil {
+		err = fmt.Errorf("%w: response lacks state", ACMEHelper)
+		return
+	}
+
+	*state = *res.State
+	return
+}
+
+// ServeHelper handles a single request in the helper process, reading it from
+// r and writing the response to w. The listeners are expected as the file
+// descriptors following the standard ones.
+func ServeHelper(r io.Reader, w io.Writer, f fs.Fs) (err error) {
+	var req ACMERequest
+	if err = json.NewDecoder(r).Decode(&req); err != nil {
+		err = fmt.Errorf("could not decode request: %w", err)
+		return
+	}
+
+	files := []*os.File{}
+	for i, addrs := range req.Listeners {
+		files = append(files, os.NewFile(uintptr(3+i), strings.Join(addrs, ",")))
+	}
+	listeners, err := ListenersFromFiles(req.Listeners, files)
+	if err != nil {
+		return
+	}
+	defer listeners.Close()
+
+	local := LocalACME{Fs: f, Listeners: listeners}
+	state := req.State
+	switch req.Operation {
+	case ACME_OPERATION_REGISTER:
+		err = local.Register(req.Domain, &state)
+	case ACME_OPERATION_OBTAIN:
+		err = local.Obtain(req.Domain, &state)
+	case ACME_OPERATION_RENEW:
+		err = local.Renew(req.Domain, &state)
+	case ACME_OPERATION_REVOKE:
+		err = local.Revoke(req.Domain, &state)
+	case ACME_OPERATION_DEACTIVATE:
+		err = local.Deactivate(req.Domain, &state)
+	default:
+		err = fmt.Errorf("unknown operation %s", req.Operation)
+	}
+
+	res := ACMEResponse{State: &state}
+	if err != nil {
+		res = ACMEResponse{Error: err.Error()}
+	}
+	if err = json.NewEncoder(w).Encode(res); err != nil {
+		err = fmt.Errorf("could not encode response: %w", err)
+		return
+	}
+	return
+}
@@ -0,0 +1,77 @@
+package sacme_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lucat1/sacme"
+	fs "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCA serves just enough of an ACME directory to register accounts
+func fakeCA(t *testing.T) *httptest.Server {
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dir", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   srv.URL + "/nonce",
+			"newAccount": srv.URL + "/account",
+			"newOrder":   srv.URL + "/order",
+			"revokeCert": srv.URL + "/revoke",
+			"keyChange":  srv.URL + "/key-change",
+		})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+	})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		w.Header().Set("Location", srv.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status": "valid"}`))
+	})
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func serve(t *testing.T, req sacme.ACMERequest) (res sacme.ACMEResponse) {
+	data, err := json.Marshal(req)
+	assert.Nil(t, err)
+	var out bytes.Buffer
+	assert.Nil(t, sacme.ServeHelper(bytes.NewReader(data), &out, fs.NewMemMapFs()))
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &res))
+	return
+}
+
+func TestServeHelper(t *testing.T) {
+	srv := fakeCA(t)
+	rawDomain, _, _ := ValidRawDomain(t)
+	rawDomain = strings.Replace(rawDomain, "[account]\n", "[account]\ndirectory = \""+srv.URL+"/dir\"\n", 1)
+	domain, err := sacme.ParseDomain([]byte(rawDomain), *DefaultConfig(t))
+	assert.Nil(t, err)
+	state, err := sacme.NewState(*domain)
+	assert.Nil(t, err)
+
+	res := serve(t, sacme.ACMERequest{Operation: sacme.ACME_OPERATION_REGISTER, Domain: *domain, State: *state})
+	assert.Empty(t, res.Error)
+	assert.NotNil(t, res.State)
+	assert.True(t, res.State.IsRegistered())
+	assert.Equal(t, srv.URL+"/account/1", res.State.Account.Registration.URI)
+	assert.Equal(t, state.Account.Key, res.State.Account.Key)
+
+	// failures are reported in the response, without a state
+	res = serve(t, sacme.ACMERequest{Operation: sacme.ACME_OPERATION_REGISTER, Domain: *domain, State: *res.State})
+	assert.Contains(t, res.Error, "already exists")
+	assert.Nil(t, res.State)
+	res = serve(t, sacme.ACMERequest{Operation: sacme.ACMEOperation("bogus"), Domain: *domain, State: *state})
+	assert.Contains(t, res.Error, "unknown operation bogus")
+
+	err = sacme.ServeHelper(strings.NewReader("{"), &bytes.Buffer{}, fs.NewMemMapFs())
+	assert.ErrorContains(t, err, "could not decode request")
+}
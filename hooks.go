@@ -0,0 +1,242 @@
+package sacme
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// HookEnv returns the environment variables describing the certificate
+// installed by the resolved install i
+func (i Install) HookEnv(state *State) (env []string, err error) {
+	certificates, err := state.ACME.Certificates()
+	if err != nil {
+		err = fmt.Errorf("could not load certificate for hook environment: %w", err)
+		return
+	}
+	leaf := certificates[0]
+
+	env = []string{
+		HOOK_ENV_DOMAIN + "=" + state.ACME.Domain,
+		HOOK_ENV_SERIAL + "=" + fmt.Sprintf("%x", leaf.SerialNumber),
+		HOOK_ENV_NOT_BEFORE + "=" + leaf.NotBefore.UTC().Format(time.RFC3339),
+		HOOK_ENV_NOT_AFTER + "=" + leaf.NotAfter.UTC().Format(time.RFC3339),
+	}
+
+	pathEnv := func(name, path string) {
+		env = append(env, HOOK_ENV_PREFIX+strings.ToUpper(name)+HOOK_ENV_PATH+"="+path)
+	}
+	for _, pt := range i.partTargets() {
+		if pt.target != nil {
+			pathEnv(string(pt.part), pt.target.Path)
+		}
+	}
+	if i.Concat != nil {
+		pathEnv("concat", i.Concat.Path)
+	}
+	if i.PKCS12 != nil {
+		pathEnv("pkcs12", i.PKCS12.Path)
+	}
+	if i.JKS != nil {
+		pathEnv("jks", i.JKS.Path)
+	}
+	if i.Live != nil {
+		env = append(env, HOOK_ENV_LIVE_DIR+"="+i.Live.Dir.Path, HOOK_ENV_LIVE_LINK+"="+i.Live.Link)
+	}
+
+	return
+}
+
+type HookResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Duration time.Duration
+}
+
+// credential returns the credential to run a process as u and g, dropping
+// all supplementary groups
+func credential(u *user.User, g *user.Group) (c *syscall.Credential, err error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		err = fmt.Errorf("could not parse uid %s (user %s) as int: %w", u.Uid, u.Username, err)
+		return
+	}
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		err = fmt.Errorf("could not parse gid %s (group %s) as int: %w", g.Gid, g.Name, err)
+		return
+	}
+
+	c = &syscall.Credential{
+		Uid:    uint32(uid),
+		Gid:    uint32(gid),
+		Groups: []uint32{},
+	}
+	return
+}
+
+// sysProcAttr returns the attributes to start a process as the user and group
+// of the context, when set
+func (c HookContext) sysProcAttr() (attr *syscall.SysProcAttr, err error) {
+	attr = &syscall.SysProcAttr{}
+	if c.User == nil {
+		return
+	}
+	attr.Credential, err = credential(c.User, c.Group)
+	if err != nil {
+		return
+	}
+	// only root may change the supplementary groups
+	attr.Credential.NoSetGroups = os.Geteuid() != 0
+	return
+}
+
+// environ returns the environment of sacme restricted to the allowed
+// variables, or all of it when there is no allowlist
+func (c HookContext) environ() (env []string) {
+	if c.Env == nil {
+		return os.Environ()
+	}
+	for _, name := range c.Env {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return
+}
+
+// Run executes the hook with the given additional environment variables,
+// capturing its whole output. When the timeout expires, the hook is killed
+// along with all the processes it started.
+func (h Hook) Run(env []string) (res HookResult, err error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(DEFAULT_SHELL, "-c", h.Command)
+	cmd.Env = append(h.environ(), env...)
+	cmd.Dir = h.Dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.SysProcAttr, err = h.sysProcAttr()
+	if err != nil {
+		err = fmt.Errorf("%w: %v", HookFailed, err)
+		return
+	}
+	cmd.SysProcAttr.Setpgid = true
+	if h.User != nil {
+		cmd.Env = append(cmd.Env, "USER="+h.User.Username, "LOGNAME="+h.User.Username)
+		if len(h.User.HomeDir) > 0 {
+			cmd.Env = append(cmd.Env, "HOME="+h.User.HomeDir)
+		}
+	}
+
+	start := time.Now()
+	if err = cmd.Start(); err != nil {
+		err = fmt.Errorf("%w: could not start hook: %v", HookFailed, err)
+		return
+	}
+
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(h.Timeout, func() {
+		timedOut.Store(true)
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err = cmd.Wait()
+	timer.Stop()
+
+	res = HookResult{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		ExitCode: cmd.ProcessState.ExitCode(),
+		Duration: time.Since(start),
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case timedOut.Load():
+		err = fmt.Errorf("%w: killed after %s", HookTimeout, h.Timeout)
+	case errors.As(err, &exitErr):
+		err = fmt.Errorf("%w: exited with status %d", HookFailed, res.ExitCode)
+	case err != nil:
+		err = fmt.Errorf("%w: %v", HookFailed, err)
+	}
+	return
+}
+
+// DeferredHook is a deferred hook queued by the installs of one or more
+// domains
+type DeferredHook struct {
+	Hook
+	Domains []string
+}
+
+// Env returns the environment variables for a deferred hook, which lists
+// the domains it was queued by
+func (h DeferredHook) Env() []string {
+	return []string{HOOK_ENV_DOMAINS + "=" + strings.Join(h.Domains, " ")}
+}
+
+// DeferredHooks collects the deferred hooks of changed installs across
+// domains, so that each distinct command runs only once at the end
+type DeferredHooks struct {
+	keys  []string
+	hooks map[string]*DeferredHook
+}
+
+// deferredKey identifies the hooks which can be merged: the same command run
+// in the same context
+func deferredKey(hook Hook) string {
+	key := []string{hook.Command, hook.Dir, strings.Join(hook.Env, ",")}
+	if hook.User != nil {
+		key = append(key, hook.User.Uid, hook.Group.Gid)
+	}
+	if hook.Env == nil {
+		key = append(key, "*")
+	}
+	return strings.Join(key, "\x00")
+}
+
+func NewDeferredHooks() *DeferredHooks {
+	return &DeferredHooks{hooks: map[string]*DeferredHook{}}
+}
+
+// Add queues hook on behalf of domain. Hooks with the same command and
+// context are merged, keeping the longest timeout and the strictest failure
+// policy.
+func (d *DeferredHooks) Add(hook Hook, domain string) {
+	key := deferredKey(hook)
+	queued, ok := d.hooks[key]
+	if !ok {
+		d.keys = append(d.keys, key)
+		d.hooks[key] = &DeferredHook{Hook: hook, Domains: []string{domain}}
+		return
+	}
+
+	if hook.Timeout > queued.Timeout {
+		queued.Timeout = hook.Timeout
+	}
+	if hook.OnFailure != ON_FAILURE_IGNORE {
+		queued.OnFailure = hook.OnFailure
+	}
+	for _, d := range queued.Domains {
+		if d == domain {
+			return
+		}
+	}
+	queued.Domains = append(queued.Domains, domain)
+}
+
+// Hooks returns the queued hooks in the order they were first added
+func (d *DeferredHooks) Hooks() (hooks []DeferredHook) {
+	for _, key := range d.keys {
+		hooks = append(hooks, *d.hooks[key])
+	}
+	return
+}
@@ -0,0 +1,204 @@
+package sacme_test
+
+import (
+	"fmt"
+	"os/user"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucat1/sacme"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHookEnv(t *testing.T) {
+	state := IssuedState(t)
+	inst := sacme.Install{
+		Key:       currentTarget(t, "/ssl/privkey.pem", sacme.FORMAT_PEM),
+		Fullchain: currentTarget(t, "/ssl/fullchain.pem", sacme.FORMAT_PEM),
+	}
+
+	env, err := inst.HookEnv(state)
+	assert.Nil(t, err)
+	assert.Contains(t, env, "SACME_DOMAIN=example.com")
+	assert.Contains(t, env, "SACME_KEY_PATH=/ssl/privkey.pem")
+	assert.Contains(t, env, "SACME_FULLCHAIN_PATH=/ssl/fullchain.pem")
+	placeholders, err := state.ACME.Placeholders()
+	assert.Nil(t, err)
+	assert.Contains(t, env, "SACME_SERIAL="+placeholders[sacme.PLACEHOLDER_SERIAL])
+}
+
+func TestHookRun(t *testing.T) {
+	hook := sacme.Hook{
+		Command:   `echo "$SACME_DOMAIN"; echo oops >&2`,
+		Timeout:   time.Minute,
+		OnFailure: sacme.ON_FAILURE_FAIL,
+	}
+	res, err := hook.Run([]string{"SACME_DOMAIN=example.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, "example.com\n", res.Stdout)
+	assert.Equal(t, "oops\n", res.Stderr)
+	assert.Equal(t, 0, res.ExitCode)
+
+	hook.Command = "echo partial; exit 3"
+	res, err = hook.Run(nil)
+	assert.ErrorIs(t, err, sacme.HookFailed)
+	assert.Equal(t, 3, res.ExitCode)
+	assert.Equal(t, "partial\n", res.Stdout)
+
+	// processes started by the hook are killed as well
+	hook.Command = "sleep 10 & sleep 10"
+	hook.Timeout = 100 * time.Millisecond
+	res, err = hook.Run(nil)
+	assert.ErrorIs(t, err, sacme.HookTimeout)
+	assert.Less(t, res.Duration, 5*time.Second)
+}
+
+func TestHookRunContext(t *testing.T) {
+	t.Setenv("SACME_TEST_SECRET", "secret")
+	t.Setenv("SACME_TEST_ALLOWED", "allowed")
+	u, err := user.Current()
+	assert.Nil(t, err)
+	g, err := user.LookupGroupId(u.Gid)
+	assert.Nil(t, err)
+	dir := t.TempDir()
+
+	hook := sacme.Hook{
+		HookContext: sacme.HookContext{User: u, Group: g, Dir: dir, Env: []string{"SACME_TEST_ALLOWED"}},
+		Command:     `echo "$SACME_TEST_SECRET:$SACME_TEST_ALLOWED:$SACME_DOMAIN:$(pwd):$(id -u)"`,
+		Timeout:     time.Minute,
+	}
+	res, err := hook.Run([]string{"SACME_DOMAIN=example.com"})
+	assert.Nil(t, err, res.Stderr)
+	assert.Equal(t, ":allowed:example.com:"+dir+":"+u.Uid+"\n", res.Stdout)
+
+	hook.HookContext = sacme.HookContext{}
+	res, err = hook.Run(nil)
+	assert.Nil(t, err, res.Stderr)
+	assert.True(t, strings.HasPrefix(res.Stdout, "secret:allowed::"))
+}
+
+func TestParseDomainHooks(t *testing.T) {
+	rawDomain, _, _ := ValidRawDomain(t)
+	rawDomain = strings.Replace(rawDomain, `hooks = [
+  "true"
+]`, `hook_timeout = "30s"
+hooks = [
+  "true",
+  { command = "systemctl reload nginx", on_failure = "rollback", timeout = "5s" },
+  { command = "systemctl reload postfix", defer = true },
+]`, 1)
+
+	d, err := sacme.ParseDomain([]byte(rawDomain), *DefaultConfig(t))
+	assert.Nil(t, err)
+	assert.Equal(t, []sacme.Hook{
+		{Command: "true", Timeout: 30 * time.Second, OnFailure: sacme.DEFAULT_ON_FAILURE},
+		{Command: "systemctl reload nginx", Timeout: 5 * time.Second, OnFailure: sacme.ON_FAILURE_ROLLBACK},
+		{Command: "systemctl reload postfix", Timeout: 30 * time.Second, OnFailure: sacme.DEFAULT_ON_FAILURE, Deferred: true},
+	}, d.Installs[0].Hooks)
+
+	for _, hook := range []string{
+		`{ command = "true", on_failure = "retry" }`,
+		`{ command = "true", retries = 3 }`,
+		`{ command = "true", defer = true, on_failure = "rollback" }`,
+		`{ timeout = "1s" }`,
+		`42`,
+	} {
+		invalid := strings.Replace(rawDomain, `"true",`, hook+",", 1)
+		_, err = sacme.ParseDomain([]byte(invalid), *DefaultConfig(t))
+		assert.ErrorIs(t, err, sacme.InvalidHook, hook)
+	}
+}
+
+func TestParseDomainLifecycleHooks(t *testing.T) {
+	rawDomain, _, _ := ValidRawDomain(t)
+	withHooks := func(hooks string) []byte {
+		return []byte(strings.Replace(rawDomain, "[[installs]]", hooks+"\n\n[[installs]]", 1))
+	}
+
+	d, err := sacme.ParseDomain(withHooks(`[hooks]
+hook_timeout = "1m"
+pre_issue = ["systemctl stop nginx"]
+post_issue = [{ command = "systemctl start nginx", on_failure = "fail" }]
+on_renew_failure = ["logger renewal failed"]
+on_uninstall = [{ command = "rm -f /etc/nginx/tls.conf", timeout = "5s" }]`), *DefaultConfig(t))
+	assert.Nil(t, err)
+	assert.Equal(t, sacme.DomainHooks{
+		PreIssue:       []sacme.Hook{{Command: "systemctl stop nginx", Timeout: time.Minute, OnFailure: sacme.DEFAULT_ON_FAILURE}},
+		PostIssue:      []sacme.Hook{{Command: "systemctl start nginx", Timeout: time.Minute, OnFailure: sacme.ON_FAILURE_FAIL}},
+		OnRenewFailure: []sacme.Hook{{Command: "logger renewal failed", Timeout: time.Minute, OnFailure: sacme.DEFAULT_ON_FAILURE}},
+		OnUninstall:    []sacme.Hook{{Command: "rm -f /etc/nginx/tls.conf", Timeout: 5 * time.Second, OnFailure: sacme.DEFAULT_ON_FAILURE}},
+	}, d.Hooks)
+
+	d, err = sacme.ParseDomain([]byte(rawDomain), *DefaultConfig(t))
+	assert.Nil(t, err)
+	assert.Equal(t, sacme.DomainHooks{}, d.Hooks)
+
+	for _, hooks := range []string{
+		`pre_issue = [{ command = "true", on_failure = "rollback" }]`,
+		`post_issue = [{ command = "true", defer = true }]`,
+		`on_uninstall = [{ timeout = "1s" }]`,
+	} {
+		_, err = sacme.ParseDomain(withHooks("[hooks]\n"+hooks), *DefaultConfig(t))
+		assert.ErrorIs(t, err, sacme.InvalidHook, hooks)
+	}
+}
+
+func TestParseDomainHookContext(t *testing.T) {
+	rawDomain, u, g := ValidRawDomain(t)
+	rawDomain = strings.Replace(rawDomain, "[[installs]]", fmt.Sprintf(`[hooks]
+hook_user = "%s"
+hook_dir = "/srv"
+hook_env = ["PATH"]
+pre_issue = ["true"]
+
+[[installs]]
+hook_group = "%s"
+hook_env = []`, u.Username, g.Name), 1)
+
+	d, err := sacme.ParseDomain([]byte(rawDomain), *DefaultConfig(t))
+	assert.Nil(t, err)
+	ctx := d.Hooks.PreIssue[0].HookContext
+	assert.Equal(t, u.Uid, ctx.User.Uid)
+	assert.Equal(t, u.Gid, ctx.Group.Gid)
+	assert.Equal(t, "/srv", ctx.Dir)
+	assert.Equal(t, []string{"PATH"}, ctx.Env)
+
+	ctx = d.Installs[0].Hooks[0].HookContext
+	assert.Equal(t, u.Uid, ctx.User.Uid)
+	assert.Equal(t, g.Gid, ctx.Group.Gid)
+	assert.Equal(t, "/srv", ctx.Dir)
+	assert.Equal(t, []string{}, ctx.Env)
+
+	for valid, invalid := range map[string]string{
+		`hook_dir = "/srv"`:             `hook_dir = "relative"`,
+		`hook_env = ["PATH"]`:           `hook_env = ["A=B"]`,
+		`hook_group = "` + g.Name + `"`: `hook_group = "sacme-no-such-group"`,
+	} {
+		_, err = sacme.ParseDomain([]byte(strings.Replace(rawDomain, valid, invalid, 1)), *DefaultConfig(t))
+		assert.ErrorIs(t, err, sacme.InvalidHook, invalid)
+	}
+}
+
+func TestDeferredHooks(t *testing.T) {
+	reload := sacme.Hook{Command: "systemctl reload nginx", Timeout: time.Second, OnFailure: sacme.ON_FAILURE_IGNORE, Deferred: true}
+	strict := reload
+	strict.Timeout = time.Minute
+	strict.OnFailure = sacme.ON_FAILURE_FAIL
+	other := sacme.Hook{Command: "systemctl reload postfix", Timeout: time.Second, Deferred: true}
+
+	deferred := sacme.NewDeferredHooks()
+	deferred.Add(reload, "a.example.com")
+	deferred.Add(other, "a.example.com")
+	deferred.Add(strict, "b.example.com")
+	deferred.Add(reload, "b.example.com")
+
+	hooks := deferred.Hooks()
+	assert.Len(t, hooks, 2)
+	assert.Equal(t, reload.Command, hooks[0].Command)
+	assert.Equal(t, time.Minute, hooks[0].Timeout)
+	assert.Equal(t, sacme.ON_FAILURE_FAIL, hooks[0].OnFailure)
+	assert.Equal(t, []string{"a.example.com", "b.example.com"}, hooks[0].Domains)
+	assert.Equal(t, []string{"SACME_DOMAINS=a.example.com b.example.com"}, hooks[0].Env())
+	assert.Equal(t, other.Command, hooks[1].Command)
+}
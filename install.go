@@ -1,125 +1,460 @@
 package sacme
 
 import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
 	"github.com/lucat1/sacme/pkg/file"
+	"github.com/lucat1/sacme/pkg/keystore"
 	fs "github.com/spf13/afero"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 func (i1 InstallState) Matches(i2 Install) bool {
-	result := true
-	if i1.Key != nil {
-		result = result && i2.Key != nil && *i1.Key == pathPermToState(i2.Key)
+	is, err := i2.stateFor(&i1)
+	return err == nil && i1.Equals(is)
+}
+
+func (i1 Install) Matches(i2 InstallState) bool {
+	is, err := i1.stateFor(&i2)
+	return err == nil && is.Equals(i2)
+}
+
+func pathPermToState(pp *file.PathPerm) PathPermState {
+	return PathPermState{
+		Path:  pp.Path,
+		Perm:  uint32(pp.Perm),
+		Owner: pp.Owner.Uid,
+		Group: pp.Group.Gid,
 	}
+}
 
-	if i1.Crt != nil {
-		result = result && i2.Crt != nil && *i1.Crt == pathPermToState(i2.Crt)
+func targetToState(t *Target) TargetState {
+	return TargetState{
+		PathPermState: pathPermToState(&t.PathPerm),
+		Format:        t.Format,
 	}
+}
 
-	if i1.CA != nil {
-		result = result && i2.CA != nil && *i1.CA == pathPermToState(i2.CA)
+func optionalTargetToState(t *Target) *TargetState {
+	if t == nil {
+		return nil
 	}
+	ts := targetToState(t)
+	return &ts
+}
 
-	if i1.Concat != nil {
-		result = result && i2.Concat != nil && *i1.Concat == pathPermToState(i2.Concat)
+func concatToState(c *Concat) ConcatState {
+	return ConcatState{
+		TargetState: targetToState(&c.Target),
+		Parts:       c.Parts,
 	}
+}
 
-	return result
+// keystoreToState describes a keystore, digesting its password with the salt
+// of previous when given, so that the two can be compared, or a random one
+func keystoreToState(ks *Keystore, previous *KeystoreState) (kss KeystoreState, err error) {
+	var salt []byte
+	if previous != nil {
+		salt, _ = hex.DecodeString(previous.PasswordSalt)
+	}
+	if len(salt) <= 0 {
+		salt = make([]byte, KEYSTORE_SALT_SIZE)
+		if _, err = rand.Read(salt); err != nil {
+			err = fmt.Errorf("could not generate a password salt: %w", err)
+			return
+		}
+	}
+	digest := pbkdf2.Key([]byte(ks.Password), salt, KEYSTORE_DIGEST_ITERATIONS, sha256.Size, sha256.New)
+	kss = KeystoreState{
+		PathPermState:  pathPermToState(&ks.PathPerm),
+		Alias:          ks.Alias,
+		PasswordSalt:   hex.EncodeToString(salt),
+		PasswordDigest: hex.EncodeToString(digest),
+	}
+	return
 }
 
-func (i1 Install) Matches(i2 InstallState) bool {
-	result := true
-	if i1.Key != nil {
-		result = result && i2.Key != nil && pathPermToState(i1.Key) == *i2.Key
+// State returns the InstallState describing the files written by the install
+func (i Install) State() (InstallState, error) {
+	return i.stateFor(nil)
+}
+
+// stateFor is State, with the keystore passwords digested as in previous
+func (i Install) stateFor(previous *InstallState) (is InstallState, err error) {
+	is.Key = optionalTargetToState(i.Key)
+	is.Crt = optionalTargetToState(i.Crt)
+	is.CA = optionalTargetToState(i.CA)
+	is.Leaf = optionalTargetToState(i.Leaf)
+	is.Chain = optionalTargetToState(i.Chain)
+	is.Fullchain = optionalTargetToState(i.Fullchain)
+
+	if i.Concat != nil {
+		cs := concatToState(i.Concat)
+		is.Concat = &cs
 	}
 
-	if i1.Crt != nil {
-		result = result && i2.Crt != nil && pathPermToState(i1.Crt) == *i2.Crt
+	var pkcs12, jks *KeystoreState
+	if previous != nil {
+		pkcs12, jks = previous.PKCS12, previous.JKS
+	}
+	if i.PKCS12 != nil {
+		var ks KeystoreState
+		if ks, err = keystoreToState(i.PKCS12, pkcs12); err != nil {
+			return
+		}
+		is.PKCS12 = &ks
 	}
 
-	if i1.CA != nil {
-		result = result && i2.CA != nil && pathPermToState(i1.CA) == *i2.CA
+	if i.JKS != nil {
+		var ks KeystoreState
+		if ks, err = keystoreToState(i.JKS, jks); err != nil {
+			return
+		}
+		is.JKS = &ks
 	}
 
-	if i1.Concat != nil {
-		result = result && i2.Concat != nil && pathPermToState(i1.Concat) == *i2.Concat
+	if i.Live != nil {
+		dir := pathPermToState(&i.Live.Dir)
+		is.Dir = &dir
+		is.Link = i.Live.Link
 	}
 
-	return result
+	return
 }
 
-func pathPermToState(pp *file.PathPerm) PathPermState {
-	return PathPermState{
-		Path:  pp.Path,
-		Perm:  uint32(pp.Perm),
-		Owner: pp.Owner.Uid,
-		Group: pp.Group.Gid,
+// Resolve returns a copy of the install with the placeholders in all paths
+// replaced by their value
+func (i Install) Resolve(placeholders map[string]string) Install {
+	pairs := []string{}
+	for placeholder, value := range placeholders {
+		pairs = append(pairs, placeholder, value)
+	}
+	r := strings.NewReplacer(pairs...)
+
+	resolveTarget := func(t *Target) *Target {
+		if t == nil {
+			return nil
+		}
+		resolved := *t
+		resolved.Path = r.Replace(t.Path)
+		return &resolved
+	}
+	resolveKeystore := func(ks *Keystore) *Keystore {
+		if ks == nil {
+			return nil
+		}
+		resolved := *ks
+		resolved.Path = r.Replace(ks.Path)
+		return &resolved
+	}
+
+	resolved := i
+	resolved.Key = resolveTarget(i.Key)
+	resolved.Crt = resolveTarget(i.Crt)
+	resolved.CA = resolveTarget(i.CA)
+	resolved.Leaf = resolveTarget(i.Leaf)
+	resolved.Chain = resolveTarget(i.Chain)
+	resolved.Fullchain = resolveTarget(i.Fullchain)
+	if i.Concat != nil {
+		concat := *i.Concat
+		concat.Target = *resolveTarget(&i.Concat.Target)
+		resolved.Concat = &concat
+	}
+	resolved.PKCS12 = resolveKeystore(i.PKCS12)
+	resolved.JKS = resolveKeystore(i.JKS)
+	if i.Live != nil {
+		live := *i.Live
+		live.Dir.Path = r.Replace(i.Live.Dir.Path)
+		live.Link = r.Replace(i.Live.Link)
+		resolved.Live = &live
+	}
+
+	return resolved
+}
+
+type partTarget struct {
+	part   InstallPart
+	target *Target
+}
+
+func (i Install) partTargets() []partTarget {
+	return []partTarget{
+		{INSTALL_PART_KEY, i.Key},
+		{INSTALL_PART_CRT, i.Crt},
+		{INSTALL_PART_CA, i.CA},
+		{INSTALL_PART_LEAF, i.Leaf},
+		{INSTALL_PART_CHAIN, i.Chain},
+		{INSTALL_PART_FULLCHAIN, i.Fullchain},
+	}
+}
+
+func installTarget(f fs.Fs, t Target, content []byte, installType string) (err error) {
+	content, err = Transcode(content, t.Format)
+	if err != nil {
+		err = fmt.Errorf("could not convert %s to %s: %w", installType, t.Format, err)
+		return
+	}
+
+	return file.WriteFile(f, t.PathPerm, content, installType)
+}
+
+type keystoreEncoder func(rand io.Reader, key crypto.PrivateKey, leaf *x509.Certificate, chain []*x509.Certificate, password, alias string) ([]byte, error)
+
+// encodePKCS12 adapts keystore.EncodePKCS12, as PKCS#12 key entries carry no
+// alias
+func encodePKCS12(rand io.Reader, key crypto.PrivateKey, leaf *x509.Certificate, chain []*x509.Certificate, password, _ string) ([]byte, error) {
+	return keystore.EncodePKCS12(rand, key, leaf, chain, password)
+}
+
+func installKeystore(f fs.Fs, ks *Keystore, state *State, encode keystoreEncoder, installType string) (err error) {
+	key, leaf, chain, err := state.ACME.Chain()
+	if err != nil {
+		err = fmt.Errorf("could not load certificate for %s: %w", installType, err)
+		return
+	}
+
+	alias := ks.Alias
+	if len(alias) <= 0 {
+		alias = state.ACME.Domain
+	}
+	content, err := encode(rand.Reader, key, leaf, chain, ks.Password, alias)
+	if err != nil {
+		err = fmt.Errorf("could not encode %s: %w", installType, err)
+		return
 	}
+
+	return file.WriteFile(f, ks.PathPerm, content, installType)
 }
 
+// Install writes all the targets of a resolved install. Versioned installs
+// are written in their own directory, and the live link is switched to it
+// once all files are in place.
 func (i Install) Install(f fs.Fs, state *State) (isp *InstallState, err error) {
-	var is InstallState
+	// Parent directories are created up front, so that they are recorded
+	// in the order they need to be removed in
+	created := []string{}
+	makeParents := func(pp file.PathPerm) (err error) {
+		dirs, err := file.MakeParents(f, pp)
+		created = append(created, dirs...)
+		if err != nil {
+			err = fmt.Errorf("could not create parent directories: %w", err)
+		}
+		return
+	}
 
-	if i.Key != nil {
-		if err = file.WriteFile(f, *i.Key, state.ACME.PrivateKey, "key"); err != nil {
+	if i.Live != nil {
+		if err = makeParents(i.Live.Dir); err != nil {
+			return
+		}
+		if err = file.MakeDir(f, i.Live.Dir); err != nil {
+			err = fmt.Errorf("could not create version directory: %w", err)
 			return
 		}
-		ks := pathPermToState(i.Key)
-		is.Key = &ks
 	}
-
-	if i.Crt != nil {
-		if err = file.WriteFile(f, *i.Crt, state.ACME.Certificate, "crt"); err != nil {
+	for _, pp := range i.PathPerms() {
+		if err = makeParents(pp); err != nil {
 			return
 		}
-		ks := pathPermToState(i.Crt)
-		is.Crt = &ks
 	}
 
-	if i.CA != nil {
-		if err = file.WriteFile(f, *i.CA, state.ACME.IssuerCertificate, "ca"); err != nil {
+	for _, pt := range i.partTargets() {
+		if pt.target == nil {
+			continue
+		}
+
+		var content []byte
+		content, err = state.ACME.Part(pt.part)
+		if err != nil {
+			err = fmt.Errorf("could not prepare %s for install: %w", pt.part, err)
+			return
+		}
+		if err = installTarget(f, *pt.target, content, string(pt.part)); err != nil {
 			return
 		}
-		ks := pathPermToState(i.CA)
-		is.CA = &ks
 	}
 
 	if i.Concat != nil {
 		concat := []byte{}
-		concat = append(concat, state.ACME.PrivateKey[:]...)
-		concat = append(concat, state.ACME.Certificate[:]...)
+		for _, part := range i.Concat.Parts {
+			var content []byte
+			content, err = state.ACME.Part(part)
+			if err != nil {
+				err = fmt.Errorf("could not prepare %s for concat install: %w", part, err)
+				return
+			}
+			concat = append(concat, content...)
+		}
+
+		if err = installTarget(f, i.Concat.Target, concat, "concat"); err != nil {
+			return
+		}
+	}
 
-		if err = file.WriteFile(f, *i.Concat, concat, "concat"); err != nil {
+	if i.PKCS12 != nil {
+		if err = installKeystore(f, i.PKCS12, state, encodePKCS12, "pkcs12"); err != nil {
 			return
 		}
-		ks := pathPermToState(i.Concat)
-		is.Concat = &ks
 	}
 
+	if i.JKS != nil {
+		if err = installKeystore(f, i.JKS, state, keystore.EncodeJKS, "jks"); err != nil {
+			return
+		}
+	}
+
+	if i.Live != nil {
+		if err = file.Symlink(f, i.Live.Dir.Path, i.Live.Link); err != nil {
+			err = fmt.Errorf("could not switch live link: %w", err)
+			return
+		}
+	}
+
+	placeholders, err := state.ACME.Placeholders()
+	if err != nil {
+		return
+	}
+	is, err := i.State()
+	if err != nil {
+		return
+	}
+	is.Dirs = created
+	is.Serial = placeholders[PLACEHOLDER_SERIAL]
 	isp = &is
 	return
 }
 
-func (i *InstallState) Uninstall(f fs.Fs) (err error) {
-	if i.Key != nil {
-		if err = file.RemoveFile(f, i.Key.Path); err != nil {
+// Paths lists the paths of the files written by the install
+func (i Install) Paths() (paths []string) {
+	for _, pp := range i.PathPerms() {
+		paths = append(paths, pp.Path)
+	}
+	return
+}
+
+// PathPerms lists the files written by the install
+func (i Install) PathPerms() (pps []file.PathPerm) {
+	for _, pt := range i.partTargets() {
+		if pt.target != nil {
+			pps = append(pps, pt.target.PathPerm)
+		}
+	}
+	if i.Concat != nil {
+		pps = append(pps, i.Concat.PathPerm)
+	}
+	for _, ks := range []*Keystore{i.PKCS12, i.JKS} {
+		if ks != nil {
+			pps = append(pps, ks.PathPerm)
+		}
+	}
+	return
+}
+
+// Supersede archives previous as the newest retained version of the
+// versioned install state i. The versions exceeding keep are dropped from the
+// archive and returned, so that they can be uninstalled. When the same
+// version was written again, e.g. on reinstall or after a change to the
+// install, it is not archived and only its files which were not written
+// again are returned.
+func (i *InstallState) Supersede(previous InstallState, keep int) (pruned []InstallState) {
+	archive := previous.Archive
+	// created parent directories outlive the single versions
+	i.Dirs = append(previous.Dirs, i.Dirs...)
+	if previous.Dir != nil && i.Dir != nil && previous.Dir.Path == i.Dir.Path {
+		i.Archive = previous.Archive
+		if stale := previous.filesExcept(i.Paths()); len(stale.Paths()) > 0 {
+			pruned = []InstallState{stale}
+		}
+		return
+	}
+	previous.Link = ""
+	previous.Archive = nil
+	previous.Dirs = nil
+	archive = append([]InstallState{previous}, archive...)
+
+	if len(archive) > keep {
+		pruned = archive[keep:]
+		archive = archive[:keep]
+	}
+	i.Archive = archive
+	return
+}
+
+// filesExcept returns the files of the install state which are not at one of
+// paths, without the link, version directory, archive and created parent
+// directories
+func (i InstallState) filesExcept(paths []string) (rest InstallState) {
+	skip := map[string]bool{}
+	for _, path := range paths {
+		skip[path] = true
+	}
+
+	rest = i
+	rest.Link, rest.Dir, rest.Archive, rest.Dirs = "", nil, nil, nil
+	for _, t := range []**TargetState{&rest.Key, &rest.Crt, &rest.CA, &rest.Leaf, &rest.Chain, &rest.Fullchain} {
+		if *t != nil && skip[(*t).Path] {
+			*t = nil
+		}
+	}
+	if rest.Concat != nil && skip[rest.Concat.Path] {
+		rest.Concat = nil
+	}
+	for _, ks := range []**KeystoreState{&rest.PKCS12, &rest.JKS} {
+		if *ks != nil && skip[(*ks).Path] {
+			*ks = nil
+		}
+	}
+	return
+}
+
+// Uninstall removes all installed files, including the version directory, the
+// live link and the archived versions of versioned installs. Parent
+// directories created during the install are removed if they are empty, and
+// the directories left in place are returned.
+func (i *InstallState) Uninstall(f fs.Fs) (kept []string, err error) {
+	for _, path := range i.Paths() {
+		if err = file.RemoveFile(f, path); err != nil {
 			return
 		}
 	}
 
-	if i.Crt != nil {
-		if err = file.RemoveFile(f, i.Crt.Path); err != nil {
+	if len(i.Link) > 0 {
+		if err = file.RemoveFile(f, i.Link); err != nil {
 			return
 		}
 	}
 
-	if i.CA != nil {
-		if err = file.RemoveFile(f, i.CA.Path); err != nil {
+	removeDir := func(dir string) (err error) {
+		removed, err := file.RemoveEmptyDir(f, dir)
+		if err == nil && !removed {
+			kept = append(kept, dir)
+		}
+		return
+	}
+
+	if i.Dir != nil {
+		if err = removeDir(i.Dir.Path); err != nil {
 			return
 		}
 	}
 
-	if i.Concat != nil {
-		if err = file.RemoveFile(f, i.Concat.Path); err != nil {
+	for _, archived := range i.Archive {
+		var k []string
+		k, err = archived.Uninstall(f)
+		kept = append(kept, k...)
+		if err != nil {
+			return
+		}
+	}
+
+	for j := len(i.Dirs) - 1; j >= 0; j-- {
+		if err = removeDir(i.Dirs[j]); err != nil {
 			return
 		}
 	}
@@ -0,0 +1,423 @@
+package sacme_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"os/user"
+	"testing"
+	"time"
+
+	"github.com/lucat1/sacme"
+	"github.com/lucat1/sacme/pkg/file"
+	jks "github.com/pavlo-v-chernykh/keystore-go/v4"
+	fs "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// IssuedState returns a state holding a freshly generated certificate for
+// example.com, signed by a throwaway CA and bundled with its issuer.
+func IssuedState(t *testing.T) *sacme.State {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sacme test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.Nil(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	assert.Nil(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(12 * time.Hour),
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	leafPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	return &sacme.State{
+		ACME: sacme.ACMEState{
+			Domain:            "example.com",
+			PrivateKey:        pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+			Certificate:       append(append([]byte{}, leafPEM...), caPEM...),
+			IssuerCertificate: caPEM,
+		},
+	}
+}
+
+func currentPathPerm(t *testing.T, path string) file.PathPerm {
+	u, err := user.Current()
+	assert.Nil(t, err)
+	g, err := user.LookupGroupId(u.Gid)
+	assert.Nil(t, err)
+	return file.PathPerm{Path: path, Perm: 0600, Owner: u, Group: g}
+}
+
+func currentTarget(t *testing.T, path string, format sacme.Format) *sacme.Target {
+	return &sacme.Target{PathPerm: currentPathPerm(t, path), Format: format}
+}
+
+func TestInstallKeystores(t *testing.T) {
+	f := fs.NewMemMapFs()
+	state := IssuedState(t)
+	inst := sacme.Install{
+		PKCS12: &sacme.Keystore{PathPerm: currentPathPerm(t, "/ssl/example.p12"), Password: "changeit"},
+		JKS:    &sacme.Keystore{PathPerm: currentPathPerm(t, "/ssl/example.jks"), Password: "changeit", Alias: "tomcat"},
+	}
+
+	is, err := inst.Install(f, state)
+	assert.Nil(t, err)
+	assert.NotNil(t, is.PKCS12)
+	assert.NotNil(t, is.JKS)
+	assert.Equal(t, "tomcat", is.JKS.Alias)
+	assert.True(t, inst.Matches(*is))
+	assert.True(t, is.Matches(inst))
+
+	key, leaf, chain, err := state.ACME.Chain()
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, err)
+
+	p12, err := fs.ReadFile(f, "/ssl/example.p12")
+	assert.Nil(t, err)
+	p12Key, p12Leaf, p12Chain, err := pkcs12.DecodeChain(p12, "changeit")
+	assert.Nil(t, err)
+	assert.Equal(t, key, p12Key)
+	assert.Equal(t, leaf.Raw, p12Leaf.Raw)
+	assert.Len(t, p12Chain, len(chain))
+	assert.Equal(t, chain[0].Raw, p12Chain[0].Raw)
+
+	data, err := fs.ReadFile(f, "/ssl/example.jks")
+	assert.Nil(t, err)
+	ks := jks.New()
+	assert.Nil(t, ks.Load(bytes.NewReader(data), []byte("changeit")))
+	assert.Equal(t, []string{"tomcat"}, ks.Aliases())
+	entry, err := ks.GetPrivateKeyEntry("tomcat", []byte("changeit"))
+	assert.Nil(t, err)
+	assert.Equal(t, keyDER, entry.PrivateKey)
+	assert.Len(t, entry.CertificateChain, 1+len(chain))
+	assert.Equal(t, leaf.Raw, entry.CertificateChain[0].Content)
+	assert.Equal(t, chain[0].Raw, entry.CertificateChain[1].Content)
+
+	// the password is only kept as a salted digest
+	assert.NotEmpty(t, is.PKCS12.PasswordSalt)
+	assert.NotEqual(t, is.PKCS12.PasswordSalt, is.JKS.PasswordSalt)
+	assert.NotEqual(t, is.PKCS12.PasswordDigest, is.JKS.PasswordDigest)
+
+	changed := inst
+	changed.JKS = &sacme.Keystore{PathPerm: inst.JKS.PathPerm, Password: "changed", Alias: "tomcat"}
+	assert.False(t, changed.Matches(*is))
+
+	_, err = is.Uninstall(f)
+	assert.Nil(t, err)
+	_, err = f.Stat("/ssl/example.p12")
+	assert.NotNil(t, err)
+}
+
+func TestInstallParts(t *testing.T) {
+	f := fs.NewMemMapFs()
+	state := IssuedState(t)
+	inst := sacme.Install{
+		Leaf:      currentTarget(t, "/ssl/leaf.pem", sacme.FORMAT_PEM),
+		Chain:     currentTarget(t, "/ssl/chain.pem", sacme.FORMAT_PEM),
+		Fullchain: currentTarget(t, "/ssl/fullchain.pem", sacme.FORMAT_PEM),
+		Concat: &sacme.Concat{
+			Target: *currentTarget(t, "/ssl/haproxy.pem", sacme.FORMAT_PEM),
+			Parts:  []sacme.InstallPart{sacme.INSTALL_PART_LEAF, sacme.INSTALL_PART_CHAIN, sacme.INSTALL_PART_KEY},
+		},
+	}
+
+	is, err := inst.Install(f, state)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/ssl/leaf.pem", "/ssl/chain.pem", "/ssl/fullchain.pem", "/ssl/haproxy.pem"}, is.Paths())
+	placeholders, err := state.ACME.Placeholders()
+	assert.Nil(t, err)
+	assert.Equal(t, placeholders[sacme.PLACEHOLDER_SERIAL], is.Serial)
+
+	leaf, err := fs.ReadFile(f, "/ssl/leaf.pem")
+	assert.Nil(t, err)
+	chain, err := fs.ReadFile(f, "/ssl/chain.pem")
+	assert.Nil(t, err)
+	fullchain, err := fs.ReadFile(f, "/ssl/fullchain.pem")
+	assert.Nil(t, err)
+	concat, err := fs.ReadFile(f, "/ssl/haproxy.pem")
+	assert.Nil(t, err)
+
+	assert.Equal(t, state.ACME.IssuerCertificate, chain)
+	assert.Equal(t, state.ACME.Certificate, fullchain)
+	assert.Equal(t, append(append(leaf, chain...), state.ACME.PrivateKey...), concat)
+
+	reordered := inst
+	reordered.Concat = &sacme.Concat{Target: inst.Concat.Target, Parts: sacme.DEFAULT_CONCAT_PARTS}
+	assert.False(t, reordered.Matches(*is))
+	assert.True(t, inst.Matches(*is))
+	// the certificate in the files does not change what is installed
+	is.Serial = "00"
+	assert.True(t, inst.Matches(*is))
+	_, err = state.ACME.Part(sacme.InstallPart("bogus"))
+	assert.ErrorIs(t, err, sacme.InvalidPart)
+}
+
+func TestInstallFormats(t *testing.T) {
+	f := fs.NewMemMapFs()
+	state := IssuedState(t)
+	inst := sacme.Install{
+		Key:  currentTarget(t, "/ssl/key.der", sacme.FORMAT_DER),
+		Leaf: currentTarget(t, "/ssl/leaf.der", sacme.FORMAT_DER),
+		Concat: &sacme.Concat{
+			Target: *currentTarget(t, "/ssl/pkcs8.pem", sacme.FORMAT_PKCS8_PEM),
+			Parts:  []sacme.InstallPart{sacme.INSTALL_PART_KEY},
+		},
+	}
+
+	_, err := inst.Install(f, state)
+	assert.Nil(t, err)
+
+	keyDER, err := fs.ReadFile(f, "/ssl/key.der")
+	assert.Nil(t, err)
+	key, err := x509.ParsePKCS8PrivateKey(keyDER)
+	assert.Nil(t, err)
+	assert.IsType(t, &ecdsa.PrivateKey{}, key)
+
+	leafDER, err := fs.ReadFile(f, "/ssl/leaf.der")
+	assert.Nil(t, err)
+	leaf, err := x509.ParseCertificate(leafDER)
+	assert.Nil(t, err)
+	assert.Equal(t, "example.com", leaf.Subject.CommonName)
+
+	pkcs8, err := fs.ReadFile(f, "/ssl/pkcs8.pem")
+	assert.Nil(t, err)
+	block, _ := pem.Decode(pkcs8)
+	assert.Equal(t, "PRIVATE KEY", block.Type)
+	assert.Equal(t, keyDER, block.Bytes)
+
+	pkcs1, err := sacme.Transcode(pkcs8, sacme.FORMAT_PKCS1_PEM)
+	assert.Nil(t, err)
+	assert.Equal(t, state.ACME.PrivateKey, pkcs1)
+	_, err = sacme.Transcode(pkcs8, sacme.Format("gif"))
+	assert.ErrorIs(t, err, sacme.InvalidFormat)
+
+	defaults := DefaultConfig(t).Install
+	raw := sacme.RawTarget{
+		RawPathPerm: sacme.RawPathPerm{Path: "/ssl/fullchain.der"},
+		Format:      sacme.FORMAT_DER,
+	}
+	_, err = sacme.ValidateTarget(raw, defaults, sacme.INSTALL_PART_FULLCHAIN)
+	assert.ErrorIs(t, err, sacme.InvalidFormat)
+	_, err = sacme.ValidateTarget(raw, defaults, sacme.INSTALL_PART_LEAF)
+	assert.Nil(t, err)
+}
+
+func TestInstallVersioned(t *testing.T) {
+	f := fs.NewBasePathFs(fs.NewOsFs(), t.TempDir())
+	dir := currentPathPerm(t, "/{domain}/{serial}")
+	dir.Perm = 0755
+	inst := sacme.Install{
+		Key: currentTarget(t, "/{domain}/{serial}/privkey.pem", sacme.FORMAT_PEM),
+		Crt: currentTarget(t, "/{domain}/{serial}/cert.pem", sacme.FORMAT_PEM),
+		Live: &sacme.Live{
+			Dir:  dir,
+			Link: "/{domain}/live",
+			Keep: 1,
+		},
+	}
+	assert.Nil(t, f.Mkdir("/example.com", 0755))
+
+	var current *sacme.InstallState
+	var last *sacme.State
+	var pruned []sacme.InstallState
+	for generation := 0; generation < 3; generation++ {
+		state := IssuedState(t)
+		last = state
+		placeholders, err := state.ACME.Placeholders()
+		assert.Nil(t, err)
+		resolved := inst.Resolve(placeholders)
+
+		is, err := resolved.Install(f, state)
+		assert.Nil(t, err)
+		assert.Equal(t, "/example.com/"+placeholders[sacme.PLACEHOLDER_SERIAL], is.Dir.Path)
+		if current != nil {
+			pruned = is.Supersede(*current, resolved.Live.Keep)
+			for _, p := range pruned {
+				_, err = p.Uninstall(f)
+				assert.Nil(t, err)
+			}
+		}
+		current = is
+
+		crt, err := fs.ReadFile(f, "/example.com/live/cert.pem")
+		assert.Nil(t, err)
+		assert.Equal(t, state.ACME.Certificate, crt)
+	}
+
+	assert.Len(t, current.Archive, 1)
+	assert.Len(t, pruned, 1)
+	assert.Empty(t, current.Archive[0].Link)
+	_, err := f.Stat(current.Archive[0].Dir.Path)
+	assert.Nil(t, err)
+	_, err = f.Stat(pruned[0].Dir.Path)
+	assert.True(t, os.IsNotExist(err))
+
+	// writing the same version again, e.g. on reinstall, does not archive it
+	placeholders, err := last.ACME.Placeholders()
+	assert.Nil(t, err)
+	again, err := inst.Resolve(placeholders).Install(f, last)
+	assert.Nil(t, err)
+	assert.Empty(t, again.Supersede(*current, inst.Live.Keep))
+	assert.Equal(t, current.Archive, again.Archive)
+	current = again
+
+	_, err = current.Uninstall(f)
+	assert.Nil(t, err)
+	entries, err := fs.ReadDir(f, "/example.com")
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestInstallSupersedeSameVersion(t *testing.T) {
+	f := fs.NewBasePathFs(fs.NewOsFs(), t.TempDir())
+	dir := currentPathPerm(t, "/{serial}")
+	dir.Perm = 0755
+	inst := sacme.Install{
+		Key:  currentTarget(t, "/{serial}/privkey.pem", sacme.FORMAT_PEM),
+		Crt:  currentTarget(t, "/{serial}/cert.pem", sacme.FORMAT_PEM),
+		Live: &sacme.Live{Dir: dir, Link: "/live", Keep: 1},
+	}
+
+	old := IssuedState(t)
+	placeholders, err := old.ACME.Placeholders()
+	assert.Nil(t, err)
+	first, err := inst.Resolve(placeholders).Install(f, old)
+	assert.Nil(t, err)
+	state := IssuedState(t)
+	placeholders, err = state.ACME.Placeholders()
+	assert.Nil(t, err)
+	current, err := inst.Resolve(placeholders).Install(f, state)
+	assert.Nil(t, err)
+	assert.Empty(t, current.Supersede(*first, inst.Live.Keep))
+	assert.Len(t, current.Archive, 1)
+
+	// the install changed, but not the certificate: the live version is
+	// neither archived nor pruned, and only the dropped file is removed
+	changed := inst
+	changed.Crt = nil
+	again, err := changed.Resolve(placeholders).Install(f, state)
+	assert.Nil(t, err)
+	pruned := again.Supersede(*current, inst.Live.Keep)
+	assert.Equal(t, current.Archive, again.Archive)
+	assert.Len(t, pruned, 1)
+	assert.Equal(t, []string{current.Crt.Path}, pruned[0].Paths())
+	assert.Empty(t, pruned[0].Link)
+	assert.Nil(t, pruned[0].Dir)
+	_, err = pruned[0].Uninstall(f)
+	assert.Nil(t, err)
+
+	_, err = f.Stat(current.Crt.Path)
+	assert.True(t, os.IsNotExist(err))
+	for _, path := range []string{current.Key.Path, "/live/privkey.pem", first.Key.Path} {
+		_, err = f.Stat(path)
+		assert.Nil(t, err, path)
+	}
+
+	kept, err := again.Uninstall(f)
+	assert.Nil(t, err)
+	assert.Empty(t, kept)
+}
+
+func TestInstallParents(t *testing.T) {
+	f := fs.NewMemMapFs()
+	state := IssuedState(t)
+	assert.Nil(t, f.Mkdir("/etc", 0755))
+
+	key := currentTarget(t, "/etc/ssl/example.com/privkey.pem", sacme.FORMAT_PEM)
+	key.Parents = &file.Parents{Perm: 0750, Owner: key.Owner, Group: key.Group}
+	crt := currentTarget(t, "/etc/ssl/example.com/cert.pem", sacme.FORMAT_PEM)
+	crt.Parents = key.Parents
+	inst := sacme.Install{Key: key, Crt: crt}
+
+	is, err := inst.Install(f, state)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/etc/ssl", "/etc/ssl/example.com"}, is.Dirs)
+	info, err := f.Stat("/etc/ssl/example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	assert.True(t, inst.Matches(*is))
+
+	assert.Nil(t, fs.WriteFile(f, "/etc/ssl/other.pem", []byte{}, 0644))
+	// directories removed by someone else are not an error
+	is.Dirs = append(is.Dirs, "/etc/ssl/example.com/gone")
+	kept, err := is.Uninstall(f)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/etc/ssl"}, kept)
+	_, err = f.Stat("/etc/ssl/example.com")
+	assert.True(t, os.IsNotExist(err))
+	_, err = f.Stat("/etc/ssl")
+	assert.Nil(t, err)
+}
+
+func TestInstallRollback(t *testing.T) {
+	// BasePathFs does not read back the links it creates, so use real paths
+	f := fs.NewOsFs()
+	root := t.TempDir()
+	dir := currentPathPerm(t, root+"/{domain}/{serial}")
+	dir.Perm = 0755
+	dir.Parents = &file.Parents{Perm: 0755, Owner: dir.Owner, Group: dir.Group}
+	inst := sacme.Install{
+		Key:  currentTarget(t, root+"/{domain}/{serial}/privkey.pem", sacme.FORMAT_PEM),
+		Live: &sacme.Live{Dir: dir, Link: root + "/{domain}/live", Keep: 1},
+	}
+
+	state := IssuedState(t)
+	placeholders, err := state.ACME.Placeholders()
+	assert.Nil(t, err)
+	previous, err := inst.Resolve(placeholders).Install(f, state)
+	assert.Nil(t, err)
+
+	// replace the previous version through the journal, then roll back
+	tx := file.NewJournal(f)
+	next := IssuedState(t)
+	placeholders, err = next.ACME.Placeholders()
+	assert.Nil(t, err)
+	is, err := inst.Resolve(placeholders).Install(tx, next)
+	assert.Nil(t, err)
+	for _, pruned := range is.Supersede(*previous, 0) {
+		_, err = pruned.Uninstall(tx)
+		assert.Nil(t, err)
+	}
+	_, err = f.Stat(previous.Dir.Path)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, tx.Rollback())
+	content, err := fs.ReadFile(f, root+"/example.com/live/privkey.pem")
+	assert.Nil(t, err)
+	assert.Equal(t, state.ACME.PrivateKey, content)
+	_, err = f.Stat(is.Dir.Path)
+	assert.True(t, os.IsNotExist(err))
+	entries, err := fs.ReadDir(f, root+"/example.com")
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+}
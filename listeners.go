@@ -0,0 +1,186 @@
+package sacme
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/lucat1/sacme/challenges/standalone"
+)
+
+// Listeners holds the providers serving pre-opened listeners for the
+// http-01/standalone challenge, keyed by the address they are bound to
+type Listeners map[string]*standalone.StandaloneProvider
+
+// StandaloneAddress returns the address the http-01/standalone challenge of
+// a domain is served on
+func StandaloneAddress(auth Authentication) string {
+	return net.JoinHostPort(auth.Options[AUTHENTICATION_OPTION_INTERFACE], auth.Options[AUTHENTICATION_OPTION_PORT])
+}
+
+// OpenListeners binds the addresses of all domains authenticating with the
+// http-01/standalone challenge, so that they can be served after privileges
+// have been dropped
+func OpenListeners(domains []Domain) (l Listeners, err error) {
+	listeners := Listeners{}
+	if err = listeners.Open(domains); err != nil {
+		return
+	}
+	l = listeners
+	return
+}
+
+// Open binds the http-01/standalone addresses of the domains which are not
+// covered yet. On error, only the listeners it opened are closed.
+func (l Listeners) Open(domains []Domain) (err error) {
+	opened := Listeners{}
+	for _, domain := range domains {
+		if domain.Authentication.Method != AUTHENTICATION_METHOD_HTTP01_STANDALONE {
+			continue
+		}
+		addr := StandaloneAddress(domain.Authentication)
+		if _, ok := l[addr]; ok {
+			continue
+		}
+
+		var listener net.Listener
+		listener, err = net.Listen("tcp", addr)
+		if err != nil {
+			opened.Close()
+			for a := range opened {
+				delete(l, a)
+			}
+			err = fmt.Errorf("could not listen on %s for domain %s: %w", addr, domain.Domain, err)
+			return
+		}
+		l[addr] = standalone.NewStandaloneProvider(listener)
+		opened[addr] = l[addr]
+	}
+	return
+}
+
+// ActivatedListeners assigns the listeners passed with socket activation to
+// the http-01/standalone addresses of the domains, by port and, when an
+// interface is configured, by IP. All standalone domains must be covered.
+func ActivatedListeners(domains []Domain, activated []net.Listener) (l Listeners, err error) {
+	listeners := Listeners{}
+	if err = listeners.Activate(domains, activated); err != nil {
+		return
+	}
+	l = listeners
+	return
+}
+
+// Activate assigns the activated listeners to the http-01/standalone
+// addresses of the domains which are not covered yet, reusing the providers
+// already serving them
+func (l Listeners) Activate(domains []Domain, activated []net.Listener) (err error) {
+	// a listener can match multiple addresses, but must be served only once
+	providers := map[net.Listener]*standalone.StandaloneProvider{}
+	for _, sp := range l {
+		providers[sp.Listener()] = sp
+	}
+	for _, domain := range domains {
+		if domain.Authentication.Method != AUTHENTICATION_METHOD_HTTP01_STANDALONE {
+			continue
+		}
+		addr := StandaloneAddress(domain.Authentication)
+		if _, ok := l[addr]; ok {
+			continue
+		}
+
+		iface := domain.Authentication.Options[AUTHENTICATION_OPTION_INTERFACE]
+		port := domain.Authentication.Options[AUTHENTICATION_OPTION_PORT]
+		for _, listener := range activated {
+			tcp, ok := listener.Addr().(*net.TCPAddr)
+			if !ok || strconv.Itoa(tcp.Port) != port {
+				continue
+			}
+			if len(iface) > 0 && !tcp.IP.Equal(net.ParseIP(iface)) {
+				continue
+			}
+			if _, ok := providers[listener]; !ok {
+				providers[listener] = standalone.NewStandaloneProvider(listener)
+			}
+			l[addr] = providers[listener]
+			break
+		}
+		if _, ok := l[addr]; !ok {
+			err = fmt.Errorf("no activated listener matches %s for domain %s", addr, domain.Domain)
+			return
+		}
+	}
+	return
+}
+
+// Files returns duplicates of the listening sockets, to be passed to another
+// process, along with the addresses served by each of them
+func (l Listeners) Files() (addrs [][]string, files []*os.File, err error) {
+	indices := map[*standalone.StandaloneProvider]int{}
+	for addr, sp := range l {
+		if i, ok := indices[sp]; ok {
+			addrs[i] = append(addrs[i], addr)
+			continue
+		}
+
+		tcp, ok := sp.Listener().(*net.TCPListener)
+		if !ok {
+			err = fmt.Errorf("listener on %s is not a TCP listener", addr)
+			break
+		}
+
+		var f *os.File
+		f, err = tcp.File()
+		if err != nil {
+			err = fmt.Errorf("could not get file for listener on %s: %w", addr, err)
+			break
+		}
+		indices[sp] = len(files)
+		addrs = append(addrs, []string{addr})
+		files = append(files, f)
+	}
+
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		addrs, files = nil, nil
+	}
+	return
+}
+
+// ListenersFromFiles rebuilds the listeners passed by another process
+func ListenersFromFiles(addrs [][]string, files []*os.File) (l Listeners, err error) {
+	if len(addrs) != len(files) {
+		err = fmt.Errorf("got %d files for %d listeners", len(files), len(addrs))
+		return
+	}
+
+	listeners := Listeners{}
+	for i, f := range files {
+		var listener net.Listener
+		listener, err = net.FileListener(f)
+		if err != nil {
+			listeners.Close()
+			err = fmt.Errorf("could not use file %s as listener for %v: %w", f.Name(), addrs[i], err)
+			return
+		}
+		// the listener holds its own duplicate of the descriptor
+		f.Close()
+
+		sp := standalone.NewStandaloneProvider(listener)
+		for _, addr := range addrs[i] {
+			listeners[addr] = sp
+		}
+	}
+
+	l = listeners
+	return
+}
+
+func (l Listeners) Close() {
+	for _, sp := range l {
+		sp.Listener().Close()
+	}
+}
@@ -0,0 +1,96 @@
+package sacme_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/lucat1/sacme"
+	"github.com/stretchr/testify/assert"
+)
+
+func standaloneDomain(name string) sacme.Domain {
+	return sacme.Domain{
+		Domain: name,
+		Authentication: sacme.Authentication{
+			Method: sacme.AUTHENTICATION_METHOD_HTTP01_STANDALONE,
+			Options: map[string]string{
+				sacme.AUTHENTICATION_OPTION_INTERFACE: "127.0.0.1",
+				sacme.AUTHENTICATION_OPTION_PORT:      "0",
+			},
+		},
+	}
+}
+
+func get(t *testing.T, url string) (int, string) {
+	res, err := http.Get(url)
+	assert.Nil(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	assert.Nil(t, err)
+	return res.StatusCode, string(body)
+}
+
+func TestListeners(t *testing.T) {
+	domains := []sacme.Domain{standaloneDomain("a.example.com"), standaloneDomain("b.example.com")}
+	listeners, err := sacme.OpenListeners(domains)
+	assert.Nil(t, err)
+	defer listeners.Close()
+	// both domains share the same address
+	assert.Len(t, listeners, 1)
+
+	addrs, files, err := listeners.Files()
+	assert.Nil(t, err)
+	passed, err := sacme.ListenersFromFiles(addrs, files)
+	assert.Nil(t, err)
+	defer passed.Close()
+
+	sp := passed[sacme.StandaloneAddress(domains[0].Authentication)]
+	assert.NotNil(t, sp)
+	url := "http://" + sp.Listener().Addr().String() + http01.ChallengePath("token")
+
+	assert.Nil(t, sp.Present("a.example.com", "token", "token.keyauth"))
+	status, body := get(t, url)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "token.keyauth", body)
+
+	assert.Nil(t, sp.CleanUp("a.example.com", "token", "token.keyauth"))
+	status, _ = get(t, url)
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestActivatedListeners(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+
+	wildcard := standaloneDomain("a.example.com")
+	wildcard.Authentication.Options[sacme.AUTHENTICATION_OPTION_INTERFACE] = ""
+	wildcard.Authentication.Options[sacme.AUTHENTICATION_OPTION_PORT] = port
+	local := standaloneDomain("b.example.com")
+	local.Authentication.Options[sacme.AUTHENTICATION_OPTION_PORT] = port
+
+	listeners, err := sacme.ActivatedListeners([]sacme.Domain{wildcard, local}, []net.Listener{listener})
+	assert.Nil(t, err)
+	assert.Len(t, listeners, 2)
+	// the same listener is served by a single provider
+	assert.Same(t, listeners[sacme.StandaloneAddress(wildcard.Authentication)], listeners[sacme.StandaloneAddress(local.Authentication)])
+
+	other := standaloneDomain("c.example.com")
+	other.Authentication.Options[sacme.AUTHENTICATION_OPTION_INTERFACE] = "127.0.0.2"
+	other.Authentication.Options[sacme.AUTHENTICATION_OPTION_PORT] = port
+	_, err = sacme.ActivatedListeners([]sacme.Domain{other}, []net.Listener{listener})
+	assert.NotNil(t, err)
+
+	// extending the listeners, e.g. on reload, keeps the existing provider
+	extra := standaloneDomain("d.example.com")
+	extra.Authentication.Options[sacme.AUTHENTICATION_OPTION_INTERFACE] = "::ffff:127.0.0.1"
+	extra.Authentication.Options[sacme.AUTHENTICATION_OPTION_PORT] = port
+	assert.Nil(t, listeners.Activate([]sacme.Domain{extra}, []net.Listener{listener}))
+	assert.Len(t, listeners, 3)
+	assert.Same(t, listeners[sacme.StandaloneAddress(wildcard.Authentication)], listeners[sacme.StandaloneAddress(extra.Authentication)])
+}
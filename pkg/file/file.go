@@ -2,10 +2,12 @@ package file
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/user"
+	"path/filepath"
 	"strconv"
 
 	fs "github.com/spf13/afero"
@@ -16,10 +18,19 @@ type PathPerm struct {
 	Perm  os.FileMode
 	Owner *user.User
 	Group *user.Group
+	// When set, missing parent directories are created by MakeParents
+	Parents *Parents
+}
+
+// Parents describes the permission and ownership of created parent directories
+type Parents struct {
+	Perm  os.FileMode
+	Owner *user.User
+	Group *user.Group
 }
 
 func WriteFile(f fs.Fs, pp PathPerm, content []byte, installType string) (err error) {
-	handle, err := f.OpenFile(pp.Path, os.O_CREATE|os.O_WRONLY, os.FileMode(pp.Perm))
+	handle, err := f.OpenFile(pp.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(pp.Perm))
 	if err != nil {
 		err = fmt.Errorf("could not open file %s for writing %s: %w", pp.Path, installType, err)
 		return
@@ -38,6 +49,10 @@ func WriteFile(f fs.Fs, pp PathPerm, content []byte, installType string) (err er
 		return
 	}
 
+	return chown(f, pp)
+}
+
+func chown(f fs.Fs, pp PathPerm) (err error) {
 	uid, err := strconv.Atoi(pp.Owner.Uid)
 	if err != nil {
 		err = fmt.Errorf("could not parse uid %s (user %s) as int: %w", pp.Owner.Uid, pp.Owner.Username, err)
@@ -65,3 +80,117 @@ func RemoveFile(f fs.Fs, path string) (err error) {
 
 	return
 }
+
+// MakeDir creates the directory described by pp, unless it already exists, and
+// applies the configured permissions and ownership to it
+func MakeDir(f fs.Fs, pp PathPerm) (err error) {
+	err = f.Mkdir(pp.Path, pp.Perm)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		err = fmt.Errorf("could not create directory %s: %w", pp.Path, err)
+		return
+	}
+
+	if err = f.Chmod(pp.Path, pp.Perm|os.ModeDir); err != nil {
+		err = fmt.Errorf("could not chmod directory %s: %w", pp.Path, err)
+		return
+	}
+
+	return chown(f, pp)
+}
+
+// MakeParents creates the missing parent directories of pp.Path, if pp allows
+// it, returning the created directories from the outermost to the innermost
+func MakeParents(f fs.Fs, pp PathPerm) (created []string, err error) {
+	if pp.Parents == nil {
+		return
+	}
+
+	missing := []string{}
+	for dir := filepath.Dir(pp.Path); ; dir = filepath.Dir(dir) {
+		var info os.FileInfo
+		info, err = f.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				err = fmt.Errorf("parent %s of %s is not a directory", dir, pp.Path)
+				return
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			err = fmt.Errorf("could not stat parent directory %s: %w", dir, err)
+			return
+		}
+		missing = append([]string{dir}, missing...)
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	for _, dir := range missing {
+		err = MakeDir(f, PathPerm{
+			Path:  dir,
+			Perm:  pp.Parents.Perm,
+			Owner: pp.Parents.Owner,
+			Group: pp.Parents.Group,
+		})
+		if err != nil {
+			return
+		}
+		created = append(created, dir)
+	}
+
+	err = nil
+	return
+}
+
+// RemoveEmptyDir removes a directory, unless other files have been placed in
+// it, in which case the directory is left untouched. A directory which does
+// not exist anymore counts as removed.
+func RemoveEmptyDir(f fs.Fs, path string) (removed bool, err error) {
+	entries, err := fs.ReadDir(f, path)
+	if errors.Is(err, os.ErrNotExist) {
+		removed, err = true, nil
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("could not list directory %s: %w", path, err)
+		return
+	}
+	if len(entries) > 0 {
+		return
+	}
+
+	if err = f.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		err = fmt.Errorf("could not remove directory %s: %w", path, err)
+		return
+	}
+
+	removed = true
+	return
+}
+
+// Symlink atomically points link to target, replacing any previous link by
+// renaming a temporary symlink over it
+func Symlink(f fs.Fs, target, link string) (err error) {
+	linker, ok := f.(fs.Linker)
+	if !ok {
+		err = fmt.Errorf("filesystem does not support symlinks")
+		return
+	}
+
+	tmp := link + ".tmp"
+	if err = f.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		err = fmt.Errorf("could not remove stale temporary symlink %s: %w", tmp, err)
+		return
+	}
+	if err = linker.SymlinkIfPossible(target, tmp); err != nil {
+		err = fmt.Errorf("could not create symlink %s to %s: %w", tmp, target, err)
+		return
+	}
+	if err = f.Rename(tmp, link); err != nil {
+		err = fmt.Errorf("could not move symlink %s to %s: %w", tmp, link, err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,258 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	fs "github.com/spf13/afero"
+)
+
+// journalEntry is the state of a path before it was first modified
+type journalEntry struct {
+	path    string
+	exists  bool
+	mode    os.FileMode
+	content []byte
+	link    string
+	// the ownership is only restored when known
+	owned    bool
+	uid, gid int
+}
+
+// Journal wraps a filesystem, recording the state of every path before it
+// is first modified through it, so that all changes can be rolled back.
+type Journal struct {
+	fs.Fs
+	entries []journalEntry
+	seen    map[string]bool
+}
+
+func NewJournal(f fs.Fs) *Journal {
+	return &Journal{Fs: f, seen: map[string]bool{}}
+}
+
+func (j *Journal) lstat(name string) (os.FileInfo, error) {
+	if lstater, ok := j.Fs.(fs.Lstater); ok {
+		info, _, err := lstater.LstatIfPossible(name)
+		return info, err
+	}
+	return j.Fs.Stat(name)
+}
+
+func (j *Journal) record(name string) (err error) {
+	if j.seen[name] {
+		return
+	}
+
+	entry := journalEntry{path: name}
+	info, err := j.lstat(name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		err = nil
+	case err != nil:
+		err = fmt.Errorf("could not record %s before changing it: %w", name, err)
+		return
+	default:
+		entry.exists = true
+		entry.mode = info.Mode()
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			entry.owned, entry.uid, entry.gid = true, int(st.Uid), int(st.Gid)
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			reader, ok := j.Fs.(fs.LinkReader)
+			if !ok {
+				err = fmt.Errorf("could not record symlink %s: filesystem cannot read links", name)
+				return
+			}
+			entry.link, err = reader.ReadlinkIfPossible(name)
+		case info.Mode().IsRegular():
+			entry.content, err = fs.ReadFile(j.Fs, name)
+		}
+		if err != nil {
+			err = fmt.Errorf("could not record %s before changing it: %w", name, err)
+			return
+		}
+	}
+
+	j.seen[name] = true
+	j.entries = append(j.entries, entry)
+	return
+}
+
+// Rollback restores all recorded paths to their original state, in the
+// reverse order in which they were changed
+func (j *Journal) Rollback() (err error) {
+	errs := []error{}
+	for k := len(j.entries) - 1; k >= 0; k-- {
+		if rerr := j.restore(j.entries[k]); rerr != nil {
+			errs = append(errs, rerr)
+		}
+	}
+	j.entries = nil
+	j.seen = map[string]bool{}
+
+	if len(errs) > 0 {
+		err = fmt.Errorf("could not roll back %d paths: %v", len(errs), errs)
+	}
+	return
+}
+
+func (j *Journal) restore(entry journalEntry) (err error) {
+	info, lerr := j.lstat(entry.path)
+	current := lerr == nil
+	isDir := current && info.IsDir()
+
+	if !entry.exists {
+		if current {
+			err = j.Fs.Remove(entry.path)
+		}
+		return
+	}
+
+	switch {
+	case entry.mode.IsDir():
+		if !isDir {
+			if current {
+				if err = j.Fs.Remove(entry.path); err != nil {
+					return
+				}
+			}
+			if err = j.Fs.Mkdir(entry.path, entry.mode.Perm()); err != nil {
+				return
+			}
+		}
+	case entry.mode&os.ModeSymlink != 0:
+		if current {
+			if err = j.Fs.Remove(entry.path); err != nil {
+				return
+			}
+		}
+		linker, ok := j.Fs.(fs.Linker)
+		if !ok {
+			return fmt.Errorf("could not restore symlink %s: filesystem does not support symlinks", entry.path)
+		}
+		// the ownership of links is left alone
+		return linker.SymlinkIfPossible(entry.link, entry.path)
+	default:
+		if isDir {
+			if err = j.Fs.Remove(entry.path); err != nil {
+				return
+			}
+		}
+		if err = fs.WriteFile(j.Fs, entry.path, entry.content, entry.mode.Perm()); err != nil {
+			return
+		}
+	}
+
+	if err = j.Fs.Chmod(entry.path, entry.mode); err != nil {
+		return
+	}
+	if entry.owned {
+		err = j.Fs.Chown(entry.path, entry.uid, entry.gid)
+	}
+	return
+}
+
+func (j *Journal) Create(name string) (fs.File, error) {
+	if err := j.record(name); err != nil {
+		return nil, err
+	}
+	return j.Fs.Create(name)
+}
+
+func (j *Journal) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		if err := j.record(name); err != nil {
+			return nil, err
+		}
+	}
+	return j.Fs.OpenFile(name, flag, perm)
+}
+
+func (j *Journal) Mkdir(name string, perm os.FileMode) error {
+	if err := j.record(name); err != nil {
+		return err
+	}
+	return j.Fs.Mkdir(name, perm)
+}
+
+func (j *Journal) MkdirAll(path string, perm os.FileMode) error {
+	return fmt.Errorf("MkdirAll is not supported by the journal, use MakeParents")
+}
+
+func (j *Journal) Remove(name string) error {
+	if err := j.record(name); err != nil {
+		return err
+	}
+	return j.Fs.Remove(name)
+}
+
+func (j *Journal) RemoveAll(path string) error {
+	return fmt.Errorf("RemoveAll is not supported by the journal")
+}
+
+func (j *Journal) Rename(oldname, newname string) error {
+	if err := j.record(oldname); err != nil {
+		return err
+	}
+	if err := j.record(newname); err != nil {
+		return err
+	}
+	return j.Fs.Rename(oldname, newname)
+}
+
+func (j *Journal) Chmod(name string, mode os.FileMode) error {
+	if err := j.record(name); err != nil {
+		return err
+	}
+	return j.Fs.Chmod(name, mode)
+}
+
+func (j *Journal) Chown(name string, uid, gid int) error {
+	if err := j.record(name); err != nil {
+		return err
+	}
+	return j.Fs.Chown(name, uid, gid)
+}
+
+func (j *Journal) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := j.record(name); err != nil {
+		return err
+	}
+	return j.Fs.Chtimes(name, atime, mtime)
+}
+
+func (j *Journal) SymlinkIfPossible(oldname, newname string) error {
+	linker, ok := j.Fs.(fs.Linker)
+	if !ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: fs.ErrNoSymlink}
+	}
+	if err := j.record(newname); err != nil {
+		return err
+	}
+	return linker.SymlinkIfPossible(oldname, newname)
+}
+
+func (j *Journal) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	if lstater, ok := j.Fs.(fs.Lstater); ok {
+		return lstater.LstatIfPossible(name)
+	}
+	info, err := j.Fs.Stat(name)
+	return info, false, err
+}
+
+func (j *Journal) ReadlinkIfPossible(name string) (string, error) {
+	if reader, ok := j.Fs.(fs.LinkReader); ok {
+		return reader.ReadlinkIfPossible(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: fs.ErrNoReadlink}
+}
+
+func (j *Journal) Name() string {
+	return "Journal"
+}
@@ -0,0 +1,62 @@
+package file
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	fs "github.com/spf13/afero"
+	"golang.org/x/exp/slog"
+)
+
+// RootlessFs wraps a filesystem for unprivileged operation: ownership changes
+// which would not alter the file, or which the running user is not permitted
+// to make, are skipped instead of failing the install.
+type RootlessFs struct {
+	fs.Fs
+}
+
+func NewRootlessFs(f fs.Fs) *RootlessFs {
+	return &RootlessFs{Fs: f}
+}
+
+func (r *RootlessFs) Chown(name string, uid, gid int) (err error) {
+	if info, serr := r.Fs.Stat(name); serr == nil {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) == uid && int(st.Gid) == gid {
+			return
+		}
+	}
+
+	err = r.Fs.Chown(name, uid, gid)
+	if errors.Is(err, os.ErrPermission) {
+		slog.Warn("not permitted to change ownership, skipping", "path", name, "uid", uid, "gid", gid)
+		err = nil
+	}
+	return
+}
+
+func (r *RootlessFs) SymlinkIfPossible(oldname, newname string) error {
+	if linker, ok := r.Fs.(fs.Linker); ok {
+		return linker.SymlinkIfPossible(oldname, newname)
+	}
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: fs.ErrNoSymlink}
+}
+
+func (r *RootlessFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	if lstater, ok := r.Fs.(fs.Lstater); ok {
+		return lstater.LstatIfPossible(name)
+	}
+	info, err := r.Fs.Stat(name)
+	return info, false, err
+}
+
+func (r *RootlessFs) ReadlinkIfPossible(name string) (string, error) {
+	if reader, ok := r.Fs.(fs.LinkReader); ok {
+		return reader.ReadlinkIfPossible(name)
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: fs.ErrNoReadlink}
+}
+
+func (r *RootlessFs) Name() string {
+	return "RootlessFs"
+}
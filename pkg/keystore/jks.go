@@ -0,0 +1,49 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"time"
+
+	jks "github.com/pavlo-v-chernykh/keystore-go/v4"
+)
+
+const jksCertType = "X509"
+
+// EncodeJKS encodes a private key, its leaf certificate and the issuer chain
+// into a Java KeyStore (JKS) with a single private key entry named alias. The
+// same password protects both the entry and the integrity of the keystore.
+func EncodeJKS(rand io.Reader, key crypto.PrivateKey, leaf *x509.Certificate, chain []*x509.Certificate, password, alias string) (data []byte, err error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		err = fmt.Errorf("could not encode private key: %w", err)
+		return
+	}
+
+	entry := jks.PrivateKeyEntry{
+		CreationTime: time.Now(),
+		PrivateKey:   der,
+	}
+	for _, cert := range append([]*x509.Certificate{leaf}, chain...) {
+		entry.CertificateChain = append(entry.CertificateChain, jks.Certificate{
+			Type:    jksCertType,
+			Content: cert.Raw,
+		})
+	}
+
+	ks := jks.New(jks.WithCustomRandomNumberGenerator(rand))
+	if err = ks.SetPrivateKeyEntry(alias, entry, []byte(password)); err != nil {
+		err = fmt.Errorf("could not add private key entry: %w", err)
+		return
+	}
+	var buf bytes.Buffer
+	if err = ks.Store(&buf, []byte(password)); err != nil {
+		err = fmt.Errorf("could not store keystore: %w", err)
+		return
+	}
+	data = buf.Bytes()
+	return
+}
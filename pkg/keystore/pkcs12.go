@@ -0,0 +1,17 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/x509"
+	"io"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// EncodePKCS12 encodes a private key, its leaf certificate and the issuer
+// chain into a password protected PKCS#12 archive, using the modern
+// algorithms (AES-256-CBC with PBKDF2 and an HMAC-SHA256 integrity check)
+// understood by OpenSSL 1.1.1 and Java 12 and later.
+func EncodePKCS12(rand io.Reader, key crypto.PrivateKey, leaf *x509.Certificate, chain []*x509.Certificate, password string) (data []byte, err error) {
+	return pkcs12.Modern.WithRand(rand).Encode(key, leaf, chain, password)
+}
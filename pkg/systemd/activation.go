@@ -0,0 +1,93 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The first file descriptor passed by the service manager
+const LISTEN_FDS_START = 3
+
+const (
+	ENV_LISTEN_PID     = "LISTEN_PID"
+	ENV_LISTEN_FDS     = "LISTEN_FDS"
+	ENV_LISTEN_FDNAMES = "LISTEN_FDNAMES"
+)
+
+// Files returns the file descriptors passed with socket activation, named
+// after LISTEN_FDNAMES. Nothing is returned when the variables are missing or
+// meant for another process. The variables are unset, so that they are not
+// inherited by child processes.
+func Files() (files []*os.File, err error) {
+	defer func() {
+		os.Unsetenv(ENV_LISTEN_PID)
+		os.Unsetenv(ENV_LISTEN_FDS)
+		os.Unsetenv(ENV_LISTEN_FDNAMES)
+	}()
+
+	rawPid, ok := os.LookupEnv(ENV_LISTEN_PID)
+	if !ok {
+		return
+	}
+	pid, err := strconv.Atoi(rawPid)
+	if err != nil {
+		err = fmt.Errorf("could not parse %s=%s: %w", ENV_LISTEN_PID, rawPid, err)
+		return
+	}
+	if pid != os.Getpid() {
+		return
+	}
+
+	rawFds := os.Getenv(ENV_LISTEN_FDS)
+	fds, err := strconv.Atoi(rawFds)
+	if err != nil || fds < 0 {
+		err = fmt.Errorf("invalid %s=%s", ENV_LISTEN_FDS, rawFds)
+		return
+	}
+
+	names := []string{}
+	if rawNames := os.Getenv(ENV_LISTEN_FDNAMES); len(rawNames) > 0 {
+		names = strings.Split(rawNames, ":")
+	}
+
+	for i := 0; i < fds; i++ {
+		fd := LISTEN_FDS_START + i
+		syscall.CloseOnExec(fd)
+
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+		files = append(files, os.NewFile(uintptr(fd), name))
+	}
+	return
+}
+
+// Listeners returns the listening sockets passed with socket activation.
+// Other kinds of file descriptors are rejected.
+func Listeners() (listeners []net.Listener, err error) {
+	files, err := Files()
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		var listener net.Listener
+		listener, err = net.FileListener(f)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			listeners = nil
+			err = fmt.Errorf("passed file descriptor %s is not a listening socket: %w", f.Name(), err)
+			return
+		}
+		f.Close()
+		listeners = append(listeners, listener)
+	}
+	return
+}
@@ -0,0 +1,53 @@
+package systemd_test
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/lucat1/sacme/pkg/systemd"
+	"github.com/stretchr/testify/assert"
+)
+
+const childEnv = "SACME_TEST_ACTIVATION_ADDR"
+
+// TestListeners runs itself again as a socket activated process, setting
+// LISTEN_PID to the pid of the child by exec'ing from a shell
+func TestListeners(t *testing.T) {
+	if addr, ok := os.LookupEnv(childEnv); ok {
+		listeners, err := systemd.Listeners()
+		assert.Nil(t, err)
+		assert.Len(t, listeners, 1)
+		assert.Equal(t, addr, listeners[0].Addr().String())
+		_, ok := os.LookupEnv(systemd.ENV_LISTEN_FDS)
+		assert.False(t, ok)
+		return
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	f, err := listener.(*net.TCPListener).File()
+	assert.Nil(t, err)
+	defer f.Close()
+
+	cmd := exec.Command("/bin/sh", "-c", `LISTEN_PID=$$ exec "$0" -test.run '^TestListeners$'`, os.Args[0])
+	cmd.Env = append(os.Environ(),
+		systemd.ENV_LISTEN_FDS+"=1",
+		systemd.ENV_LISTEN_FDNAMES+"=http",
+		childEnv+"="+listener.Addr().String(),
+	)
+	cmd.ExtraFiles = []*os.File{f}
+	out, err := cmd.CombinedOutput()
+	assert.Nil(t, err, string(out))
+}
+
+func TestListenersOtherProcess(t *testing.T) {
+	t.Setenv(systemd.ENV_LISTEN_PID, "1")
+	t.Setenv(systemd.ENV_LISTEN_FDS, "1")
+
+	listeners, err := systemd.Listeners()
+	assert.Nil(t, err)
+	assert.Empty(t, listeners)
+}
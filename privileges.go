@@ -0,0 +1,142 @@
+package sacme
+
+import (
+	"fmt"
+	"os/user"
+	"strings"
+
+	"github.com/lucat1/sacme/pkg/file"
+)
+
+// Privileges describes the identity sacme runs as, to tell up front which
+// ownerships can be applied without root.
+type Privileges struct {
+	Uid string
+	// the primary group of the user
+	Gid string
+	// all the groups the user is a member of
+	Gids map[string]bool
+}
+
+func CurrentPrivileges() (p *Privileges, err error) {
+	u, err := user.Current()
+	if err != nil {
+		err = fmt.Errorf("could not find the running user: %w", err)
+		return
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		err = fmt.Errorf("could not list the groups of user %s: %w", u.Username, err)
+		return
+	}
+
+	priv := Privileges{
+		Uid:  u.Uid,
+		Gid:  u.Gid,
+		Gids: map[string]bool{u.Gid: true},
+	}
+	for _, gid := range gids {
+		priv.Gids[gid] = true
+	}
+
+	p = &priv
+	return
+}
+
+func (p Privileges) Root() bool {
+	return p.Uid == "0"
+}
+
+// CanOwn reports whether files can be given to owner and group without
+// privileges: an unprivileged user can only hand its own files to the groups
+// it is a member of.
+func (p Privileges) CanOwn(owner *user.User, group *user.Group) bool {
+	return p.Root() || (owner.Uid == p.Uid && p.Gids[group.Gid])
+}
+
+// CanRunAs reports whether processes can be started as user and group
+// without privileges, which is only possible for the identity sacme runs as.
+func (p Privileges) CanRunAs(u *user.User, g *user.Group) bool {
+	return p.Root() || (u.Uid == p.Uid && g.Gid == p.Gid)
+}
+
+func (p Privileges) checkHooks(hooks []Hook) (problems []string) {
+	for i, hook := range hooks {
+		if hook.User != nil && !p.CanRunAs(hook.User, hook.Group) {
+			problems = append(problems, fmt.Sprintf("hook at position %d cannot run as %s:%s", i, hook.User.Username, hook.Group.Name))
+		}
+	}
+	return
+}
+
+func (p Privileges) checkPathPerm(pp file.PathPerm) (problems []string) {
+	if !p.CanOwn(pp.Owner, pp.Group) {
+		problems = append(problems, fmt.Sprintf("%s cannot be owned by %s:%s", pp.Path, pp.Owner.Username, pp.Group.Name))
+	}
+	if pp.Parents != nil && !p.CanOwn(pp.Parents.Owner, pp.Parents.Group) {
+		problems = append(problems, fmt.Sprintf("parents of %s cannot be owned by %s:%s", pp.Path, pp.Parents.Owner.Username, pp.Parents.Group.Name))
+	}
+	return
+}
+
+// CheckInstall reports all the files and directories of the install whose
+// ownership cannot be set without privileges.
+func (p Privileges) CheckInstall(i Install) (err error) {
+	if problems := p.installProblems(i); len(problems) > 0 {
+		err = fmt.Errorf("%w: %s", RequiresPrivileges, strings.Join(problems, "; "))
+	}
+	return
+}
+
+func (p Privileges) installProblems(i Install) (problems []string) {
+	pps := i.PathPerms()
+	if i.Live != nil {
+		pps = append(pps, i.Live.Dir)
+	}
+	for _, pp := range pps {
+		problems = append(problems, p.checkPathPerm(pp)...)
+	}
+	problems = append(problems, p.checkHooks(i.Hooks)...)
+	if r := i.Reload; r != nil && r.User != nil && !p.CanRunAs(r.User, r.Group) {
+		problems = append(problems, fmt.Sprintf("reload cannot run as %s:%s", r.User.Username, r.Group.Name))
+	}
+	return
+}
+
+// CheckDomain reports all the installs and hooks of the domain, as well as
+// the webroot used for authentication, which cannot be satisfied without
+// privileges.
+func (p Privileges) CheckDomain(d Domain) (err error) {
+	problems := []string{}
+	if d.Authentication.Method == AUTHENTICATION_METHOD_HTTP01_WEBROOT {
+		var pp *file.PathPerm
+		pp, err = webrootPathPerm(d.Authentication.Options)
+		if err != nil {
+			return
+		}
+		problems = append(problems, p.checkPathPerm(*pp)...)
+	}
+	for _, list := range []struct {
+		name  string
+		hooks []Hook
+	}{
+		{"pre_issue", d.Hooks.PreIssue},
+		{"post_issue", d.Hooks.PostIssue},
+		{"on_renew_failure", d.Hooks.OnRenewFailure},
+		{"on_uninstall", d.Hooks.OnUninstall},
+	} {
+		for _, problem := range p.checkHooks(list.hooks) {
+			problems = append(problems, fmt.Sprintf("%s %s", list.name, problem))
+		}
+	}
+	for i, inst := range d.Installs {
+		for _, problem := range p.installProblems(inst) {
+			problems = append(problems, fmt.Sprintf("install at position %d: %s", i, problem))
+		}
+	}
+
+	if len(problems) > 0 {
+		err = fmt.Errorf("%w: %s", RequiresPrivileges, strings.Join(problems, "; "))
+	}
+	return
+}
@@ -0,0 +1,67 @@
+package sacme_test
+
+import (
+	"os/user"
+	"testing"
+
+	"github.com/lucat1/sacme"
+	"github.com/lucat1/sacme/pkg/file"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrivilegesCheckDomain(t *testing.T) {
+	priv := sacme.Privileges{
+		Uid:  "1000",
+		Gid:  "1000",
+		Gids: map[string]bool{"1000": true, "33": true},
+	}
+	sacmeUser := &user.User{Uid: "1000", Username: "sacme"}
+	root := &user.User{Uid: "0", Username: "root"}
+	sslCert := &user.Group{Gid: "33", Name: "ssl-cert"}
+	rootGroup := &user.Group{Gid: "0", Name: "root"}
+
+	// group readable keys for services in a shared group are fine
+	key := &sacme.Target{PathPerm: file.PathPerm{Path: "/ssl/key.pem", Perm: 0640, Owner: sacmeUser, Group: sslCert}}
+	ok := sacme.Install{Key: key}
+	assert.Nil(t, priv.CheckInstall(ok))
+
+	crt := &sacme.Target{PathPerm: file.PathPerm{Path: "/ssl/crt.pem", Perm: 0644, Owner: root, Group: rootGroup}}
+	parents := &sacme.Target{PathPerm: file.PathPerm{
+		Path:    "/ssl/new/ca.pem",
+		Perm:    0644,
+		Owner:   sacmeUser,
+		Group:   sslCert,
+		Parents: &file.Parents{Perm: 0755, Owner: sacmeUser, Group: rootGroup},
+	}}
+	bad := sacme.Install{Key: key, Crt: crt, CA: parents}
+	err := priv.CheckInstall(bad)
+	assert.ErrorIs(t, err, sacme.RequiresPrivileges)
+	assert.Contains(t, err.Error(), "/ssl/crt.pem")
+	assert.Contains(t, err.Error(), "parents of /ssl/new/ca.pem")
+	assert.NotContains(t, err.Error(), "/ssl/key.pem")
+
+	err = priv.CheckDomain(sacme.Domain{Domain: "example.com", Installs: []sacme.Install{ok, bad}})
+	assert.ErrorIs(t, err, sacme.RequiresPrivileges)
+	assert.Contains(t, err.Error(), "install at position 1")
+	assert.NotContains(t, err.Error(), "install at position 0")
+
+	// hooks can only run as the identity sacme runs as
+	own := sacme.Hook{Command: "true", HookContext: sacme.HookContext{User: sacmeUser, Group: &user.Group{Gid: "1000", Name: "sacme"}}}
+	other := sacme.Hook{Command: "true", HookContext: sacme.HookContext{User: sacmeUser, Group: sslCert}}
+	assert.Nil(t, priv.CheckInstall(sacme.Install{Key: key, Hooks: []sacme.Hook{own}}))
+	err = priv.CheckDomain(sacme.Domain{Domain: "example.com", Hooks: sacme.DomainHooks{PostIssue: []sacme.Hook{own, other}}})
+	assert.ErrorIs(t, err, sacme.RequiresPrivileges)
+	assert.Contains(t, err.Error(), "post_issue hook at position 1 cannot run as sacme:ssl-cert")
+
+	// and so can reloads
+	reload := &sacme.Reload{Method: sacme.RELOAD_METHOD_UNIT, Target: "nginx.service", HookContext: other.HookContext}
+	err = priv.CheckDomain(sacme.Domain{Domain: "example.com", Installs: []sacme.Install{{Key: key, Reload: reload}}})
+	assert.ErrorIs(t, err, sacme.RequiresPrivileges)
+	assert.Contains(t, err.Error(), "install at position 0: reload cannot run as sacme:ssl-cert")
+	reload.HookContext = own.HookContext
+	assert.Nil(t, priv.CheckInstall(sacme.Install{Key: key, Reload: reload}))
+
+	priv.Uid = "0"
+	assert.Nil(t, priv.CheckInstall(bad))
+	assert.Nil(t, priv.CheckInstall(sacme.Install{Hooks: []sacme.Hook{other}}))
+}
@@ -0,0 +1,217 @@
+package sacme
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// maximum length of a process name, as reported by the kernel
+const commLength = 15
+
+type ReloadResult struct {
+	// the signalled processes, empty for units
+	Pids []int
+	// the output of systemctl, or of kill for signals sent as another user
+	Output   string
+	Duration time.Duration
+}
+
+// readPidfile returns the pid stored in a pidfile
+func readPidfile(path string) (pid int, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	pid, err = strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || pid <= 0 {
+		err = fmt.Errorf("pidfile %s does not contain a valid pid", path)
+	}
+	return
+}
+
+// findProcesses returns the pids of the processes called name, leaving out
+// those whose parent has the same name
+func findProcesses(name string) (pids []int, err error) {
+	if len(name) > commLength {
+		name = name[:commLength]
+	}
+
+	entries, err := os.ReadDir(PROC_PATH)
+	if err != nil {
+		err = fmt.Errorf("could not list processes: %w", err)
+		return
+	}
+
+	parents := map[int]int{}
+	for _, entry := range entries {
+		pid, perr := strconv.Atoi(entry.Name())
+		if perr != nil {
+			continue
+		}
+		// the process may have exited in the meantime
+		stat, serr := os.ReadFile(filepath.Join(PROC_PATH, entry.Name(), "stat"))
+		if serr != nil {
+			continue
+		}
+		// pid (comm) state ppid ..., where comm may contain spaces and parens
+		start, end := bytes.IndexByte(stat, '('), bytes.LastIndexByte(stat, ')')
+		if start < 0 || end < start {
+			continue
+		}
+		fields := strings.Fields(string(stat[end+1:]))
+		if string(stat[start+1:end]) != name || len(fields) < 2 {
+			continue
+		}
+		parents[pid], _ = strconv.Atoi(fields[1])
+	}
+
+	for pid, ppid := range parents {
+		if _, ok := parents[ppid]; !ok {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return
+}
+
+// Check reports whether the target of the reload exists
+func (r Reload) Check() (err error) {
+	switch r.Method {
+	case RELOAD_METHOD_PIDFILE:
+		var info os.FileInfo
+		info, err = os.Stat(r.Target)
+		if err == nil && !info.Mode().IsRegular() {
+			err = fmt.Errorf("not a regular file")
+		}
+		if err != nil {
+			err = fmt.Errorf("%w: invalid pidfile %s: %v", InvalidReload, r.Target, err)
+		}
+	case RELOAD_METHOD_UNIT:
+		var out []byte
+		out, err = exec.Command(SYSTEMCTL, "show", "--property=LoadState", "--value", "--", r.Target).Output()
+		if err != nil {
+			err = fmt.Errorf("%w: could not query unit %s: %v", InvalidReload, r.Target, err)
+			return
+		}
+		if state := strings.TrimSpace(string(out)); state != "loaded" {
+			err = fmt.Errorf("%w: unit %s is %s", InvalidReload, r.Target, state)
+		}
+	case RELOAD_METHOD_PROCESS:
+		var pids []int
+		pids, err = findProcesses(r.Target)
+		if err == nil && len(pids) <= 0 {
+			err = fmt.Errorf("no such process")
+		}
+		if err != nil {
+			err = fmt.Errorf("%w: invalid process %s: %v", InvalidReload, r.Target, err)
+		}
+	default:
+		err = fmt.Errorf("%w: unknown method %s", InvalidReload, r.Method)
+	}
+	return
+}
+
+// Run reloads the service, either by signalling its processes or through
+// systemd. A systemctl call still running after the timeout is killed.
+func (r Reload) Run() (res ReloadResult, err error) {
+	start := time.Now()
+	defer func() {
+		res.Duration = time.Since(start)
+	}()
+
+	switch r.Method {
+	case RELOAD_METHOD_PIDFILE:
+		var pid int
+		pid, err = readPidfile(r.Target)
+		if err != nil {
+			err = fmt.Errorf("%w: %v", ReloadFailed, err)
+			return
+		}
+		res.Pids = []int{pid}
+	case RELOAD_METHOD_PROCESS:
+		res.Pids, err = findProcesses(r.Target)
+		if err != nil {
+			err = fmt.Errorf("%w: %v", ReloadFailed, err)
+			return
+		}
+		if len(res.Pids) <= 0 {
+			err = fmt.Errorf("%w: no process called %s", ReloadFailed, r.Target)
+			return
+		}
+	case RELOAD_METHOD_UNIT:
+		res.Output, err = r.systemctl()
+		return
+	default:
+		err = fmt.Errorf("%w: unknown method %s", ReloadFailed, r.Method)
+		return
+	}
+
+	if r.User != nil {
+		res.Output, err = r.kill(res.Pids)
+		return
+	}
+	for _, pid := range res.Pids {
+		if kerr := syscall.Kill(pid, r.Signal); kerr != nil {
+			err = fmt.Errorf("%w: could not signal process %d: %v", ReloadFailed, pid, kerr)
+			return
+		}
+	}
+	return
+}
+
+// kill signals the processes from a shell running as the user of the
+// context, so that the kernel checks whether that user may signal them
+func (r Reload) kill(pids []int) (output string, err error) {
+	args := []string{"-c", fmt.Sprintf(`kill -%d "$@"`, int(r.Signal)), "kill"}
+	for _, pid := range pids {
+		args = append(args, strconv.Itoa(pid))
+	}
+	return r.command(DEFAULT_SHELL, args...)
+}
+
+func (r Reload) systemctl() (output string, err error) {
+	return r.command(SYSTEMCTL, "reload", "--", r.Target)
+}
+
+// command runs name as the user of the context, killing it after the timeout
+func (r Reload) command(name string, args ...string) (output string, err error) {
+	var out bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.SysProcAttr, err = r.sysProcAttr()
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ReloadFailed, err)
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		err = fmt.Errorf("%w: could not start %s: %v", ReloadFailed, name, err)
+		return
+	}
+
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(r.Timeout, func() {
+		timedOut.Store(true)
+		cmd.Process.Kill()
+	})
+	err = cmd.Wait()
+	timer.Stop()
+	output = out.String()
+
+	switch {
+	case timedOut.Load():
+		err = fmt.Errorf("%w: %s for %s killed after %s", ReloadFailed, name, r.Target, r.Timeout)
+	case err != nil:
+		err = fmt.Errorf("%w: %s for %s: %v", ReloadFailed, name, r.Target, err)
+	}
+	return
+}
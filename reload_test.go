@@ -0,0 +1,128 @@
+package sacme_test
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lucat1/sacme"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadPidfile(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	assert.Nil(t, cmd.Start())
+	pidfile := filepath.Join(t.TempDir(), "sleep.pid")
+	assert.Nil(t, os.WriteFile(pidfile, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0644))
+
+	reload, err := sacme.ValidateReload(sacme.RawReload{Pidfile: pidfile, Signal: "sigterm"}, "1m", sacme.ON_FAILURE_FAIL, sacme.HookContext{})
+	assert.Nil(t, err)
+	assert.Equal(t, sacme.RELOAD_METHOD_PIDFILE, reload.Method)
+	assert.Equal(t, syscall.SIGTERM, reload.Signal)
+
+	res, err := reload.Run()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{cmd.Process.Pid}, res.Pids)
+	err = cmd.Wait()
+	assert.Equal(t, syscall.SIGTERM, err.(*exec.ExitError).Sys().(syscall.WaitStatus).Signal())
+
+	assert.Nil(t, os.WriteFile(pidfile, []byte("garbage"), 0644))
+	_, err = reload.Run()
+	assert.ErrorIs(t, err, sacme.ReloadFailed)
+}
+
+func TestReloadAsUser(t *testing.T) {
+	current, err := user.Current()
+	assert.Nil(t, err)
+	group, err := user.LookupGroupId(current.Gid)
+	assert.Nil(t, err)
+
+	cmd := exec.Command("sleep", "30")
+	assert.Nil(t, cmd.Start())
+	pidfile := filepath.Join(t.TempDir(), "sleep.pid")
+	assert.Nil(t, os.WriteFile(pidfile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644))
+
+	ctx := sacme.HookContext{User: current, Group: group}
+	reload, err := sacme.ValidateReload(sacme.RawReload{Pidfile: pidfile, Signal: "TERM"}, "1m", sacme.ON_FAILURE_FAIL, ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, ctx, reload.HookContext)
+
+	// the signal is sent by a shell running as the user
+	res, err := reload.Run()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{cmd.Process.Pid}, res.Pids)
+	err = cmd.Wait()
+	assert.Equal(t, syscall.SIGTERM, err.(*exec.ExitError).Sys().(syscall.WaitStatus).Signal())
+
+	// the process is gone
+	_, err = reload.Run()
+	assert.ErrorIs(t, err, sacme.ReloadFailed)
+}
+
+func TestReloadCheck(t *testing.T) {
+	pidfile := filepath.Join(t.TempDir(), "nginx.pid")
+	assert.Nil(t, os.WriteFile(pidfile, []byte("1"), 0644))
+
+	assert.Nil(t, sacme.Reload{Method: sacme.RELOAD_METHOD_PIDFILE, Target: pidfile}.Check())
+	assert.Nil(t, sacme.Reload{Method: sacme.RELOAD_METHOD_PROCESS, Target: filepath.Base(os.Args[0])}.Check())
+	assert.ErrorIs(t, sacme.Reload{Method: sacme.RELOAD_METHOD_PIDFILE, Target: "/sacme/no/such.pid"}.Check(), sacme.InvalidReload)
+	assert.ErrorIs(t, sacme.Reload{Method: sacme.RELOAD_METHOD_PIDFILE, Target: filepath.Dir(pidfile)}.Check(), sacme.InvalidReload)
+	assert.ErrorIs(t, sacme.Reload{Method: sacme.RELOAD_METHOD_PROCESS, Target: "sacme-no-such-process"}.Check(), sacme.InvalidReload)
+}
+
+func TestParseDomainReload(t *testing.T) {
+	rawDomain, _, _ := ValidRawDomain(t)
+	pidfile := filepath.Join(t.TempDir(), "nginx.pid")
+	assert.Nil(t, os.WriteFile(pidfile, []byte("1"), 0644))
+	withReload := func(reload string) []byte {
+		return []byte(strings.Replace(rawDomain, "[installs.key]", "[installs.reload]\n"+reload+"\n\n[installs.key]", 1))
+	}
+
+	d, err := sacme.ParseDomain(withReload(`pidfile = "`+pidfile+`"`), *DefaultConfig(t))
+	assert.Nil(t, err)
+	assert.Equal(t, &sacme.Reload{
+		Method:    sacme.RELOAD_METHOD_PIDFILE,
+		Target:    pidfile,
+		Signal:    syscall.SIGHUP,
+		Timeout:   5 * time.Minute,
+		OnFailure: sacme.DEFAULT_ON_FAILURE,
+	}, d.Installs[0].Reload)
+
+	// the test binary itself is a running process
+	d, err = sacme.ParseDomain(withReload(`process = "`+filepath.Base(os.Args[0])+`"
+signal = "USR1"
+on_failure = "rollback"`), *DefaultConfig(t))
+	assert.Nil(t, err)
+	assert.Equal(t, sacme.RELOAD_METHOD_PROCESS, d.Installs[0].Reload.Method)
+	assert.Equal(t, syscall.SIGUSR1, d.Installs[0].Reload.Signal)
+	assert.Equal(t, sacme.ON_FAILURE_ROLLBACK, d.Installs[0].Reload.OnFailure)
+
+	// targets which do not exist yet are only reported by Check
+	for _, reload := range []string{
+		`pidfile = "/sacme/no/such.pid"`,
+		`process = "sacme-no-such-process"`,
+	} {
+		_, err = sacme.ParseDomain(withReload(reload), *DefaultConfig(t))
+		assert.Nil(t, err, reload)
+	}
+
+	for _, reload := range []string{
+		`pidfile = "relative.pid"`,
+		`pidfile = "` + pidfile + `"
+unit = "nginx.service"`,
+		`pidfile = "` + pidfile + `"
+signal = "KILL"`,
+		`unit = "nginx.service"
+signal = "HUP"`,
+		`signal = "HUP"`,
+	} {
+		_, err = sacme.ParseDomain(withReload(reload), *DefaultConfig(t))
+		assert.ErrorIs(t, err, sacme.InvalidReload, reload)
+	}
+}
@@ -0,0 +1,144 @@
+package sacme
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+type RawRenewal struct {
+	// the elapsed fraction of the validity period after which the
+	// certificate is renewed
+	Fraction float64 `toml:"fraction"`
+	// renew this long before the certificate expires instead
+	BeforeExpiry string `toml:"before_expiry"`
+}
+
+// Renewal is the policy deciding when the certificate of a domain is renewed
+type Renewal struct {
+	Fraction float64
+	// takes precedence over the fraction when set
+	BeforeExpiry time.Duration
+}
+
+// ValidateRenewal parses a RawRenewal into a Renewal struct, renewing after
+// DEFAULT_RENEWAL_FRACTION of the validity period when nothing is set
+func ValidateRenewal(raw RawRenewal) (r *Renewal, err error) {
+	renewal := Renewal{Fraction: DEFAULT_RENEWAL_FRACTION}
+
+	if raw.Fraction != 0 {
+		if raw.Fraction <= 0 || raw.Fraction >= 1 {
+			err = atKey(fmt.Errorf("%w: fraction must be between 0 and 1, got %v", InvalidRenewal, raw.Fraction), "fraction")
+			return
+		}
+		renewal.Fraction = raw.Fraction
+	}
+
+	if len(raw.BeforeExpiry) > 0 {
+		if raw.Fraction != 0 {
+			err = atKey(fmt.Errorf("%w: only one of fraction and before_expiry can be set", InvalidRenewal), "before_expiry")
+			return
+		}
+		renewal.BeforeExpiry, err = time.ParseDuration(raw.BeforeExpiry)
+		if err != nil || renewal.BeforeExpiry <= 0 {
+			err = atKey(fmt.Errorf("%w: invalid before_expiry %s", InvalidRenewal, raw.BeforeExpiry), "before_expiry")
+			return
+		}
+	}
+
+	r = &renewal
+	return
+}
+
+// RenewAt returns when the certificate should be renewed. A certificate
+// whose validity is shorter than BeforeExpiry is due right away.
+func (r Renewal) RenewAt(cert *x509.Certificate) time.Time {
+	return r.renewAt(cert.NotBefore, cert.NotAfter)
+}
+
+func (r Renewal) renewAt(notBefore, notAfter time.Time) time.Time {
+	if r.BeforeExpiry > 0 {
+		at := notAfter.Add(-r.BeforeExpiry)
+		if at.Before(notBefore) {
+			return notBefore
+		}
+		return at
+	}
+	validity := notAfter.Sub(notBefore)
+	return notBefore.Add(time.Duration(float64(validity) * r.Fraction))
+}
+
+// PlannedRenewal is a renewal forecast by a Renewal policy
+type PlannedRenewal struct {
+	At time.Time
+	// when the renewed certificate expires
+	Expires time.Time
+}
+
+// Forecast simulates the policy between from and until for a certificate
+// valid from notBefore to notAfter. Certificates are assumed to be renewed
+// when due, or at from if they are already due, and to be valid for as long
+// as the one they replace.
+func (r Renewal) Forecast(notBefore, notAfter, from, until time.Time) (renewals []PlannedRenewal) {
+	validity := notAfter.Sub(notBefore)
+	for {
+		at := r.renewAt(notBefore, notAfter)
+		if at.Before(from) {
+			at = from
+		}
+		if at.After(until) {
+			return
+		}
+		renewals = append(renewals, PlannedRenewal{At: at, Expires: notAfter})
+		// a policy renewing certificates as soon as they are issued would
+		// never advance the clock
+		if validity <= 0 || !r.renewAt(at, at.Add(validity)).After(at) {
+			return
+		}
+		notBefore, notAfter = at, at.Add(validity)
+	}
+}
+
+// NextRenewal returns when the certificate in the state should be renewed,
+// or the zero time if there is none yet
+func (s *State) NextRenewal(r Renewal) (at time.Time, err error) {
+	if s.ACME.Empty() {
+		return
+	}
+	certificates, err := s.ACME.Certificates()
+	if err != nil {
+		return
+	}
+	at = r.RenewAt(certificates[0])
+	return
+}
+
+// Forecast forecasts the renewals of the certificate in the state between
+// from and until, see Renewal.Forecast. The certificate is returned, or nil
+// if there is none yet.
+func (s *State) Forecast(r Renewal, from, until time.Time) (certificate *x509.Certificate, renewals []PlannedRenewal, err error) {
+	if s.ACME.Empty() {
+		return
+	}
+	certificates, err := s.ACME.Certificates()
+	if err != nil {
+		return
+	}
+	certificate = certificates[0]
+	renewals = r.Forecast(certificate.NotBefore, certificate.NotAfter, from, until)
+	return
+}
+
+// RetryBackoff returns how long to wait before retrying after the given
+// number of consecutive failures, doubling from RETRY_BACKOFF_MIN up to
+// RETRY_BACKOFF_MAX
+func RetryBackoff(failures int) time.Duration {
+	backoff := RETRY_BACKOFF_MIN
+	for i := 1; i < failures && backoff < RETRY_BACKOFF_MAX; i++ {
+		backoff *= 2
+	}
+	if backoff > RETRY_BACKOFF_MAX {
+		backoff = RETRY_BACKOFF_MAX
+	}
+	return backoff
+}
@@ -0,0 +1,95 @@
+package sacme_test
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucat1/sacme"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenewAt(t *testing.T) {
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(90 * 24 * time.Hour)}
+
+	assert.Equal(t, notBefore.Add(45*24*time.Hour), sacme.Renewal{Fraction: 0.5}.RenewAt(cert))
+	assert.Equal(t, notBefore.Add(60*24*time.Hour), sacme.Renewal{Fraction: 0.5, BeforeExpiry: 30 * 24 * time.Hour}.RenewAt(cert))
+	// short lived certificates are due right away rather than in the past
+	assert.Equal(t, notBefore, sacme.Renewal{BeforeExpiry: 100 * 24 * time.Hour}.RenewAt(cert))
+
+	state := IssuedState(t)
+	at, err := state.NextRenewal(sacme.Renewal{Fraction: 0.5})
+	assert.Nil(t, err)
+	certificates, err := state.ACME.Certificates()
+	assert.Nil(t, err)
+	assert.Equal(t, sacme.Renewal{Fraction: 0.5}.RenewAt(certificates[0]), at)
+
+	at, err = (&sacme.State{}).NextRenewal(sacme.Renewal{Fraction: 0.5})
+	assert.Nil(t, err)
+	assert.True(t, at.IsZero())
+}
+
+func TestForecast(t *testing.T) {
+	day := 24 * time.Hour
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := notBefore.Add(90 * day)
+	policy := sacme.Renewal{Fraction: 0.5}
+
+	renewals := policy.Forecast(notBefore, notAfter, notBefore, notBefore.Add(100*day))
+	assert.Equal(t, []sacme.PlannedRenewal{
+		{At: notBefore.Add(45 * day), Expires: notAfter},
+		{At: notBefore.Add(90 * day), Expires: notBefore.Add(135 * day)},
+	}, renewals)
+
+	// certificates already due are renewed right away
+	from := notBefore.Add(100 * day)
+	renewals = policy.Forecast(notBefore, notAfter, from, from.Add(10*day))
+	assert.Equal(t, []sacme.PlannedRenewal{{At: from, Expires: notAfter}}, renewals)
+
+	assert.Empty(t, policy.Forecast(notBefore, notAfter, notBefore, notBefore.Add(44*day)))
+	// a policy renewing on every run is forecast once
+	assert.Len(t, sacme.Renewal{BeforeExpiry: 100 * day}.Forecast(notBefore, notAfter, notBefore, notAfter), 1)
+
+	certificate, renewals, err := (&sacme.State{}).Forecast(policy, notBefore, notAfter)
+	assert.Nil(t, err)
+	assert.Nil(t, certificate)
+	assert.Empty(t, renewals)
+}
+
+func TestParseDomainRenewal(t *testing.T) {
+	rawDomain, _, _ := ValidRawDomain(t)
+	withRenewal := func(renewal string) []byte {
+		return []byte(strings.Replace(rawDomain, "[[installs]]", "[renewal]\n"+renewal+"\n\n[[installs]]", 1))
+	}
+
+	d, err := sacme.ParseDomain([]byte(rawDomain), *DefaultConfig(t))
+	assert.Nil(t, err)
+	assert.Equal(t, sacme.Renewal{Fraction: sacme.DEFAULT_RENEWAL_FRACTION}, d.Renewal)
+
+	d, err = sacme.ParseDomain(withRenewal(`fraction = 0.66`), *DefaultConfig(t))
+	assert.Nil(t, err)
+	assert.Equal(t, sacme.Renewal{Fraction: 0.66}, d.Renewal)
+
+	d, err = sacme.ParseDomain(withRenewal(`before_expiry = "72h"`), *DefaultConfig(t))
+	assert.Nil(t, err)
+	assert.Equal(t, 72*time.Hour, d.Renewal.BeforeExpiry)
+
+	for _, renewal := range []string{
+		`fraction = 1.5`,
+		`fraction = -0.1`,
+		`before_expiry = "soon"`,
+		`before_expiry = "-1h"`,
+		"fraction = 0.5\nbefore_expiry = \"1h\"",
+	} {
+		_, err = sacme.ParseDomain(withRenewal(renewal), *DefaultConfig(t))
+		assert.ErrorIs(t, err, sacme.InvalidRenewal, renewal)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	assert.Equal(t, sacme.RETRY_BACKOFF_MIN, sacme.RetryBackoff(1))
+	assert.Equal(t, 4*sacme.RETRY_BACKOFF_MIN, sacme.RetryBackoff(3))
+	assert.Equal(t, sacme.RETRY_BACKOFF_MAX, sacme.RetryBackoff(100))
+}
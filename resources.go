@@ -0,0 +1,83 @@
+package sacme
+
+import (
+	"sort"
+	"strings"
+)
+
+// Resources returns the exclusive resources the domain uses to obtain its
+// certificate and the paths it installs: domains sharing any of them cannot be
+// processed at the same time.
+func (d Domain) Resources() (resources []string) {
+	auth := d.Authentication
+	switch auth.Method {
+	case AUTHENTICATION_METHOD_HTTP01_STANDALONE:
+		// a listener only serves the tokens of the process it belongs to, and
+		// a wildcard address conflicts with any other on the same port
+		resources = append(resources, "tcp "+auth.Options[AUTHENTICATION_OPTION_PORT])
+	case AUTHENTICATION_METHOD_DNS01_ACMEDNS:
+		// acme-dns only holds one TXT record per subdomain at a time
+		endpoint := strings.TrimSuffix(auth.Options[AUTHENTICATION_OPTION_ENDPOINT], "/")
+		resources = append(resources, string(auth.Method)+" "+endpoint+" "+auth.Options[AUTHENTICATION_OPTION_SUBDOMAIN])
+	}
+	// validate reports paths installed by more than one domain, which would
+	// otherwise be written concurrently
+	for _, inst := range d.Installs {
+		paths := []string{}
+		for path := range installPaths(d, inst) {
+			paths = append(paths, "install "+path)
+		}
+		sort.Strings(paths)
+		resources = append(resources, paths...)
+	}
+	return
+}
+
+// ExclusiveGroups partitions the domains into groups which can be processed
+// concurrently with each other, while the domains within a group share
+// exclusive resources and must be processed one after another. Both groups
+// and their domains keep the order of domains.
+func ExclusiveGroups(domains []Domain) (groups [][]Domain) {
+	// union-find over the indices of the domains
+	parent := make([]int, len(domains))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	owners := map[string]int{}
+	for i, domain := range domains {
+		for _, resource := range domain.Resources() {
+			owner, ok := owners[resource]
+			if !ok {
+				owners[resource] = i
+				continue
+			}
+			// the root is always the first domain of the group
+			a, b := find(owner), find(i)
+			if a > b {
+				a, b = b, a
+			}
+			parent[b] = a
+		}
+	}
+
+	index := map[int]int{}
+	for i, domain := range domains {
+		root := find(i)
+		g, ok := index[root]
+		if !ok {
+			g = len(groups)
+			index[root] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], domain)
+	}
+	return
+}
@@ -0,0 +1,78 @@
+package sacme_test
+
+import (
+	"testing"
+
+	"github.com/lucat1/sacme"
+	"github.com/stretchr/testify/assert"
+)
+
+func acmeDNSDomain(name, endpoint, subdomain string) sacme.Domain {
+	return sacme.Domain{
+		Domain: name,
+		Authentication: sacme.Authentication{
+			Method: sacme.AUTHENTICATION_METHOD_DNS01_ACMEDNS,
+			Options: map[string]string{
+				sacme.AUTHENTICATION_OPTION_ENDPOINT:  endpoint,
+				sacme.AUTHENTICATION_OPTION_SUBDOMAIN: subdomain,
+			},
+		},
+	}
+}
+
+func TestExclusiveGroups(t *testing.T) {
+	other := standaloneDomain("c.example.com")
+	other.Authentication.Options[sacme.AUTHENTICATION_OPTION_PORT] = "8080"
+	bound := standaloneDomain("h.example.com")
+	bound.Authentication.Options[sacme.AUTHENTICATION_OPTION_INTERFACE] = ""
+	webroot := sacme.Domain{
+		Domain:         "e.example.com",
+		Authentication: sacme.Authentication{Method: sacme.AUTHENTICATION_METHOD_HTTP01_WEBROOT},
+	}
+	domains := []sacme.Domain{
+		standaloneDomain("a.example.com"),
+		acmeDNSDomain("b.example.com", "https://auth.acme-dns.io/", "sub"),
+		other,
+		standaloneDomain("d.example.com"),
+		webroot,
+		acmeDNSDomain("f.example.com", "https://auth.acme-dns.io", "sub"),
+		acmeDNSDomain("g.example.com", "https://auth.acme-dns.io", "other"),
+		bound,
+	}
+
+	names := [][]string{}
+	for _, group := range sacme.ExclusiveGroups(domains) {
+		g := []string{}
+		for _, domain := range group {
+			g = append(g, domain.Domain)
+		}
+		names = append(names, g)
+	}
+	assert.Equal(t, [][]string{
+		{"a.example.com", "d.example.com", "h.example.com"},
+		{"b.example.com", "f.example.com"},
+		{"c.example.com"},
+		{"e.example.com"},
+		{"g.example.com"},
+	}, names)
+
+	assert.Empty(t, sacme.ExclusiveGroups(nil))
+}
+
+func TestExclusiveGroupsInstalls(t *testing.T) {
+	shared := func(name, path string) sacme.Domain {
+		d := sacme.Domain{Domain: name, Authentication: sacme.Authentication{Method: sacme.AUTHENTICATION_METHOD_HTTP01_WEBROOT}}
+		d.Installs = []sacme.Install{{Crt: currentTarget(t, path, sacme.FORMAT_PEM)}}
+		return d
+	}
+	domains := []sacme.Domain{
+		shared("a.example.com", "/ssl/shared.crt"),
+		shared("b.example.com", "/ssl/{domain}.crt"),
+		shared("c.example.com", "/ssl/./shared.crt"),
+		shared("d.example.com", "/ssl/{domain}.crt"),
+	}
+
+	groups := sacme.ExclusiveGroups(domains)
+	assert.Len(t, groups, 3)
+	assert.Equal(t, []sacme.Domain{domains[0], domains[2]}, groups[0])
+}
@@ -1,9 +1,9 @@
 let
   pkgs = import (builtins.fetchTarball {
-    url = "https://github.com/NixOS/nixpkgs/archive/7a339d87931bba829f68e94621536cad9132971a.tar.gz";
+    url = "https://github.com/NixOS/nixpkgs/archive/nixos-24.05.tar.gz";
   }) {};
 in pkgs.mkShell {
   packages = with pkgs; [
-    go_1_19
+    go_1_22
   ];
 }
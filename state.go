@@ -7,6 +7,7 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"golang.org/x/exp/slog"
 	"io"
@@ -139,6 +140,97 @@ func (state ACMEState) Certificates() (certs []*x509.Certificate, err error) {
 	return
 }
 
+// Chain returns the parsed private key, the leaf certificate and its issuer
+// chain. When the certificate bundle lacks the chain, the issuer certificate is
+// used instead.
+func (state ACMEState) Chain() (key crypto.PrivateKey, leaf *x509.Certificate, chain []*x509.Certificate, err error) {
+	certs, err := state.Certificates()
+	if err != nil {
+		return
+	}
+	leaf, chain = certs[0], certs[1:]
+
+	if len(chain) <= 0 && len(state.IssuerCertificate) > 0 {
+		chain, err = certcrypto.ParsePEMBundle(state.IssuerCertificate)
+		if err != nil {
+			err = fmt.Errorf("could not parse issuer certificate as x509: %w", err)
+			return
+		}
+	}
+
+	key, err = certcrypto.ParsePEMPrivateKey(state.PrivateKey)
+	if err != nil {
+		err = fmt.Errorf("could not parse private key: %w", err)
+		return
+	}
+
+	return
+}
+
+// Part returns the PEM encoded content of a certificate part:
+//   - key: the private key
+//   - crt: the certificate as returned by the CA (leaf and chain, as we bundle)
+//   - ca: the issuer certificate
+//   - leaf: only the leaf certificate
+//   - chain: only the issuer chain, without the leaf
+//   - fullchain: the leaf certificate followed by the issuer chain
+func (state ACMEState) Part(part InstallPart) (content []byte, err error) {
+	switch part {
+	case INSTALL_PART_KEY:
+		content = state.PrivateKey
+		return
+	case INSTALL_PART_CRT:
+		content = state.Certificate
+		return
+	case INSTALL_PART_CA:
+		content = state.IssuerCertificate
+		return
+	case INSTALL_PART_LEAF, INSTALL_PART_CHAIN, INSTALL_PART_FULLCHAIN:
+	default:
+		err = fmt.Errorf("%w: %s", InvalidPart, part)
+		return
+	}
+
+	_, leaf, chain, err := state.Chain()
+	if err != nil {
+		return
+	}
+	switch part {
+	case INSTALL_PART_LEAF:
+		content = pemCertificates(leaf)
+	case INSTALL_PART_CHAIN:
+		content = pemCertificates(chain...)
+	case INSTALL_PART_FULLCHAIN:
+		content = pemCertificates(append([]*x509.Certificate{leaf}, chain...)...)
+	}
+	return
+}
+
+// Placeholders returns the values for the placeholders in install paths,
+// computed from the current certificate
+func (state ACMEState) Placeholders() (placeholders map[string]string, err error) {
+	certs, err := state.Certificates()
+	if err != nil {
+		return
+	}
+	leaf := certs[0]
+
+	placeholders = map[string]string{
+		PLACEHOLDER_DOMAIN:     state.Domain,
+		PLACEHOLDER_SERIAL:     fmt.Sprintf("%x", leaf.SerialNumber),
+		PLACEHOLDER_NOT_BEFORE: leaf.NotBefore.UTC().Format(PLACEHOLDER_TIME_FORMAT),
+		PLACEHOLDER_NOT_AFTER:  leaf.NotAfter.UTC().Format(PLACEHOLDER_TIME_FORMAT),
+	}
+	return
+}
+
+func pemCertificates(certs ...*x509.Certificate) (content []byte) {
+	for _, cert := range certs {
+		content = append(content, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return
+}
+
 type PathPermState struct {
 	Path string
 	Perm uint32
@@ -149,15 +241,131 @@ type PathPermState struct {
 }
 
 func (p1 PathPermState) Equals(p2 PathPermState) bool {
-	fmt.Println("checking for equality!")
-	return false
+	return p1 == p2
+}
+
+type TargetState struct {
+	PathPermState
+	// States saved before formats were configurable lack this field, and
+	// were installed as PEM
+	Format Format
+}
+
+func (t1 TargetState) Equals(t2 TargetState) bool {
+	f1, f2 := t1.Format, t2.Format
+	if len(f1) <= 0 {
+		f1 = FORMAT_PEM
+	}
+	if len(f2) <= 0 {
+		f2 = FORMAT_PEM
+	}
+	return f1 == f2 && t1.PathPermState.Equals(t2.PathPermState)
+}
+
+type ConcatState struct {
+	TargetState
+	// States saved before parts were configurable lack this field, and were
+	// installed with the default parts
+	Parts []InstallPart
+}
+
+func (c1 ConcatState) Equals(c2 ConcatState) bool {
+	p1, p2 := c1.Parts, c2.Parts
+	if p1 == nil {
+		p1 = DEFAULT_CONCAT_PARTS
+	}
+	if p2 == nil {
+		p2 = DEFAULT_CONCAT_PARTS
+	}
+	if len(p1) != len(p2) {
+		return false
+	}
+	for i := range p1 {
+		if p1[i] != p2[i] {
+			return false
+		}
+	}
+	return c1.TargetState.Equals(c2.TargetState)
+}
+
+type KeystoreState struct {
+	PathPermState
+	Alias string
+	// salted PBKDF2 digest of the password, used to detect password changes
+	// without storing the password itself
+	PasswordSalt   string
+	PasswordDigest string
+}
+
+func (k1 KeystoreState) Equals(k2 KeystoreState) bool {
+	return k1 == k2
 }
 
 type InstallState struct {
-	Key    *PathPermState
-	Crt    *PathPermState
-	CA     *PathPermState
-	Concat *PathPermState
+	Key       *TargetState
+	Crt       *TargetState
+	CA        *TargetState
+	Leaf      *TargetState
+	Chain     *TargetState
+	Fullchain *TargetState
+	Concat    *ConcatState
+	PKCS12    *KeystoreState
+	JKS       *KeystoreState
+
+	// For versioned installs, the directory holding this version of the
+	// files and the symlink pointing to it
+	Dir  *PathPermState
+	Link string
+	// Previous versions of a versioned install, newest first. Archived
+	// versions have no Link and no Archive of their own.
+	Archive []InstallState
+
+	// Parent directories created by sacme, from the outermost to the
+	// innermost. They are not considered when comparing installs.
+	Dirs []string
+	// The serial of the certificate in the files, empty in states saved
+	// before it was recorded, whose files are then compared with the
+	// certificate instead. It is not considered when comparing installs.
+	Serial string
+}
+
+// Paths returns the paths of all the files installed
+func (i InstallState) Paths() (paths []string) {
+	for _, pp := range []*TargetState{i.Key, i.Crt, i.CA, i.Leaf, i.Chain, i.Fullchain} {
+		if pp != nil {
+			paths = append(paths, pp.Path)
+		}
+	}
+	if i.Concat != nil {
+		paths = append(paths, i.Concat.Path)
+	}
+	for _, ks := range []*KeystoreState{i.PKCS12, i.JKS} {
+		if ks != nil {
+			paths = append(paths, ks.Path)
+		}
+	}
+	return
+}
+
+func (i1 InstallState) Equals(i2 InstallState) bool {
+	return equalStates(i1.Key, i2.Key) &&
+		equalStates(i1.Crt, i2.Crt) &&
+		equalStates(i1.CA, i2.CA) &&
+		equalStates(i1.Leaf, i2.Leaf) &&
+		equalStates(i1.Chain, i2.Chain) &&
+		equalStates(i1.Fullchain, i2.Fullchain) &&
+		equalStates(i1.Concat, i2.Concat) &&
+		equalStates(i1.PKCS12, i2.PKCS12) &&
+		equalStates(i1.JKS, i2.JKS) &&
+		equalStates(i1.Dir, i2.Dir) &&
+		i1.Link == i2.Link
+}
+
+func equalStates[T interface{ Equals(T) bool }](s1, s2 *T) bool {
+	if s1 == nil || s2 == nil {
+		return s1 == s2
+	}
+	return (*s1).Equals(*s2)
 }
 
 // State holds the account/acme/installation state for a domain
@@ -0,0 +1,410 @@
+package sacme
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/lucat1/sacme/pkg/file"
+	fs "github.com/spf13/afero"
+)
+
+// CertificateStatus describes the certificate issued for a domain
+type CertificateStatus struct {
+	SANs        []string  `json:"sans"`
+	Issuer      string    `json:"issuer"`
+	Serial      string    `json:"serial"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	DaysLeft    int       `json:"days_left"`
+	NextRenewal time.Time `json:"next_renewal"`
+}
+
+// FileStatus tells whether an installed file matches what sacme installed
+type FileStatus struct {
+	Path   string `json:"path"`
+	InSync bool   `json:"in_sync"`
+	// why the file is not in sync
+	Problem string `json:"problem,omitempty"`
+}
+
+// DomainStatus describes what sacme manages for a domain
+type DomainStatus struct {
+	Domain    string `json:"domain"`
+	Email     string `json:"email"`
+	Directory string `json:"directory"`
+	// the URI of the registered account, if any
+	Account string `json:"account,omitempty"`
+	// nil if no certificate has been issued yet
+	Certificate *CertificateStatus `json:"certificate"`
+	Files       []FileStatus       `json:"files"`
+	// whether all installed files are in sync
+	InSync bool `json:"in_sync"`
+	// the effective definition, only when requested
+	Config *DomainConfig `json:"config,omitempty"`
+}
+
+// Status describes the certificate in the state and checks the installed
+// files on f
+func (s *State) Status(domain Domain, f fs.Fs, now time.Time) (ds *DomainStatus, err error) {
+	status := DomainStatus{
+		Domain:    domain.Domain,
+		Email:     domain.Account.Email,
+		Directory: domain.Account.Directroy.String(),
+		Files:     []FileStatus{},
+		InSync:    true,
+	}
+	if s.IsRegistered() {
+		status.Account = s.Account.Registration.URI
+	}
+
+	if !s.ACME.Empty() {
+		var certificates []*x509.Certificate
+		certificates, err = s.ACME.Certificates()
+		if err != nil {
+			return
+		}
+		leaf := certificates[0]
+		sans := append([]string{}, leaf.DNSNames...)
+		for _, ip := range leaf.IPAddresses {
+			sans = append(sans, ip.String())
+		}
+		status.Certificate = &CertificateStatus{
+			SANs:        sans,
+			Issuer:      leaf.Issuer.String(),
+			Serial:      fmt.Sprintf("%x", leaf.SerialNumber),
+			NotBefore:   leaf.NotBefore,
+			NotAfter:    leaf.NotAfter,
+			DaysLeft:    int(leaf.NotAfter.Sub(now).Hours() / 24),
+			NextRenewal: domain.Renewal.RenewAt(leaf),
+		}
+	}
+
+	for _, i := range s.Installs {
+		for _, file := range i.Check(f, s.ACME) {
+			status.InSync = status.InSync && file.InSync
+			status.Files = append(status.Files, file)
+		}
+	}
+
+	ds = &status
+	return
+}
+
+// Check compares the files of the install, except for archived versions, with
+// what installing the certificate in acme writes. The content of keystores is
+// not reproducible, so only their metadata is compared.
+func (i InstallState) Check(f fs.Fs, acme ACMEState) (files []FileStatus) {
+	stale := ""
+	if placeholders, err := acme.Placeholders(); err != nil {
+		stale = "there is no valid certificate"
+	} else if len(i.Serial) <= 0 && !i.Holds(f, acme) {
+		stale = "written for another certificate"
+	} else if len(i.Serial) > 0 && i.Serial != placeholders[PLACEHOLDER_SERIAL] {
+		stale = fmt.Sprintf("written for certificate %s", i.Serial)
+	}
+
+	for _, pt := range i.contentTargets() {
+		files = append(files, checkTarget(f, pt.target, acme, pt.parts...))
+	}
+	for _, ks := range []*KeystoreState{i.PKCS12, i.JKS} {
+		if ks == nil {
+			continue
+		}
+		file := checkFile(f, ks.PathPermState, nil)
+		if file.InSync && len(stale) > 0 {
+			file.InSync, file.Problem = false, stale
+		}
+		files = append(files, file)
+	}
+
+	if len(i.Link) > 0 && i.Dir != nil {
+		file := FileStatus{Path: i.Link}
+		link, err := f.Stat(i.Link)
+		var dir os.FileInfo
+		if err == nil {
+			dir, err = f.Stat(i.Dir.Path)
+		}
+		if os.IsNotExist(err) {
+			file.Problem = "missing"
+		} else if err != nil {
+			file.Problem = fmt.Sprintf("cannot stat: %v", err)
+		} else if !os.SameFile(link, dir) {
+			file.Problem = fmt.Sprintf("does not point to %s", i.Dir.Path)
+		} else {
+			file.InSync = true
+		}
+		files = append(files, file)
+	}
+	return
+}
+
+// checkTarget compares a file with the concatenation of the parts in the
+// format of the target
+type contentTarget struct {
+	target TargetState
+	parts  []InstallPart
+}
+
+// contentTargets lists the files of the install whose content follows from
+// the certificate, i.e. all but the keystores
+func (i InstallState) contentTargets() (targets []contentTarget) {
+	for _, pt := range []struct {
+		part   InstallPart
+		target *TargetState
+	}{
+		{INSTALL_PART_KEY, i.Key},
+		{INSTALL_PART_CRT, i.Crt},
+		{INSTALL_PART_CA, i.CA},
+		{INSTALL_PART_LEAF, i.Leaf},
+		{INSTALL_PART_CHAIN, i.Chain},
+		{INSTALL_PART_FULLCHAIN, i.Fullchain},
+	} {
+		if pt.target != nil {
+			targets = append(targets, contentTarget{*pt.target, []InstallPart{pt.part}})
+		}
+	}
+	if i.Concat != nil {
+		parts := i.Concat.Parts
+		if parts == nil {
+			parts = DEFAULT_CONCAT_PARTS
+		}
+		targets = append(targets, contentTarget{i.Concat.TargetState, parts})
+	}
+	return
+}
+
+// Holds reports whether the files of the install hold the certificate in
+// acme, telling which certificate an install saved without its serial was
+// written with. Keystores are salted and cannot be compared, so they are
+// assumed to hold the same certificate as the other files of the install.
+func (i InstallState) Holds(f fs.Fs, acme ACMEState) bool {
+	for _, ct := range i.contentTargets() {
+		expected, err := targetContent(ct.target, acme, ct.parts...)
+		if err != nil {
+			return false
+		}
+		content, err := fs.ReadFile(f, ct.target.Path)
+		if err != nil || !bytes.Equal(content, expected) {
+			return false
+		}
+	}
+	return true
+}
+
+// targetContent returns the content a target holds for the certificate
+func targetContent(target TargetState, acme ACMEState, parts ...InstallPart) (content []byte, err error) {
+	format := target.Format
+	if len(format) <= 0 {
+		format = FORMAT_PEM
+	}
+
+	for _, part := range parts {
+		var p []byte
+		if p, err = acme.Part(part); err != nil {
+			return
+		}
+		content = append(content, p...)
+	}
+	return Transcode(content, format)
+}
+
+func checkTarget(f fs.Fs, target TargetState, acme ACMEState, parts ...InstallPart) FileStatus {
+	expected, err := targetContent(target, acme, parts...)
+	if err != nil {
+		return FileStatus{Path: target.Path, Problem: fmt.Sprintf("cannot compute the expected content: %v", err)}
+	}
+	return checkFile(f, target.PathPermState, expected)
+}
+
+// checkFile compares the metadata of a file and, unless expected is nil, its
+// content
+func checkFile(f fs.Fs, pp PathPermState, expected []byte) (file FileStatus) {
+	file.Path = pp.Path
+	info, err := f.Stat(pp.Path)
+	if os.IsNotExist(err) {
+		file.Problem = "missing"
+		return
+	}
+	if err != nil {
+		file.Problem = fmt.Sprintf("cannot stat: %v", err)
+		return
+	}
+
+	if perm := os.FileMode(pp.Perm).Perm(); info.Mode().Perm() != perm {
+		file.Problem = fmt.Sprintf("mode is %04o instead of %04o", info.Mode().Perm(), perm)
+		return
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if uid := strconv.Itoa(int(st.Uid)); len(pp.Owner) > 0 && uid != pp.Owner {
+			file.Problem = fmt.Sprintf("owner is %s instead of %s", uid, pp.Owner)
+			return
+		}
+		if gid := strconv.Itoa(int(st.Gid)); len(pp.Group) > 0 && gid != pp.Group {
+			file.Problem = fmt.Sprintf("group is %s instead of %s", gid, pp.Group)
+			return
+		}
+	}
+
+	if expected != nil {
+		content, err := fs.ReadFile(f, pp.Path)
+		if err != nil {
+			file.Problem = fmt.Sprintf("cannot read: %v", err)
+			return
+		}
+		if !bytes.Equal(content, expected) {
+			file.Problem = "content differs from the certificate"
+			return
+		}
+	}
+
+	file.InSync = true
+	return
+}
+
+// HookContextConfig describes how a hook or a reload runs. Env is null when
+// the hooks get the whole environment of sacme.
+type HookContextConfig struct {
+	User  string   `json:"hook_user,omitempty"`
+	Group string   `json:"hook_group,omitempty"`
+	Dir   string   `json:"hook_dir,omitempty"`
+	Env   []string `json:"hook_env"`
+}
+
+// HookConfig describes a hook with the defaults of its domain applied
+type HookConfig struct {
+	Command   string    `json:"command"`
+	Timeout   string    `json:"timeout"`
+	OnFailure OnFailure `json:"on_failure"`
+	Deferred  bool      `json:"deferred,omitempty"`
+	HookContextConfig
+}
+
+// FileConfig describes a file or directory written by an install
+type FileConfig struct {
+	Path  string `json:"path"`
+	Mode  string `json:"mode"`
+	Owner string `json:"owner,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+// InstallConfig describes an install with the defaults applied
+type InstallConfig struct {
+	Files []FileConfig `json:"files"`
+	// the versioned directory and its link, if any
+	Dir    *FileConfig  `json:"dir,omitempty"`
+	Link   string       `json:"link,omitempty"`
+	Hooks  []HookConfig `json:"hooks"`
+	Reload string       `json:"reload,omitempty"`
+	// who the reload runs as, when not sacme
+	ReloadUser  string `json:"reload_user,omitempty"`
+	ReloadGroup string `json:"reload_group,omitempty"`
+}
+
+// DomainConfig is the effective definition of a domain, after the defaults
+// of the global config have been merged under its values. Secrets are
+// redacted.
+type DomainConfig struct {
+	Email          string         `json:"email"`
+	KeyType        KeyType        `json:"key_type"`
+	AcceptTOS      bool           `json:"accept_tos"`
+	Directory      string         `json:"directory"`
+	Authentication Authentication `json:"authentication"`
+	// only one of the two is set, as in the renewal section
+	RenewalFraction     float64 `json:"renewal_fraction,omitempty"`
+	RenewalBeforeExpiry string  `json:"renewal_before_expiry,omitempty"`
+	// the domain hooks, by the name of their list
+	Hooks    map[string][]HookConfig `json:"hooks"`
+	Installs []InstallConfig         `json:"installs"`
+}
+
+// Config describes the effective definition of the domain
+func (d Domain) Config() DomainConfig {
+	config := DomainConfig{
+		Email:     d.Account.Email,
+		KeyType:   d.Account.KeyType,
+		AcceptTOS: d.Account.AcceptTOS,
+		Directory: d.Account.Directroy.String(),
+		Authentication: Authentication{
+			Method:  d.Authentication.Method,
+			Options: map[string]string{},
+		},
+		Hooks: map[string][]HookConfig{
+			"pre_issue":        hookConfigs(d.Hooks.PreIssue),
+			"post_issue":       hookConfigs(d.Hooks.PostIssue),
+			"on_renew_failure": hookConfigs(d.Hooks.OnRenewFailure),
+			"on_uninstall":     hookConfigs(d.Hooks.OnUninstall),
+		},
+		Installs: []InstallConfig{},
+	}
+	for key, val := range d.Authentication.Options {
+		if key == AUTHENTICATION_OPTION_PASSWORD && len(val) > 0 {
+			val = REDACTED_VALUE
+		}
+		config.Authentication.Options[key] = val
+	}
+	if d.Renewal.BeforeExpiry > 0 {
+		config.RenewalBeforeExpiry = d.Renewal.BeforeExpiry.String()
+	} else {
+		config.RenewalFraction = d.Renewal.Fraction
+	}
+
+	for _, i := range d.Installs {
+		install := InstallConfig{Files: []FileConfig{}, Hooks: hookConfigs(i.Hooks)}
+		for _, pp := range i.PathPerms() {
+			install.Files = append(install.Files, fileConfig(pp))
+		}
+		if i.Live != nil {
+			dir := fileConfig(i.Live.Dir)
+			install.Dir, install.Link = &dir, i.Live.Link
+		}
+		if i.Reload != nil {
+			install.Reload = fmt.Sprintf("%s %s", i.Reload.Method, i.Reload.Target)
+			if i.Reload.User != nil {
+				install.ReloadUser, install.ReloadGroup = i.Reload.User.Username, i.Reload.Group.Name
+			}
+		}
+		config.Installs = append(config.Installs, install)
+	}
+	return config
+}
+
+func hookConfigs(hooks []Hook) []HookConfig {
+	configs := []HookConfig{}
+	for _, hook := range hooks {
+		configs = append(configs, HookConfig{
+			Command:           hook.Command,
+			Timeout:           hook.Timeout.String(),
+			OnFailure:         hook.OnFailure,
+			Deferred:          hook.Deferred,
+			HookContextConfig: hookContextConfig(hook.HookContext),
+		})
+	}
+	return configs
+}
+
+func hookContextConfig(ctx HookContext) HookContextConfig {
+	config := HookContextConfig{Dir: ctx.Dir, Env: ctx.Env}
+	if ctx.User != nil {
+		config.User, config.Group = ctx.User.Username, ctx.Group.Name
+	}
+	return config
+}
+
+func fileConfig(pp file.PathPerm) FileConfig {
+	config := FileConfig{
+		Path: pp.Path,
+		Mode: fmt.Sprintf("%04o", os.FileMode(pp.Perm).Perm()),
+	}
+	if pp.Owner != nil {
+		config.Owner = pp.Owner.Username
+	}
+	if pp.Group != nil {
+		config.Group = pp.Group.Name
+	}
+	return config
+}
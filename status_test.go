@@ -0,0 +1,142 @@
+package sacme_test
+
+import (
+	"fmt"
+	"os/user"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucat1/sacme"
+	fs "github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatus(t *testing.T) {
+	rawDomain, _, _ := ValidRawDomain(t)
+	domain, err := sacme.ParseDomain([]byte(rawDomain), *DefaultConfig(t))
+	assert.Nil(t, err)
+
+	f := fs.NewBasePathFs(fs.NewOsFs(), t.TempDir())
+	dir := currentPathPerm(t, "/{serial}")
+	dir.Perm = 0755
+	inst := sacme.Install{
+		Key:    currentTarget(t, "/{serial}/privkey.pem", sacme.FORMAT_PEM),
+		Leaf:   currentTarget(t, "/{serial}/cert.der", sacme.FORMAT_DER),
+		Concat: &sacme.Concat{Target: *currentTarget(t, "/{serial}/bundle.pem", sacme.FORMAT_PEM), Parts: sacme.DEFAULT_CONCAT_PARTS},
+		PKCS12: &sacme.Keystore{PathPerm: currentPathPerm(t, "/{serial}/bundle.p12"), Password: "changeit"},
+		Live:   &sacme.Live{Dir: dir, Link: "/live"},
+	}
+
+	state := IssuedState(t)
+	placeholders, err := state.ACME.Placeholders()
+	assert.Nil(t, err)
+	is, err := inst.Resolve(placeholders).Install(f, state)
+	assert.Nil(t, err)
+	state.Installs = []sacme.InstallState{*is}
+
+	status, err := state.Status(*domain, f, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, "example.com", status.Domain)
+	assert.NotNil(t, status.Certificate)
+	assert.Equal(t, []string{"example.com"}, status.Certificate.SANs)
+	assert.Equal(t, placeholders[sacme.PLACEHOLDER_SERIAL], status.Certificate.Serial)
+	assert.Equal(t, "CN=sacme test CA", status.Certificate.Issuer)
+	assert.Equal(t, 0, status.Certificate.DaysLeft)
+	assert.Len(t, status.Files, 5)
+	assert.True(t, status.InSync, status.Files)
+
+	// the files of older states, which did not record the serial, are
+	// compared with the certificate
+	legacy := *is
+	legacy.Serial = ""
+	assert.True(t, legacy.Holds(f, state.ACME))
+	for _, file := range legacy.Check(f, state.ACME) {
+		assert.True(t, file.InSync, file.Path)
+	}
+
+	serial := placeholders[sacme.PLACEHOLDER_SERIAL]
+	assert.Nil(t, fs.WriteFile(f, "/"+serial+"/privkey.pem", []byte("tampered"), 0600))
+	assert.Nil(t, f.Chmod("/"+serial+"/cert.der", 0644))
+	assert.Nil(t, f.Remove("/"+serial+"/bundle.pem"))
+	problems := map[string]string{}
+	for _, file := range is.Check(f, state.ACME) {
+		problems[file.Path] = file.Problem
+		assert.Equal(t, len(file.Problem) <= 0, file.InSync)
+	}
+	assert.Equal(t, map[string]string{
+		"/" + serial + "/privkey.pem": "content differs from the certificate",
+		"/" + serial + "/cert.der":    "mode is 0644 instead of 0600",
+		"/" + serial + "/bundle.pem":  "missing",
+		"/" + serial + "/bundle.p12":  "",
+		"/live":                       "",
+	}, problems)
+
+	// so the keystores of older states are out of sync once the others are
+	assert.False(t, legacy.Holds(f, state.ACME))
+	for _, file := range legacy.Check(f, state.ACME) {
+		if file.Path == "/"+serial+"/bundle.p12" {
+			assert.Equal(t, "written for another certificate", file.Problem)
+		}
+	}
+
+	// keystores are out of sync once the certificate changes
+	renewed := IssuedState(t)
+	for _, file := range is.Check(f, renewed.ACME) {
+		assert.False(t, file.InSync && file.Path != "/live", file.Path)
+	}
+
+	status, err = (&sacme.State{}).Status(*domain, f, time.Now())
+	assert.Nil(t, err)
+	assert.Nil(t, status.Certificate)
+	assert.Empty(t, status.Files)
+	assert.True(t, status.InSync)
+}
+
+func TestDomainConfig(t *testing.T) {
+	rawDomain, u, g := ValidRawDomain(t)
+	rawDomain += `
+[authentication]
+method = "dns-01/acmedns"
+options = { username = "user", password = "secret", subdomain = "sub" }
+`
+	domain, err := sacme.ParseDomain([]byte(rawDomain), *DefaultConfig(t))
+	assert.Nil(t, err)
+
+	config := domain.Config()
+	assert.Equal(t, "root@example.com", config.Email)
+	assert.Equal(t, sacme.DEFAULT_DIRECTORY, config.Directory)
+	assert.Equal(t, sacme.REDACTED_VALUE, config.Authentication.Options[sacme.AUTHENTICATION_OPTION_PASSWORD])
+	assert.Equal(t, "secret", domain.Authentication.Options[sacme.AUTHENTICATION_OPTION_PASSWORD])
+	assert.Equal(t, sacme.DEFAULT_RENEWAL_FRACTION, config.RenewalFraction)
+	assert.Empty(t, config.Hooks["pre_issue"])
+	assert.Len(t, config.Installs, 1)
+	assert.Equal(t, []sacme.FileConfig{
+		{Path: "/test/path.key", Mode: "0600", Owner: u.Username, Group: g.Name},
+		{Path: "/test/path.crt", Mode: "0644", Owner: u.Username, Group: g.Name},
+	}, config.Installs[0].Files)
+	assert.Equal(t, "true", config.Installs[0].Hooks[0].Command)
+	assert.Equal(t, sacme.HookContextConfig{}, config.Installs[0].Hooks[0].HookContextConfig)
+	assert.Empty(t, config.Installs[0].ReloadUser)
+
+	// the hook context is inherited from the domain by the hooks and the
+	// reload of its installs
+	rawDomain = strings.Replace(rawDomain, "[[installs]]", fmt.Sprintf(`[hooks]
+hook_user = "%s"
+hook_dir = "/srv"
+hook_env = ["PATH"]
+pre_issue = ["true"]
+
+[[installs]]
+reload = { unit = "nginx.service" }`, u.Username), 1)
+	domain, err = sacme.ParseDomain([]byte(rawDomain), *DefaultConfig(t))
+	assert.Nil(t, err)
+	config = domain.Config()
+	group, err := user.LookupGroupId(u.Gid)
+	assert.Nil(t, err)
+	ctx := sacme.HookContextConfig{User: u.Username, Group: group.Name, Dir: "/srv", Env: []string{"PATH"}}
+	assert.Equal(t, ctx, config.Hooks["pre_issue"][0].HookContextConfig)
+	assert.Equal(t, ctx, config.Installs[0].Hooks[0].HookContextConfig)
+	assert.Equal(t, u.Username, config.Installs[0].ReloadUser)
+	assert.Equal(t, group.Name, config.Installs[0].ReloadGroup)
+}
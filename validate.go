@@ -0,0 +1,379 @@
+package sacme
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// KeyError attributes an error to a key of a TOML definition, relative to the
+// key of the KeyError wrapping it, if any
+type KeyError struct {
+	Key []string
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+func atKey(err error, key ...string) error {
+	return &KeyError{Key: key, Err: err}
+}
+
+// ErrorKey returns the full key an error is attributed to, or nil
+func ErrorKey(err error) (key []string) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if ke, ok := err.(*KeyError); ok {
+			key = append(key, ke.Key...)
+		}
+	}
+	return
+}
+
+// Diagnostic is a problem found in a definition file. Line and Column are
+// zero when the problem cannot be tied to a position in the file. Warnings
+// depend on the state of the system and do not make the definition invalid.
+type Diagnostic struct {
+	File    string
+	Line    int
+	Column  int
+	Err     error
+	Warning bool
+}
+
+func (d Diagnostic) Error() string {
+	err := d.Err.Error()
+	if d.Warning {
+		err = "warning: " + err
+	}
+	if d.Line <= 0 {
+		return fmt.Sprintf("%s: %s", d.File, err)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, err)
+}
+
+func (d Diagnostic) Unwrap() error {
+	return d.Err
+}
+
+// positions maps the dotted keys of a TOML document, with the index of array
+// tables and array elements, to where they are defined
+type positions map[string]unstable.Position
+
+func indexPositions(data []byte) positions {
+	pos := positions{}
+	arrays := map[string]int{}
+	// resolve inserts the current index after the keys of array tables
+	resolve := func(keys []string) (path []string) {
+		for _, key := range keys {
+			path = append(path, key)
+			if n, ok := arrays[strings.Join(path, ".")]; ok {
+				path = append(path, strconv.Itoa(n-1))
+			}
+		}
+		return
+	}
+
+	p := unstable.Parser{}
+	p.Reset(data)
+	table := []string{}
+	for p.NextExpression() {
+		e := p.Expression()
+		switch e.Kind {
+		case unstable.Table, unstable.ArrayTable:
+			keys, starts := keyOf(&p, e)
+			if len(keys) <= 0 {
+				continue
+			}
+			table = resolve(keys[:len(keys)-1])
+			table = append(table, keys[len(keys)-1])
+			if e.Kind == unstable.ArrayTable {
+				name := strings.Join(table, ".")
+				arrays[name]++
+				table = append(table, strconv.Itoa(arrays[name]-1))
+			}
+			pos.add(table, starts[len(starts)-1])
+		case unstable.KeyValue:
+			pos.addKeyValue(&p, table, e)
+		}
+	}
+	return pos
+}
+
+func keyOf(p *unstable.Parser, n *unstable.Node) (keys []string, starts []unstable.Position) {
+	it := n.Key()
+	for it.Next() {
+		key := it.Node()
+		keys = append(keys, string(key.Data))
+		starts = append(starts, p.Shape(key.Raw).Start)
+	}
+	return
+}
+
+func (pos positions) add(path []string, start unstable.Position) {
+	key := strings.Join(path, ".")
+	if _, ok := pos[key]; !ok {
+		pos[key] = start
+	}
+}
+
+func (pos positions) addKeyValue(p *unstable.Parser, table []string, kv *unstable.Node) {
+	keys, starts := keyOf(p, kv)
+	path := append([]string{}, table...)
+	for i, key := range keys {
+		path = append(path, key)
+		pos.add(path, starts[i])
+	}
+	pos.addValue(p, path, starts[len(starts)-1], kv.Value())
+}
+
+func (pos positions) addValue(p *unstable.Parser, path []string, start unstable.Position, value *unstable.Node) {
+	switch value.Kind {
+	case unstable.InlineTable:
+		it := value.Children()
+		for it.Next() {
+			pos.addKeyValue(p, path, it.Node())
+		}
+	case unstable.Array:
+		it := value.Children()
+		for i := 0; it.Next(); i++ {
+			elem := append(append([]string{}, path...), strconv.Itoa(i))
+			// elements carry no position, so they point to their first key
+			// or to the array itself
+			first := start
+			if child := it.Node(); child.Kind == unstable.InlineTable {
+				if kvs := child.Children(); kvs.Next() {
+					_, starts := keyOf(p, kvs.Node())
+					first = starts[0]
+				}
+			}
+			pos.add(elem, first)
+			pos.addValue(p, elem, first, it.Node())
+		}
+	}
+}
+
+// lookup returns the position of the longest defined prefix of key
+func (pos positions) lookup(key []string) (start unstable.Position, ok bool) {
+	for i := len(key); i > 0; i-- {
+		if start, ok = pos[strings.Join(key[:i], ".")]; ok {
+			return
+		}
+	}
+	return
+}
+
+func (pos positions) diagnostic(file string, err error) Diagnostic {
+	d := Diagnostic{File: file, Err: err}
+	if start, ok := pos.lookup(ErrorKey(err)); ok {
+		d.Line, d.Column = start.Line, start.Column
+	}
+	return d
+}
+
+// decodeStrict decodes a TOML document into v, returning a diagnostic for
+// the syntax error or for each key that v does not define. A document with
+// syntax errors is not decoded.
+func decodeStrict(file string, data []byte, v interface{}) (diagnostics []Diagnostic, ok bool) {
+	err := toml.Unmarshal(data, v)
+	var decodeErr *toml.DecodeError
+	if errors.As(err, &decodeErr) {
+		row, col := decodeErr.Position()
+		diagnostics = append(diagnostics, Diagnostic{File: file, Line: row, Column: col, Err: decodeErr})
+		return
+	}
+	if err != nil {
+		diagnostics = append(diagnostics, Diagnostic{File: file, Err: err})
+		return
+	}
+
+	decoder := toml.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var strictErr *toml.StrictMissingError
+	if err = decoder.Decode(v); errors.As(err, &strictErr) {
+		for _, e := range strictErr.Errors {
+			row, col := e.Position()
+			diagnostics = append(diagnostics, Diagnostic{
+				File:   file,
+				Line:   row,
+				Column: col,
+				Err:    fmt.Errorf("unknown key `%s`", strings.Join(e.Key(), ".")),
+			})
+		}
+	}
+	ok = true
+	return
+}
+
+// ParseConfigFile parses the global config file like ParseConfig, reporting
+// all problems found in it. The config is nil when it is not valid.
+func ParseConfigFile(file string, data []byte) (c *Config, diagnostics []Diagnostic) {
+	var raw RawConfig
+	diagnostics, ok := decodeStrict(file, data, &raw)
+	if !ok {
+		return
+	}
+
+	c, err := ValidateConfig(raw)
+	if err != nil {
+		diagnostics = append(diagnostics, indexPositions(data).diagnostic(file, err))
+		sortDiagnostics(diagnostics)
+		return nil, diagnostics
+	}
+	if len(diagnostics) > 0 {
+		c = nil
+	}
+	return
+}
+
+// ParseDomainFile parses a domain file like ParseDomain, reporting all
+// problems found in it. The domain is nil when it is not valid.
+func ParseDomainFile(file string, data []byte, config Config) (d *Domain, diagnostics []Diagnostic) {
+	d, diagnostics, _ = parseDomainFile(file, data, config)
+	return
+}
+
+func parseDomainFile(file string, data []byte, config Config) (d *Domain, diagnostics []Diagnostic, pos positions) {
+	var raw RawDomain
+	diagnostics, ok := decodeStrict(file, data, &raw)
+	if !ok {
+		return
+	}
+
+	pos = indexPositions(data)
+	d, errs := validateDomain(raw, config)
+	for _, err := range errs {
+		diagnostics = append(diagnostics, pos.diagnostic(file, err))
+	}
+	sortDiagnostics(diagnostics)
+	if len(diagnostics) > 0 {
+		d = nil
+	}
+	return
+}
+
+func sortDiagnostics(diagnostics []Diagnostic) {
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		if diagnostics[i].File != diagnostics[j].File {
+			return diagnostics[i].File < diagnostics[j].File
+		}
+		return diagnostics[i].Line < diagnostics[j].Line
+	})
+}
+
+// ValidateDomainFiles checks all domain files in f, reporting every problem
+// rather than stopping at the first one. Besides the problems of each file,
+// it reports domains defined more than once and paths installed by more
+// than one install, and warns about reload targets which do not exist. Only
+// valid domains are returned.
+func ValidateDomainFiles(f fs.FS, config Config) (domains []Domain, diagnostics []Diagnostic, err error) {
+	files, err := ListDomainFiles(f)
+	if err != nil {
+		return
+	}
+
+	defined := map[string]string{}
+	type owner struct{ file, domain string }
+	installed := map[string]owner{}
+	for _, file := range files {
+		var content []byte
+		content, err = fs.ReadFile(f, file)
+		if err != nil {
+			err = fmt.Errorf("could not read domain file %s: %w", file, err)
+			return
+		}
+
+		d, diags, pos := parseDomainFile(file, content, config)
+		diagnostics = append(diagnostics, diags...)
+		if d == nil {
+			continue
+		}
+
+		if other, ok := defined[d.Domain]; ok {
+			diagnostics = append(diagnostics, pos.diagnostic(file, atKey(fmt.Errorf("domain %s is already defined in %s", d.Domain, other), "domain")))
+			continue
+		}
+		defined[d.Domain] = file
+
+		valid := true
+		for i, inst := range d.Installs {
+			paths := installPaths(*d, inst)
+			sorted := make([]string, 0, len(paths))
+			for path := range paths {
+				sorted = append(sorted, path)
+			}
+			sort.Strings(sorted)
+			for _, path := range sorted {
+				if o, ok := installed[path]; ok {
+					err := fmt.Errorf("path %s is also installed by domain %s in %s", path, o.domain, o.file)
+					diagnostics = append(diagnostics, pos.diagnostic(file, atKey(err, "installs", strconv.Itoa(i), paths[path])))
+					valid = false
+					continue
+				}
+				installed[path] = owner{file, d.Domain}
+			}
+			if inst.Reload != nil {
+				if err := inst.Reload.Check(); err != nil {
+					d := pos.diagnostic(file, atKey(err, "installs", strconv.Itoa(i), "reload", string(inst.Reload.Method)))
+					d.Warning = true
+					diagnostics = append(diagnostics, d)
+				}
+			}
+		}
+		if valid {
+			domains = append(domains, *d)
+		}
+	}
+
+	sortDiagnostics(diagnostics)
+	return
+}
+
+// installPaths maps the paths written by an install, with the domain filled
+// in, to the key defining them. Paths with other placeholders only clash when
+// their templates are the same.
+func installPaths(domain Domain, inst Install) map[string]string {
+	i := inst.Resolve(map[string]string{PLACEHOLDER_DOMAIN: domain.Domain})
+	paths := map[string]string{}
+	for _, t := range []struct {
+		key    string
+		target *Target
+	}{
+		{"key", i.Key},
+		{"crt", i.Crt},
+		{"ca", i.CA},
+		{"leaf", i.Leaf},
+		{"chain", i.Chain},
+		{"fullchain", i.Fullchain},
+	} {
+		if t.target != nil {
+			paths[filepath.Clean(t.target.Path)] = t.key
+		}
+	}
+	if i.Concat != nil {
+		paths[filepath.Clean(i.Concat.Path)] = "concat"
+	}
+	if i.PKCS12 != nil {
+		paths[filepath.Clean(i.PKCS12.Path)] = "pkcs12"
+	}
+	if i.JKS != nil {
+		paths[filepath.Clean(i.JKS.Path)] = "jks"
+	}
+	if i.Live != nil {
+		paths[filepath.Clean(i.Live.Link)] = "live"
+	}
+	return paths
+}
@@ -0,0 +1,110 @@
+package sacme_test
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/lucat1/sacme"
+	"github.com/stretchr/testify/assert"
+)
+
+func positions(diagnostics []sacme.Diagnostic) (lines []string) {
+	for _, d := range diagnostics {
+		lines = append(lines, strings.SplitN(d.Error(), ": ", 2)[0])
+	}
+	return
+}
+
+func TestParseDomainFile(t *testing.T) {
+	rawDomain, _, _ := ValidRawDomain(t)
+	d, diagnostics := sacme.ParseDomainFile("example.com.toml", []byte(rawDomain), *DefaultConfig(t))
+	assert.Empty(t, diagnostics)
+	assert.Equal(t, "example.com", d.Domain)
+
+	d, diagnostics = sacme.ParseDomainFile("bad.toml", []byte(`domain = "example.com"
+colour = "blue"
+
+[account]
+email = "root@example.com"
+key_type = "dsa"
+
+[authentication]
+options = { bogus = "1" }
+
+[[installs]]
+key = { path = "/test/path.key" }
+
+[[installs]]
+hooks = ["true", { command = "true", on_failure = "panic" }]
+
+[[installs]]
+[installs.crt]
+path = "/test/path.crt"
+format = "gif"
+`), *DefaultConfig(t))
+	assert.Nil(t, d)
+	assert.Equal(t, []string{
+		"bad.toml:2:1",
+		"bad.toml:6:1",
+		"bad.toml:9:13",
+		"bad.toml:15:20",
+		"bad.toml:18:11",
+	}, positions(diagnostics))
+	assert.Contains(t, diagnostics[0].Error(), "unknown key `colour`")
+	assert.ErrorIs(t, diagnostics[3], sacme.InvalidHook)
+	assert.ErrorIs(t, diagnostics[4], sacme.InvalidFormat)
+
+	_, diagnostics = sacme.ParseDomainFile("syntax.toml", []byte("domain = \"example.com\"\n[account\n"), *DefaultConfig(t))
+	assert.Equal(t, []string{"syntax.toml:2:9"}, positions(diagnostics))
+}
+
+func TestParseConfigFile(t *testing.T) {
+	c, diagnostics := sacme.ParseConfigFile(sacme.CONFIG_FILE_NAME, []byte("[install]\nkey_perm = \"0640\"\n"))
+	assert.Empty(t, diagnostics)
+	assert.NotNil(t, c)
+
+	c, diagnostics = sacme.ParseConfigFile(sacme.CONFIG_FILE_NAME, []byte("[install]\nkey_perm = \"rw\"\nbogus = true\n"))
+	assert.Nil(t, c)
+	assert.Equal(t, []string{
+		sacme.CONFIG_FILE_NAME + ":2:1",
+		sacme.CONFIG_FILE_NAME + ":3:1",
+	}, positions(diagnostics))
+}
+
+func TestValidateDomainFiles(t *testing.T) {
+	rawDomain, _, _ := ValidRawDomain(t)
+	other := strings.Replace(rawDomain, `domain = "example.com"`, `domain = "example.org"`, 1)
+	fs := fstest.MapFS{
+		"a.toml":               &fstest.MapFile{Data: []byte(rawDomain)},
+		"b.toml":               &fstest.MapFile{Data: []byte(rawDomain)},
+		"c.toml":               &fstest.MapFile{Data: []byte(other)},
+		"d.toml":               &fstest.MapFile{Data: []byte("domain = [")},
+		"e.toml":               &fstest.MapFile{Data: []byte(strings.ReplaceAll(strings.Replace(rawDomain, `"example.com"`, `"example.net"`, 1), "/test/path", "/test/{domain}"))},
+		sacme.CONFIG_FILE_NAME: &fstest.MapFile{Data: []byte("rootless = [")},
+	}
+
+	domains, diagnostics, err := sacme.ValidateDomainFiles(fs, *DefaultConfig(t))
+	assert.Nil(t, err)
+	assert.Len(t, domains, 2)
+	assert.Equal(t, []string{"b.toml:2:1", "c.toml:12:11", "c.toml:18:11", "d.toml:1:11"}, positions(diagnostics))
+	assert.Contains(t, diagnostics[0].Error(), "domain example.com is already defined in a.toml")
+	assert.Contains(t, diagnostics[1].Error(), "path /test/path.key is also installed by domain example.com in a.toml")
+}
+
+func TestValidateDomainFilesReloadWarning(t *testing.T) {
+	rawDomain, _, _ := ValidRawDomain(t)
+	withReload := strings.Replace(rawDomain, "[installs.key]", "[installs.reload]\npidfile = \"/sacme/no/such.pid\"\n\n[installs.key]", 1)
+	fs := fstest.MapFS{
+		"a.toml": &fstest.MapFile{Data: []byte(withReload)},
+	}
+
+	domains, diagnostics, err := sacme.ValidateDomainFiles(fs, *DefaultConfig(t))
+	assert.Nil(t, err)
+	// the domain is still valid, as the service may not be running yet
+	assert.Len(t, domains, 1)
+	assert.Len(t, diagnostics, 1)
+	assert.True(t, diagnostics[0].Warning)
+	assert.ErrorIs(t, diagnostics[0], sacme.InvalidReload)
+	assert.Regexp(t, `^a\.toml:\d+:\d+: warning: .*/sacme/no/such.pid`, diagnostics[0].Error())
+}